@@ -0,0 +1,84 @@
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	cmdattach "k8s.io/kubectl/pkg/cmd/attach"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/completion"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+)
+
+// rexecAttach sends the attach of upstream kubectl to the rexec endpoint
+type rexecAttach struct {
+	// justification of the session, passed on to the rexec server
+	Reason string
+	Ticket string
+	// emergency access skipping the checks of the rexec server
+	BreakGlass bool
+	errOut     io.Writer
+}
+
+// mirrors the upstream attach command, only the endpoint differs
+func newAttachCmd(f cmdutil.Factory, streams genericiooptions.IOStreams) *cobra.Command {
+	o := cmdattach.NewAttachOptions(streams)
+	attach := &rexecAttach{errOut: streams.ErrOut}
+	o.Attach = attach
+	cmd := &cobra.Command{
+		Use:                   "attach (POD | TYPE/NAME) -c CONTAINER",
+		DisableFlagsInUseLine: true,
+		Short:                 i18n.T("Attach to a running container through rexec"),
+		Long:                  i18n.T("Attach to a process that is already running inside an existing container, audited by rexec."),
+		Example: templates.Examples(`
+      # attach to the shell running in the app container of mypod
+      kubectl rexec attach mypod -c app -i -t --reason "debugging the stuck worker"`),
+		ValidArgsFunction: completion.PodResourceNameCompletionFunc(f),
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(o.Complete(f, cmd, args))
+			cmdutil.CheckErr(o.Validate())
+			cmdutil.CheckErr(o.Run())
+		},
+	}
+	cmdutil.AddPodRunningTimeoutFlag(cmd, defaultPodExecTimeout)
+	cmdutil.AddContainerVarFlags(cmd, &o.ContainerName, o.ContainerName)
+	cmd.Flags().BoolVarP(&o.Stdin, "stdin", "i", o.Stdin, "Pass stdin to the container")
+	cmd.Flags().BoolVarP(&o.TTY, "tty", "t", o.TTY, "Stdin is a TTY")
+	cmd.Flags().BoolVarP(&o.Quiet, "quiet", "q", o.Quiet, "Only print output from the remote session")
+	cmd.Flags().StringVar(&attach.Reason, "reason", "", "Why the session is needed, required in some namespaces, ends up in the audit log")
+	cmd.Flags().StringVar(&attach.Ticket, "ticket", "", "Ticket or incident the session belongs to, ends up in the audit log")
+	cmd.Flags().BoolVar(&attach.BreakGlass, "break-glass", false, "Skip approvals and policies in an emergency, only for members of a break-glass group, everything done in the session is audited")
+	return cmd
+}
+
+// Attach rewrites the url upstream kubectl built for the pod to the rexec
+// endpoint and attaches the usual way
+func (a *rexecAttach) Attach(u *url.URL, config *restclient.Config, stdin io.Reader, stdout, stderr io.Writer, tty bool, terminalSizeQueue remotecommand.TerminalSizeQueue) error {
+	rexecURL := *u
+	rexecURL.Path = strings.Replace(u.Path, "/api/v1/namespaces/", "/apis/audit.adyen.internal/v1beta1/namespaces/", 1)
+	query := rexecURL.Query()
+	if a.Reason != "" {
+		query.Set("reason", a.Reason)
+	}
+	if a.Ticket != "" {
+		query.Set("ticket", a.Ticket)
+	}
+	rexecURL.RawQuery = query.Encode()
+
+	if a.BreakGlass {
+		fmt.Fprintln(a.errOut, "warning: this is a break-glass session, everything you type and see is audited")
+		config = restclient.CopyConfig(config)
+		config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+			return &headerRoundTripper{header: breakGlassHeader, value: "true", next: rt}
+		})
+	}
+	return (&cmdattach.DefaultRemoteAttach{}).Attach(&rexecURL, config, stdin, stdout, stderr, tty, terminalSizeQueue)
+}
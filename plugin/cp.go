@@ -0,0 +1,93 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	restclient "k8s.io/client-go/rest"
+	cmdcp "k8s.io/kubectl/pkg/cmd/cp"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+)
+
+// execRoundTripper sends the execs upstream kubectl makes on its own
+// to the rexec endpoint, along with the justification
+type execRoundTripper struct {
+	reason string
+	ticket string
+	next   http.RoundTripper
+}
+
+func (e *execRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.Contains(req.URL.Path, "/api/v1/namespaces/") || !strings.HasSuffix(req.URL.Path, "/exec") {
+		return e.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.URL.Path = strings.Replace(req.URL.Path, "/api/v1/namespaces/", "/apis/audit.adyen.internal/v1beta1/namespaces/", 1)
+	req.URL.RawPath = ""
+	query := req.URL.Query()
+	if e.reason != "" {
+		query.Set("reason", e.reason)
+	}
+	if e.ticket != "" {
+		query.Set("ticket", e.ticket)
+	}
+	req.URL.RawQuery = query.Encode()
+	return e.next.RoundTrip(req)
+}
+
+// mirrors the upstream cp command, the tar it runs in the container
+// goes through rexec which audits the files copied
+func newCpCmd(f cmdutil.Factory, streams genericiooptions.IOStreams) *cobra.Command {
+	o := cmdcp.NewCopyOptions(streams)
+	upstream := cmdcp.NewCmdCp(f, streams)
+	var reason, ticket string
+	var breakGlass bool
+	cmd := &cobra.Command{
+		Use:                   "cp <file-spec-src> <file-spec-dest>",
+		DisableFlagsInUseLine: true,
+		Short:                 i18n.T("Copy files and directories to and from containers through rexec"),
+		Long: templates.LongDesc(`
+      Copy files and directories to and from containers the way kubectl cp
+      does. The copy runs tar in the container through rexec, which audits
+      the name, size and sha256 of every file copied and can refuse copies
+      in some namespaces.
+
+      Like with kubectl cp, tar has to be present in the container image.`),
+		Example: templates.Examples(`
+      # copy a local file into the app container of mypod
+      kubectl rexec cp /tmp/app.conf mypod:/etc/app/app.conf -c app --reason "hotfix of the listen address"
+
+      # copy a heap dump out of a pod in namespace prod
+      kubectl rexec cp prod/mypod:/tmp/heap.hprof ./heap.hprof --ticket INC-1234`),
+		ValidArgsFunction: upstream.ValidArgsFunction,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(o.Complete(f, cmd, args))
+			config := restclient.CopyConfig(o.ClientConfig)
+			config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+				return &execRoundTripper{reason: reason, ticket: ticket, next: rt}
+			})
+			if breakGlass {
+				fmt.Fprintln(streams.ErrOut, "warning: this is a break-glass session, everything you copy is audited")
+				config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+					return &headerRoundTripper{header: breakGlassHeader, value: "true", next: rt}
+				})
+			}
+			o.ClientConfig = config
+			cmdutil.CheckErr(o.Validate())
+			cmdutil.CheckErr(o.Run())
+		},
+	}
+	// --retries is left out, a resumed copy is no archive
+	// rexec could recognize and audit
+	cmdutil.AddContainerVarFlags(cmd, &o.Container, o.Container)
+	cmd.Flags().BoolVar(&o.NoPreserve, "no-preserve", false, "The copied file/directory's ownership and permissions will not be preserved in the container")
+	cmd.Flags().StringVar(&reason, "reason", "", "Why the copy is needed, required in some namespaces, ends up in the audit log")
+	cmd.Flags().StringVar(&ticket, "ticket", "", "Ticket or incident the copy belongs to, ends up in the audit log")
+	cmd.Flags().BoolVar(&breakGlass, "break-glass", false, "Skip approvals and policies in an emergency, only for members of a break-glass group, everything copied is audited")
+	return cmd
+}
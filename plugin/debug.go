@@ -0,0 +1,149 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	cmdattach "k8s.io/kubectl/pkg/cmd/attach"
+	cmdexec "k8s.io/kubectl/pkg/cmd/exec"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/completion"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+)
+
+type debugOptions struct {
+	cmdexec.StreamOptions
+	rexecAttach
+
+	Image     string
+	Target    string
+	Container string
+}
+
+func newDebugCmd(f cmdutil.Factory, streams genericiooptions.IOStreams) *cobra.Command {
+	o := &debugOptions{StreamOptions: cmdexec.StreamOptions{IOStreams: streams}}
+	o.errOut = streams.ErrOut
+	cmd := &cobra.Command{
+		Use:                   "debug POD --image=IMAGE [-- COMMAND [args...]]",
+		DisableFlagsInUseLine: true,
+		Short:                 i18n.T("Debug a pod with an ephemeral container through rexec"),
+		Long: templates.LongDesc(`
+      Add an ephemeral container to a running pod and attach to it, the
+      way kubectl debug does. The container is added by rexec, which only
+      runs the images it allows, and the session is audited like an exec.`),
+		Example: templates.Examples(`
+      # debug the app container of mypod with a shell sharing its processes
+      kubectl rexec debug mypod -it --image=busybox:1.36 --target=app --reason "checking open files"`),
+		ValidArgsFunction: completion.PodResourceNameCompletionFunc(f),
+		Args:              cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if o.Image == "" {
+				cmdutil.CheckErr(fmt.Errorf("--image is required"))
+			}
+			timeout, err := cmdutil.GetPodRunningTimeoutFlag(cmd)
+			cmdutil.CheckErr(err)
+			cmdutil.CheckErr(o.run(f, cmd, args[0], args[1:], timeout))
+		},
+	}
+	cmdutil.AddPodRunningTimeoutFlag(cmd, defaultPodExecTimeout)
+	cmd.Flags().StringVar(&o.Image, "image", "", "Image of the debug container, rexec decides which are allowed")
+	cmd.Flags().StringVar(&o.Target, "target", "", "Container whose processes the debug container shares")
+	cmd.Flags().StringVarP(&o.Container, "container", "c", "", "Name of the debug container, generated if empty")
+	cmd.Flags().BoolVarP(&o.Stdin, "stdin", "i", false, "Keep stdin open on the container and attach to it")
+	cmd.Flags().BoolVarP(&o.TTY, "tty", "t", false, "Allocate a TTY for the debug container")
+	cmd.Flags().BoolVarP(&o.Quiet, "quiet", "q", false, "Only print output from the remote session")
+	cmd.Flags().StringVar(&o.Reason, "reason", "", "Why the session is needed, required in some namespaces, ends up in the audit log")
+	cmd.Flags().StringVar(&o.Ticket, "ticket", "", "Ticket or incident the session belongs to, ends up in the audit log")
+	cmd.Flags().BoolVar(&o.BreakGlass, "break-glass", false, "Skip approvals and policies in an emergency, only for members of a break-glass group, everything done in the session is audited")
+	return cmd
+}
+
+func (o *debugOptions) run(f cmdutil.Factory, cmd *cobra.Command, podName string, command []string, timeout time.Duration) error {
+	namespace, _, err := f.ToRawKubeConfigLoader().Namespace()
+	if err != nil {
+		return err
+	}
+	client, err := f.RESTClient()
+	if err != nil {
+		return err
+	}
+	req := client.Post().AbsPath(rexecAPIPath, namespace, "pods", podName, "debug").
+		Param("image", o.Image).
+		Param("target", o.Target).
+		Param("container", o.Container).
+		Param("stdin", fmt.Sprint(o.Stdin)).
+		Param("tty", fmt.Sprint(o.TTY)).
+		Param("reason", o.Reason).
+		Param("ticket", o.Ticket)
+	for _, arg := range command {
+		req = req.Param("command", arg)
+	}
+	if o.BreakGlass {
+		req = req.SetHeader(breakGlassHeader, "true")
+	}
+	raw, err := req.Do(context.TODO()).Raw()
+	if err != nil {
+		return err
+	}
+	container := corev1.EphemeralContainer{}
+	if err := json.Unmarshal(raw, &container); err != nil {
+		return err
+	}
+	if o.Container == "" && !o.Quiet {
+		fmt.Fprintf(o.ErrOut, "Defaulting debug container name to %s.\n", container.Name)
+	}
+	if !o.Stdin {
+		return nil
+	}
+
+	// the container has to run before anything can be attached to it
+	clientset, err := f.KubernetesClientSet()
+	if err != nil {
+		return err
+	}
+	var pod *corev1.Pod
+	err = wait.PollUntilContextTimeout(context.TODO(), time.Second, timeout, true, func(ctx context.Context) (bool, error) {
+		pod, err = clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, status := range pod.Status.EphemeralContainerStatuses {
+			if status.Name != container.Name {
+				continue
+			}
+			if status.State.Terminated != nil {
+				return false, fmt.Errorf("debug container %s terminated: %s", container.Name, status.State.Terminated.Reason)
+			}
+			return status.State.Running != nil, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	config, err := f.ToRESTConfig()
+	if err != nil {
+		return err
+	}
+	attach := &cmdattach.AttachOptions{
+		StreamOptions: o.StreamOptions,
+		CommandName:   cmd.Parent().CommandPath() + " attach",
+		Attach:        &o.rexecAttach,
+		AttachFunc:    cmdattach.DefaultAttachFunc,
+		Pod:           pod,
+		Config:        config,
+	}
+	attach.Namespace = namespace
+	attach.PodName = podName
+	attach.ContainerName = container.Name
+	return attach.Run()
+}
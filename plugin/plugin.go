@@ -3,6 +3,7 @@ package plugin
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
 	"time"
 
@@ -106,18 +107,36 @@ func Rexec() {
 	newExec.Flags().BoolVarP(&roptions.ExecOptions.Stdin, "stdin", "i", roptions.ExecOptions.Stdin, "Pass stdin to the container")
 	newExec.Flags().BoolVarP(&roptions.ExecOptions.TTY, "tty", "t", roptions.ExecOptions.TTY, "Stdin is a TTY")
 	newExec.Flags().BoolVarP(&roptions.ExecOptions.Quiet, "quiet", "q", roptions.ExecOptions.Quiet, "Only print output from the remote session")
+	newExec.Flags().StringVar(&roptions.Reason, "reason", "", "Why the session is needed, required in some namespaces, ends up in the audit log")
+	newExec.Flags().StringVar(&roptions.Ticket, "ticket", "", "Ticket or incident the session belongs to, ends up in the audit log")
+	newExec.Flags().BoolVar(&roptions.BreakGlass, "break-glass", false, "Skip approvals and policies in an emergency, only for members of a break-glass group, everything done in the session is audited")
 
 	cmds.AddCommand(newExec)
+	cmds.AddCommand(newAttachCmd(f, kubectlOptions.IOStreams))
+	cmds.AddCommand(newDebugCmd(f, kubectlOptions.IOStreams))
+	cmds.AddCommand(newCpCmd(f, kubectlOptions.IOStreams))
+	cmds.AddCommand(newPortForwardCmd(f, kubectlOptions.IOStreams))
+	cmds.AddCommand(newRequestCmd(f, kubectlOptions.IOStreams))
+	cmds.AddCommand(newDecisionCmd(f, kubectlOptions.IOStreams, true))
+	cmds.AddCommand(newDecisionCmd(f, kubectlOptions.IOStreams, false))
+	cmds.AddCommand(newWatchCmd(f, kubectlOptions.IOStreams))
+	cmds.AddCommand(newReplayCmd(f, kubectlOptions.IOStreams))
 
 	cmds.Execute()
 }
 
 type RexecOptoins struct {
 	*cmdexec.ExecOptions
+
+	// justification of the session, passed on to the rexec server
+	Reason string
+	Ticket string
+	// emergency access skipping the checks of the rexec server
+	BreakGlass bool
 }
 
 func NewRexecOptions(e *cmdexec.ExecOptions) *RexecOptoins {
-	r := RexecOptoins{e}
+	r := RexecOptoins{ExecOptions: e}
 	return &r
 }
 
@@ -170,6 +189,10 @@ func (r *RexecOptoins) rexecRun() error {
 		containerName = container.Name
 	}
 
+	if r.BreakGlass {
+		fmt.Fprintln(r.ExecOptions.ErrOut, "warning: this is a break-glass session, everything you type and see is audited")
+	}
+
 	t := r.ExecOptions.SetupTTY()
 
 	var sizeQueue remotecommand.TerminalSizeQueue
@@ -194,8 +217,22 @@ func (r *RexecOptoins) rexecRun() error {
 			Stderr:    r.ExecOptions.ErrOut != nil,
 			TTY:       t.Raw,
 		}, scheme.ParameterCodec)
+		if r.Reason != "" {
+			req.Param("reason", r.Reason)
+		}
+		if r.Ticket != "" {
+			req.Param("ticket", r.Ticket)
+		}
+
+		config := r.ExecOptions.Config
+		if r.BreakGlass {
+			config = restclient.CopyConfig(config)
+			config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+				return &headerRoundTripper{header: breakGlassHeader, value: "true", next: rt}
+			})
+		}
 
-		return r.ExecOptions.Executor.Execute(req.URL(), r.ExecOptions.Config, r.ExecOptions.In, r.ExecOptions.Out, r.ExecOptions.ErrOut, t.Raw, sizeQueue)
+		return r.ExecOptions.Executor.Execute(req.URL(), config, r.ExecOptions.In, r.ExecOptions.Out, r.ExecOptions.ErrOut, t.Raw, sizeQueue)
 	}
 
 	if err := t.Safe(fn); err != nil {
@@ -204,3 +241,19 @@ func (r *RexecOptoins) rexecRun() error {
 
 	return nil
 }
+
+// header the rexec server recognizes break-glass sessions by
+const breakGlassHeader = "X-Rexec-Break-Glass"
+
+// headerRoundTripper sets a header on every request
+type headerRoundTripper struct {
+	header string
+	value  string
+	next   http.RoundTripper
+}
+
+func (h *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(h.header, h.value)
+	return h.next.RoundTrip(req)
+}
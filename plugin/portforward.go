@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+	cmdportforward "k8s.io/kubectl/pkg/cmd/portforward"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/completion"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+)
+
+// rexecPortForwarder sends the port-forward of upstream kubectl to the
+// rexec endpoint
+type rexecPortForwarder struct {
+	genericiooptions.IOStreams
+	// justification of the session, passed on to the rexec server
+	Reason string
+	Ticket string
+	// emergency access skipping the checks of the rexec server
+	BreakGlass bool
+}
+
+// mirrors the upstream port-forward command, only the endpoint differs
+func newPortForwardCmd(f cmdutil.Factory, streams genericiooptions.IOStreams) *cobra.Command {
+	opts := cmdportforward.NewDefaultPortForwardOptions(streams)
+	forwarder := &rexecPortForwarder{IOStreams: streams}
+	opts.PortForwarder = forwarder
+	cmd := &cobra.Command{
+		Use:                   "port-forward TYPE/NAME [options] [LOCAL_PORT:]REMOTE_PORT [...[LOCAL_PORT_N:]REMOTE_PORT_N]",
+		DisableFlagsInUseLine: true,
+		Short:                 i18n.T("Forward one or more local ports to a pod through rexec"),
+		Long: templates.LongDesc(`
+      Forward one or more local ports to a pod the way kubectl port-forward
+      does. The connections go through rexec, which audits the ports used,
+      the number of connections, the bytes transferred and how long they
+      were open.`),
+		Example: templates.Examples(`
+      # listen on port 8080 locally, forwarding to port 80 of mypod
+      kubectl rexec port-forward mypod 8080:80 --reason "checking the admin page"
+
+      # forward to the postgres port of a pod of the deployment in namespace prod
+      kubectl rexec port-forward -n prod deployment/db 5432 --ticket INC-1234`),
+		ValidArgsFunction: completion.ResourceAndPortCompletionFunc(f),
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(opts.Complete(f, cmd, args))
+			cmdutil.CheckErr(opts.Validate())
+			cmdutil.CheckErr(opts.RunPortForward())
+		},
+	}
+	cmdutil.AddPodRunningTimeoutFlag(cmd, defaultPodExecTimeout)
+	cmd.Flags().StringSliceVar(&opts.Address, "address", []string{"localhost"}, "Addresses to listen on (comma separated). Only accepts IP addresses or localhost as a value.")
+	cmd.Flags().StringVar(&forwarder.Reason, "reason", "", "Why the port-forward is needed, required in some namespaces, ends up in the audit log")
+	cmd.Flags().StringVar(&forwarder.Ticket, "ticket", "", "Ticket or incident the port-forward belongs to, ends up in the audit log")
+	cmd.Flags().BoolVar(&forwarder.BreakGlass, "break-glass", false, "Skip approvals and policies in an emergency, only for members of a break-glass group, every connection is audited")
+	return cmd
+}
+
+// ForwardPorts rewrites the url upstream kubectl built for the pod to the
+// rexec endpoint, only spdy is used as rexec does not follow the
+// websocket tunnel
+func (f *rexecPortForwarder) ForwardPorts(method string, u *url.URL, opts cmdportforward.PortForwardOptions) error {
+	rexecURL := *u
+	rexecURL.Path = strings.Replace(u.Path, "/api/v1/namespaces/", "/apis/audit.adyen.internal/v1beta1/namespaces/", 1)
+	query := rexecURL.Query()
+	if f.Reason != "" {
+		query.Set("reason", f.Reason)
+	}
+	if f.Ticket != "" {
+		query.Set("ticket", f.Ticket)
+	}
+	// the remote ports, the session names them before any connection
+	for _, port := range opts.Ports {
+		query.Add("ports", port[strings.LastIndex(port, ":")+1:])
+	}
+	rexecURL.RawQuery = query.Encode()
+
+	config := opts.Config
+	if f.BreakGlass {
+		fmt.Fprintln(f.ErrOut, "warning: this is a break-glass session, every connection is audited")
+		config = restclient.CopyConfig(config)
+		config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+			return &headerRoundTripper{header: breakGlassHeader, value: "true", next: rt}
+		})
+	}
+
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return err
+	}
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, method, &rexecURL)
+	fw, err := portforward.NewOnAddresses(dialer, opts.Address, opts.Ports, opts.StopChannel, opts.ReadyChannel, f.Out, f.ErrOut)
+	if err != nil {
+		return err
+	}
+	return fw.ForwardPorts()
+}
@@ -0,0 +1,273 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+	"k8s.io/kubectl/pkg/util/term"
+)
+
+// how far the arrow keys seek
+const seekStep = 5 * time.Second
+
+// castEvent is a line of an asciinema v2 recording
+type castEvent struct {
+	at   time.Duration
+	data string
+}
+
+// recordedCommands is what rexec returns for --commands-only
+type recordedCommands struct {
+	Commands []struct {
+		Time      float64 `json:"time"`
+		Command   string  `json:"command"`
+		Uncertain bool    `json:"uncertain"`
+	} `json:"commands"`
+}
+
+type replayOptions struct {
+	speed        float64
+	maxIdle      time.Duration
+	commandsOnly bool
+	output       string
+}
+
+func newReplayCmd(f cmdutil.Factory, streams genericiooptions.IOStreams) *cobra.Command {
+	o := replayOptions{}
+	cmd := &cobra.Command{
+		Use:   "replay SESSION",
+		Short: i18n.T("Play back a recorded tty session"),
+		Long: templates.LongDesc(`
+      Play back a tty session recorded by rexec in the local terminal.
+
+      While playing, space pauses, the left and right arrows seek 5s back
+      and forth, + and - change the speed and q stops.`),
+		Example: templates.Examples(`
+      # play a session at twice the speed, skipping long pauses
+      kubectl rexec replay -n prod 0b6f1c9e-1f0e-4bb5-9d5e-52f4b5e0a4d1 --speed 2 --max-idle 2s
+
+      # list the commands typed in a session
+      kubectl rexec replay -n prod 0b6f1c9e-1f0e-4bb5-9d5e-52f4b5e0a4d1 --commands-only
+
+      # save a session for asciinema play
+      kubectl rexec replay -n prod 0b6f1c9e-1f0e-4bb5-9d5e-52f4b5e0a4d1 -o session.cast`),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if o.speed <= 0 {
+				cmdutil.CheckErr(fmt.Errorf("--speed has to be positive"))
+			}
+			cmdutil.CheckErr(o.run(f, streams, args[0]))
+		},
+	}
+	cmd.Flags().Float64Var(&o.speed, "speed", 1, "Playback speed, 2 plays twice as fast")
+	cmd.Flags().DurationVar(&o.maxIdle, "max-idle", 0, "Shorten pauses longer than this, 0 keeps them")
+	cmd.Flags().BoolVar(&o.commandsOnly, "commands-only", false, "Only list the commands typed in the session")
+	cmd.Flags().StringVarP(&o.output, "output", "o", "", "Save the recording into this .cast file instead of playing it")
+	return cmd
+}
+
+func (o *replayOptions) run(f cmdutil.Factory, streams genericiooptions.IOStreams, session string) error {
+	namespace, _, err := f.ToRawKubeConfigLoader().Namespace()
+	if err != nil {
+		return err
+	}
+	client, err := f.RESTClient()
+	if err != nil {
+		return err
+	}
+	req := client.Get().AbsPath(rexecAPIPath, namespace, "execsessions", session, "recording")
+	if o.commandsOnly {
+		req = req.Param("commands", "true")
+	}
+	raw, err := req.Do(context.TODO()).Raw()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case o.commandsOnly:
+		commands := recordedCommands{}
+		if err := json.Unmarshal(raw, &commands); err != nil {
+			return err
+		}
+		for _, command := range commands.Commands {
+			at := time.Duration(command.Time * float64(time.Second)).Truncate(time.Second)
+			mark := ""
+			if command.Uncertain {
+				mark = "  (may differ, history or completion was used)"
+			}
+			fmt.Fprintf(streams.Out, "%8s  %s%s\n", at, command.Command, mark)
+		}
+		return nil
+	case o.output != "":
+		if err := os.WriteFile(o.output, raw, 0600); err != nil {
+			return err
+		}
+		fmt.Fprintf(streams.ErrOut, "recording of %s saved to %s\n", session, o.output)
+		return nil
+	}
+
+	events, err := parseCast(raw)
+	if err != nil {
+		return err
+	}
+	p := &player{events: events, out: streams.Out, speed: o.speed, maxIdle: o.maxIdle}
+	tty := term.TTY{In: streams.In, Out: streams.Out, Raw: true}
+	if !tty.IsTerminalIn() {
+		return p.play(nil)
+	}
+	return tty.Safe(func() error {
+		return p.play(readKeys(streams.In))
+	})
+}
+
+// parseCast reads the output of a recording
+func parseCast(raw []byte) ([]castEvent, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 64*1024), len(raw)+1)
+	// the first line is the header
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("empty recording")
+	}
+	var events []castEvent
+	for scanner.Scan() {
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+			continue
+		}
+		at, _ := event[0].(float64)
+		kind, _ := event[1].(string)
+		data, _ := event[2].(string)
+		if kind != "o" {
+			continue
+		}
+		events = append(events, castEvent{at: time.Duration(at * float64(time.Second)), data: data})
+	}
+	return events, scanner.Err()
+}
+
+// readKeys turns what is typed during the playback into keys, arrows
+// become h and l
+func readKeys(in io.Reader) <-chan byte {
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := in.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			switch string(buf[:n]) {
+			case "\x1b[D":
+				keys <- 'h'
+			case "\x1b[C":
+				keys <- 'l'
+			default:
+				for _, key := range buf[:n] {
+					keys <- key
+				}
+			}
+		}
+	}()
+	return keys
+}
+
+// player writes the output of a recording with its timing
+type player struct {
+	events  []castEvent
+	out     io.Writer
+	speed   float64
+	maxIdle time.Duration
+	// the position in the recording and the next event to write
+	position time.Duration
+	next     int
+	paused   bool
+}
+
+func (p *player) play(keys <-chan byte) error {
+	for p.next < len(p.events) {
+		wait := p.events[p.next].at - p.position
+		if p.maxIdle > 0 && wait > p.maxIdle {
+			// the time skipped is taken out of the recording
+			p.position += wait - p.maxIdle
+			wait = p.maxIdle
+		}
+		var timer <-chan time.Time
+		if !p.paused {
+			timer = time.After(time.Duration(float64(wait) / p.speed))
+		}
+		started := time.Now()
+		select {
+		case <-timer:
+			p.write()
+		case key, ok := <-keys:
+			if !ok {
+				// nobody can resume the playback anymore
+				keys = nil
+				p.paused = false
+				continue
+			}
+			if !p.paused {
+				p.position += min(time.Duration(float64(time.Since(started))*p.speed), wait)
+			}
+			if !p.handleKey(key) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// write writes the next event
+func (p *player) write() {
+	event := p.events[p.next]
+	io.WriteString(p.out, event.data)
+	p.position = event.at
+	p.next++
+}
+
+// handleKey acts on a key, it returns false to stop the playback
+func (p *player) handleKey(key byte) bool {
+	switch key {
+	case ' ':
+		p.paused = !p.paused
+	case '+':
+		p.speed *= 2
+	case '-':
+		p.speed /= 2
+	case 'l':
+		p.seek(p.position + seekStep)
+	case 'h':
+		p.seek(p.position - seekStep)
+	case 'q', 0x03:
+		return false
+	}
+	return true
+}
+
+// seek moves to a position, going back means drawing the screen
+// from the start of the recording
+func (p *player) seek(to time.Duration) {
+	if to < p.position {
+		// reset the terminal
+		io.WriteString(p.out, "\x1bc")
+		p.next = 0
+	}
+	for p.next < len(p.events) && p.events[p.next].at <= to {
+		io.WriteString(p.out, p.events[p.next].data)
+		p.next++
+	}
+	p.position = max(to, 0)
+}
@@ -0,0 +1,122 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+)
+
+// exec requests are created and decided through the rexec api,
+// which keeps them as ExecRequest resources, live sessions are
+// served there as well
+
+const rexecAPIPath = "/apis/audit.adyen.internal/v1beta1/namespaces"
+
+// execRequest holds the parts of an ExecRequest the plugin prints
+type execRequest struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		Requester string `json:"requester"`
+		Pod       string `json:"pod"`
+		Reason    string `json:"reason"`
+		Ticket    string `json:"ticket,omitempty"`
+		Duration  string `json:"duration,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Phase     string     `json:"phase"`
+		Approver  string     `json:"approver"`
+		ExpiresAt *time.Time `json:"expiresAt"`
+	} `json:"status"`
+}
+
+func newRequestCmd(f cmdutil.Factory, streams genericiooptions.IOStreams) *cobra.Command {
+	request := execRequest{}
+	var duration time.Duration
+	cmd := &cobra.Command{
+		Use:   "request --pod POD --reason REASON",
+		Short: i18n.T("Ask for exec access to a pod in a namespace requiring approval"),
+		Long: templates.LongDesc(`
+      Ask for exec access to a pod, once someone else approved the request
+      rexec lets your sessions into the pod until the request expires.`),
+		Example: templates.Examples(`
+      kubectl rexec request -n prod --pod payouts-0 --reason "payouts are stuck" --ticket INC-1234`),
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if request.Spec.Pod == "" || request.Spec.Reason == "" {
+				cmdutil.CheckErr(fmt.Errorf("--pod and --reason are required"))
+			}
+			if duration > 0 {
+				request.Spec.Duration = duration.String()
+			}
+			body, err := json.Marshal(request)
+			cmdutil.CheckErr(err)
+			created, err := postExecRequest(f, body)
+			cmdutil.CheckErr(err)
+			fmt.Fprintf(streams.Out, "exec request %s created, it can be approved with:\n  kubectl rexec approve -n %s %s\n",
+				created.Metadata.Name, created.Metadata.Namespace, created.Metadata.Name)
+		},
+	}
+	cmd.Flags().StringVar(&request.Spec.Pod, "pod", "", "Pod to ask access to")
+	cmd.Flags().StringVar(&request.Spec.Reason, "reason", "", "Why the access is needed")
+	cmd.Flags().StringVar(&request.Spec.Ticket, "ticket", "", "Ticket or incident the access is needed for")
+	cmd.Flags().DurationVar(&duration, "duration", 0, "How long the access is needed, the server caps it")
+	return cmd
+}
+
+func newDecisionCmd(f cmdutil.Factory, streams genericiooptions.IOStreams, approve bool) *cobra.Command {
+	verb, short := "deny", "Deny an exec request of someone else"
+	if approve {
+		verb, short = "approve", "Approve an exec request of someone else"
+	}
+	var message string
+	cmd := &cobra.Command{
+		Use:   verb + " NAME",
+		Short: i18n.T(short),
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			body, err := json.Marshal(map[string]string{"message": message})
+			cmdutil.CheckErr(err)
+			decided, err := postExecRequest(f, body, args[0], verb)
+			cmdutil.CheckErr(err)
+			if decided.Status.ExpiresAt != nil {
+				fmt.Fprintf(streams.Out, "exec request %s of %s for %s is %s until %s\n", decided.Metadata.Name, decided.Spec.Requester,
+					decided.Spec.Pod, decided.Status.Phase, decided.Status.ExpiresAt.Local().Format(time.RFC1123))
+				return
+			}
+			fmt.Fprintf(streams.Out, "exec request %s of %s for %s is %s\n", decided.Metadata.Name, decided.Spec.Requester,
+				decided.Spec.Pod, decided.Status.Phase)
+		},
+	}
+	cmd.Flags().StringVar(&message, "message", "", "Note for the requester and the audit log")
+	return cmd
+}
+
+// postExecRequest posts to the exec requests of the current namespace,
+// or to a subresource of one of them
+func postExecRequest(f cmdutil.Factory, body []byte, segments ...string) (*execRequest, error) {
+	namespace, _, err := f.ToRawKubeConfigLoader().Namespace()
+	if err != nil {
+		return nil, err
+	}
+	client, err := f.RESTClient()
+	if err != nil {
+		return nil, err
+	}
+	path := append([]string{rexecAPIPath, namespace, "execrequests"}, segments...)
+	raw, err := client.Post().AbsPath(path...).Body(body).Do(context.TODO()).Raw()
+	if err != nil {
+		return nil, err
+	}
+	request := &execRequest{}
+	return request, json.Unmarshal(raw, request)
+}
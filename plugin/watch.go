@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericiooptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/i18n"
+	"k8s.io/kubectl/pkg/util/templates"
+)
+
+// castHeader holds the parts of an asciinema v2 header the plugin prints
+type castHeader struct {
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title"`
+}
+
+func newWatchCmd(f cmdutil.Factory, streams genericiooptions.IOStreams) *cobra.Command {
+	var raw bool
+	cmd := &cobra.Command{
+		Use:   "watch SESSION",
+		Short: i18n.T("Watch a live tty session of someone else"),
+		Long: templates.LongDesc(`
+      Watch what a live tty session shows, read only. The user of the
+      session is told that you are watching. Sessions can be found with
+      kubectl get execsessions.`),
+		Example: templates.Examples(`
+      kubectl rexec watch -n prod 0b6f1c9e-1f0e-4bb5-9d5e-52f4b5e0a4d1
+
+      # keep the session as an asciinema recording
+      kubectl rexec watch -n prod 0b6f1c9e-1f0e-4bb5-9d5e-52f4b5e0a4d1 --raw > session.cast`),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			namespace, _, err := f.ToRawKubeConfigLoader().Namespace()
+			cmdutil.CheckErr(err)
+			client, err := f.RESTClient()
+			cmdutil.CheckErr(err)
+			stream, err := client.Get().AbsPath(rexecAPIPath, namespace, "execsessions", args[0], "attach").Stream(context.TODO())
+			cmdutil.CheckErr(err)
+			defer stream.Close()
+			if raw {
+				_, err = io.Copy(streams.Out, stream)
+			} else {
+				err = showCast(stream, streams)
+			}
+			cmdutil.CheckErr(err)
+		},
+	}
+	cmd.Flags().BoolVar(&raw, "raw", false, "Print the session as asciinema v2 lines instead of showing it")
+	return cmd
+}
+
+// showCast writes the output of a cast stream to the terminal as it comes
+func showCast(stream io.Reader, streams genericiooptions.IOStreams) error {
+	reader := bufio.NewReader(stream)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	header := castHeader{}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return fmt.Errorf("unexpected session stream: %w", err)
+	}
+	fmt.Fprintf(streams.ErrOut, "watching %s started at %s in a %dx%d terminal, press ctrl-c to stop\r\n",
+		header.Title, time.Unix(header.Timestamp, 0).Local().Format(time.RFC1123), header.Width, header.Height)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			fmt.Fprintf(streams.ErrOut, "\r\nthe session is over\r\n")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var event []interface{}
+		if err := json.Unmarshal(line, &event); err != nil || len(event) != 3 {
+			continue
+		}
+		// only the output is shown, the terminal of the user
+		// echoes what they type anyway
+		if kind, _ := event[1].(string); kind == "o" {
+			data, _ := event[2].(string)
+			io.WriteString(streams.Out, data)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	"github.com/adyen/kubectl-rexec/rexec/server"
 	"github.com/spf13/cobra"
 )
@@ -18,7 +20,35 @@ func main() {
 	cmd.Flags().BoolVar(&server.SysDebugLog, "sys-debug", false, "if set more system logs will be produces")
 	cmd.Flags().StringArrayVar(&server.ByPassedUsers, "by-pass-user", []string{}, "allow user to bypass webhook restriction")
 	cmd.Flags().StringVar(&server.SecretSauce, "by-pass-shared-key", "", "shared key between apiservice and validatingwebhook")
+	cmd.Flags().StringVar(&server.RecordingDir, "recording-dir", "", "if set tty sessions are recorded as asciinema cast files into this directory")
+	cmd.Flags().DurationVar(&server.RecordingRetention, "recording-retention", 0, "recordings older than this are deleted, 0 keeps them forever")
+	cmd.Flags().BoolVar(&server.AuditScreen, "audit-screen", false, "if set the terminal output of tty sessions is emulated and the line shown on enter is logged next to each command")
+	cmd.Flags().StringArrayVar(&server.RedactPatterns, "redact-pattern", []string{}, "regex of secrets to mask in the audit next to the built in ones, only the group named secret is masked if there is one, repeatable")
+	cmd.Flags().StringVar(&server.PolicyFile, "policy-file", "", "path of the command policy file, reloaded when it changes")
+	cmd.Flags().StringVar(&server.ExecRulesFile, "exec-rules-file", "", "path of the per namespace exec rules file, reloaded when it changes")
+	cmd.Flags().StringArrayVar(&server.JustificationNamespaces, "justification-namespace", []string{}, "namespace where sessions need a reason, * for all of them")
+	cmd.Flags().StringVar(&server.TicketPattern, "ticket-pattern", "", "regex the ticket passed with a session has to match")
+	cmd.Flags().StringArrayVar(&server.ApprovalNamespaces, "approval-namespace", []string{}, "namespace where sessions need an approved exec request, * for all of them")
+	cmd.Flags().DurationVar(&server.ApprovalMaxDuration, "approval-max-duration", time.Hour, "longest time an approved exec request lets its requester in")
+	cmd.Flags().StringArrayVar(&server.BreakGlassGroups, "break-glass-group", []string{}, "group whose members may open break-glass sessions skipping approvals and policies, repeatable")
+	cmd.Flags().DurationVar(&server.MaxSessionDuration, "max-session-duration", 0, "tty sessions are closed after this long, 0 for no limit, exec rules can override it per namespace")
+	cmd.Flags().DurationVar(&server.IdleTimeout, "idle-timeout", 0, "tty sessions are closed when the user sent nothing for this long, 0 for no limit, exec rules can override it per namespace")
+	cmd.Flags().StringArrayVar(&server.DebugImages, "debug-image", []string{}, "regex of images debug containers may run, the whole image has to match, without any debug containers are refused, repeatable")
+	cmd.Flags().BoolVar(&server.DenyNativePortForward, "deny-native-port-forward", false, "if set the webhook refuses port-forwards not coming through rexec, apart from users with a bypass")
+	cmd.Flags().IntVar(&server.StdinCaptureSize, "stdin-capture-size", 64*1024, "bytes of the stdin of commands without a tty kept in the audit log, the rest is only hashed")
 	cmd.Flags().IntVar(&server.MaxStokesPerLine, "max-strokes-per-line", 0, "set how much keystores can be held in the async audit before flush")
+	cmd.Flags().StringArrayVar(&server.AuditSinks, "audit-sink", []string{"stdout"}, "where audit events are sent, one of stdout, file, syslog or http, repeatable")
+	cmd.Flags().StringVar(&server.AuditFilePath, "audit-file-path", "", "path of the audit log file used by the file sink")
+	cmd.Flags().IntVar(&server.AuditFileMaxSize, "audit-file-max-size", 100, "size in megabytes after which the audit log file is rotated")
+	cmd.Flags().IntVar(&server.AuditFileMaxBackups, "audit-file-max-backups", 5, "how many rotated audit log files are kept")
+	cmd.Flags().StringVar(&server.AuditSyslogNetwork, "audit-syslog-network", "udp", "network of the syslog sink, one of tcp, udp, unix or unixgram")
+	cmd.Flags().StringVar(&server.AuditSyslogAddress, "audit-syslog-address", "", "address of the syslog server, or socket path for unix networks")
+	cmd.Flags().StringVar(&server.AuditHTTPURL, "audit-http-url", "", "url the http sink posts batches of audit events to")
+	cmd.Flags().StringArrayVar(&server.AuditHTTPHeaders, "audit-http-header", []string{}, "header added to the requests of the http sink in the form of 'Name: value', repeatable")
+	cmd.Flags().IntVar(&server.AuditHTTPBatchSize, "audit-http-batch-size", 100, "how many audit events are sent in one request by the http sink")
+	cmd.Flags().DurationVar(&server.AuditHTTPFlushInterval, "audit-http-flush-interval", 5*time.Second, "how often the http sink sends incomplete batches")
+	cmd.Flags().IntVar(&server.AuditHTTPRetries, "audit-http-retries", 3, "how many times the http sink retries a failed request")
+	cmd.Flags().StringVar(&server.AuditHTTPBufferDir, "audit-http-buffer-dir", "", "directory where the http sink buffers events it could not deliver")
 	err := cmd.Execute()
 	if err != nil {
 		server.SysLogger.Fatal().Msg(err.Error())
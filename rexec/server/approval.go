@@ -0,0 +1,393 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/mux"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	approvalPending  = "Pending"
+	approvalApproved = "Approved"
+	approvalDenied   = "Denied"
+	approvalExpired  = "Expired"
+
+	// the custom resource the exec requests are stored in
+	approvalAPIVersion = "rexec.adyen.internal/v1alpha1"
+	approvalKind       = "ExecRequest"
+	// requests nobody looked at are dropped after a day
+	approvalPendingTTL = 24 * time.Hour
+	// how often the controller looks for expired requests
+	approvalControllerInterval = 30 * time.Second
+)
+
+// approvalRequest is an ExecRequest, a user asking for exec access to a
+// pod, which someone else has to approve before the sessions go through
+type approvalRequest struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              approvalSpec   `json:"spec"`
+	Status            approvalStatus `json:"status,omitempty"`
+}
+
+type approvalSpec struct {
+	// set by rexec from the identity of whoever created the request
+	Requester string `json:"requester,omitempty"`
+	Pod       string `json:"pod"`
+	Reason    string `json:"reason"`
+	Ticket    string `json:"ticket,omitempty"`
+	// how long the access is needed, capped by --approval-max-duration
+	Duration metav1.Duration `json:"duration,omitempty"`
+}
+
+type approvalStatus struct {
+	Phase string `json:"phase,omitempty"`
+	// who approved or denied the request, and why
+	Approver  string       `json:"approver,omitempty"`
+	Message   string       `json:"message,omitempty"`
+	DecidedAt *metav1.Time `json:"decidedAt,omitempty"`
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+}
+
+type approvalRequestList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []approvalRequest `json:"items"`
+}
+
+// approvalDecision is what the approve and deny endpoints accept
+type approvalDecision struct {
+	Message string `json:"message,omitempty"`
+}
+
+// approvalPath is where the exec requests of a namespace are stored
+func approvalPath(namespace string) string {
+	if namespace == "" {
+		return fmt.Sprintf("/apis/%s/execrequests", approvalAPIVersion)
+	}
+	return fmt.Sprintf("/apis/%s/namespaces/%s/execrequests", approvalAPIVersion, namespace)
+}
+
+// approvalStatusPath is the status subresource of a request, the only
+// way its phase and approver change
+func approvalStatusPath(namespace, name string) string {
+	return fmt.Sprintf("%s/%s/status", approvalPath(namespace), name)
+}
+
+// approvalRequired tells whether sessions in a namespace need an approval
+func approvalRequired(namespace string) bool {
+	return slices.Contains(ApprovalNamespaces, namespace) || slices.Contains(ApprovalNamespaces, "*")
+}
+
+// prepare validates a new request and fills in what only rexec may set
+func (a *approvalRequest) prepare(namespace, requester string) error {
+	if a.Spec.Pod == "" {
+		return errors.New("the pod of the request is missing")
+	}
+	if a.Spec.Reason == "" {
+		return errors.New("the reason of the request is missing")
+	}
+	err := checkJustification(namespace, a.Spec.Reason, a.Spec.Ticket)
+	if err != nil {
+		return err
+	}
+	if a.Spec.Duration.Duration <= 0 || a.Spec.Duration.Duration > ApprovalMaxDuration {
+		a.Spec.Duration.Duration = ApprovalMaxDuration
+	}
+	a.TypeMeta = metav1.TypeMeta{APIVersion: approvalAPIVersion, Kind: approvalKind}
+	a.ObjectMeta = metav1.ObjectMeta{Namespace: namespace, GenerateName: "exec-"}
+	a.Spec.Requester = requester
+	a.Spec.Reason = cleanReason(a.Spec.Reason)
+	a.Status = approvalStatus{Phase: approvalPending}
+	return nil
+}
+
+// decide approves or denies a pending request, nobody can approve their
+// own request, that is the whole point of asking
+func (a *approvalRequest) decide(approver string, approve bool, message string, now time.Time) error {
+	if approver == a.Spec.Requester {
+		return errors.New("requests cannot be approved or denied by their requester")
+	}
+	if a.Status.Phase != approvalPending && a.Status.Phase != "" {
+		return fmt.Errorf("request is already %s", a.Status.Phase)
+	}
+	decidedAt := metav1.NewTime(now)
+	a.Status.Approver = approver
+	a.Status.Message = message
+	a.Status.DecidedAt = &decidedAt
+	if !approve {
+		a.Status.Phase = approvalDenied
+		return nil
+	}
+	a.Status.Phase = approvalApproved
+	expiresAt := metav1.NewTime(now.Add(a.Spec.Duration.Duration))
+	a.Status.ExpiresAt = &expiresAt
+	return nil
+}
+
+// expire moves requests past their time to expired, it tells whether
+// the request changed
+func (a *approvalRequest) expire(now time.Time) bool {
+	switch a.Status.Phase {
+	case approvalApproved:
+		if a.Status.ExpiresAt == nil || now.Before(a.Status.ExpiresAt.Time) {
+			return false
+		}
+	case approvalPending, "":
+		if now.Before(a.CreationTimestamp.Add(approvalPendingTTL)) {
+			return false
+		}
+	default:
+		return false
+	}
+	a.Status.Phase = approvalExpired
+	return true
+}
+
+// active tells whether the request lets a user into a pod right now,
+// a request claiming to be approved by its own requester never does
+func (a *approvalRequest) active(user, pod string, now time.Time) bool {
+	return a.Status.Phase == approvalApproved && a.Spec.Requester == user && a.Spec.Pod == pod &&
+		a.Status.Approver != "" && a.Status.Approver != a.Spec.Requester &&
+		a.Status.ExpiresAt != nil && now.Before(a.Status.ExpiresAt.Time)
+}
+
+// findApproval returns the approved request letting the user into the
+// pod which lasts the longest, or nil
+func findApproval(requests []approvalRequest, user, pod string, now time.Time) *approvalRequest {
+	var found *approvalRequest
+	for i := range requests {
+		if !requests[i].active(user, pod, now) {
+			continue
+		}
+		if found == nil || requests[i].Status.ExpiresAt.After(found.Status.ExpiresAt.Time) {
+			found = &requests[i]
+		}
+	}
+	return found
+}
+
+// logApproval emits the exec_request event for a change of a request
+func logApproval(a *approvalRequest, action string) {
+	event := auditLogger.Info().
+		Str("event", "exec_request").
+		Str("action", action).
+		Str("request", a.Name).
+		Str("namespace", a.Namespace).
+		Str("pod", a.Spec.Pod).
+		Str("requester", a.Spec.Requester).
+		Str("justification", a.Spec.Reason)
+	if a.Spec.Ticket != "" {
+		event = event.Str("ticket", a.Spec.Ticket)
+	}
+	if a.Status.Approver != "" {
+		event = event.Str("approver", a.Status.Approver).Str("message", redact(a.Status.Message))
+	}
+	if a.Status.ExpiresAt != nil {
+		event = event.Time("expires_at", a.Status.ExpiresAt.Time)
+	}
+	event.Msg("")
+}
+
+// checkApproval looks for an approved request for the session, in
+// namespaces requiring one, and ties the session to it
+func checkApproval(ctx context.Context, sess *session) error {
+	if !approvalRequired(sess.namespace) {
+		return nil
+	}
+	list := approvalRequestList{}
+	err := kubeRequest(ctx, http.MethodGet, approvalPath(sess.namespace), nil, &list)
+	if err != nil {
+		SysLogger.Error().Err(err).Msgf("failed to list exec requests of %s", sess.namespace)
+		return fmt.Errorf("could not check the exec requests of namespace %s", sess.namespace)
+	}
+	approval := findApproval(list.Items, sess.user, sess.pod, time.Now())
+	if approval == nil {
+		return fmt.Errorf("sessions in namespace %s need an approved exec request, ask for one with kubectl rexec request", sess.namespace)
+	}
+	sess.approval = approval.Name
+	sess.approvalExpires = approval.Status.ExpiresAt.Time
+	sess.logger = sess.logger.With().Str("exec_request", approval.Name).Logger()
+	return nil
+}
+
+// approvalCreateHandler stores a new exec request of the calling user
+func approvalCreateHandler(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+	user := remoteUser(r)
+	if user == "" {
+		writeStatus(w, http.StatusForbidden, "no user found")
+		return
+	}
+
+	request := approvalRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, fmt.Sprintf("failed to decode request: %v", err))
+		return
+	}
+	err = request.prepare(namespace, user)
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	created := approvalRequest{}
+	err = kubeRequest(r.Context(), http.MethodPost, approvalPath(namespace), request, &created)
+	if err != nil {
+		SysLogger.Error().Err(err).Msgf("failed to create exec request in %s", namespace)
+		writeStatus(w, http.StatusInternalServerError, "failed to store the exec request")
+		return
+	}
+	// the status is dropped on create, without it the request still
+	// counts as pending, it is only set to show up in kubectl get
+	created.Status = approvalStatus{Phase: approvalPending}
+	err = kubeRequest(r.Context(), http.MethodPut, approvalStatusPath(namespace, created.Name), created, &created)
+	if err != nil {
+		SysLogger.Error().Err(err).Msgf("failed to mark exec request %s/%s pending", namespace, created.Name)
+	}
+	logApproval(&created, "requested")
+	writeObject(w, http.StatusCreated, created)
+}
+
+// approvalDecisionHandler approves or denies an exec request on behalf
+// of the calling user, the aggregation layer already checked that they
+// may create the approve subresource
+func approvalDecisionHandler(approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		user := remoteUser(r)
+		if user == "" {
+			writeStatus(w, http.StatusForbidden, "no user found")
+			return
+		}
+
+		decision := approvalDecision{}
+		if r.ContentLength != 0 {
+			err := json.NewDecoder(r.Body).Decode(&decision)
+			if err != nil {
+				writeStatus(w, http.StatusBadRequest, fmt.Sprintf("failed to decode decision: %v", err))
+				return
+			}
+		}
+
+		path := fmt.Sprintf("%s/%s", approvalPath(vars["namespace"]), vars["name"])
+		request := approvalRequest{}
+		err := kubeRequest(r.Context(), http.MethodGet, path, nil, &request)
+		if err != nil {
+			writeKubeError(w, err, "failed to read the exec request")
+			return
+		}
+		err = request.decide(user, approve, decision.Message, time.Now())
+		if err != nil {
+			writeStatus(w, http.StatusConflict, err.Error())
+			return
+		}
+		// the resource version makes sure two decisions do not race
+		updated := approvalRequest{}
+		err = kubeRequest(r.Context(), http.MethodPut, approvalStatusPath(vars["namespace"], vars["name"]), request, &updated)
+		if err != nil {
+			writeKubeError(w, err, "failed to store the decision")
+			return
+		}
+		logApproval(&updated, map[bool]string{true: "approved", false: "denied"}[approve])
+		writeObject(w, http.StatusOK, updated)
+	}
+}
+
+// approvalController expires exec requests and closes the sessions on
+// this replica whose approval ran out, replicas racing on the same
+// request are sorted out by the resource version
+func approvalController() {
+	for {
+		time.Sleep(approvalControllerInterval)
+		expireApprovals()
+		closeExpiredSessions(time.Now())
+	}
+}
+
+func expireApprovals() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	list := approvalRequestList{}
+	err := kubeRequest(ctx, http.MethodGet, approvalPath(""), nil, &list)
+	if err != nil {
+		SysLogger.Error().Err(err).Msg("failed to list exec requests")
+		return
+	}
+	now := time.Now()
+	for i := range list.Items {
+		request := &list.Items[i]
+		if !request.expire(now) {
+			continue
+		}
+		err := kubeRequest(ctx, http.MethodPut, approvalStatusPath(request.Namespace, request.Name), request, nil)
+		if err != nil {
+			var kerr *kubeError
+			if !errors.As(err, &kerr) || kerr.Code != http.StatusConflict {
+				SysLogger.Error().Err(err).Msgf("failed to expire exec request %s/%s", request.Namespace, request.Name)
+			}
+			continue
+		}
+		logApproval(request, "expired")
+	}
+}
+
+// closeExpiredSessions terminates the sessions outliving their approval
+func closeExpiredSessions(now time.Time) {
+	mapSync.Lock()
+	var expired []*session
+	for _, sess := range sessionMap {
+		if !sess.approvalExpires.IsZero() && now.After(sess.approvalExpires) {
+			expired = append(expired, sess)
+		}
+	}
+	mapSync.Unlock()
+	for _, sess := range expired {
+		if sess.closing() {
+			continue
+		}
+		sess.timeout("rexec closed the session: the exec request "+sess.approval+" expired", "exec request expired")
+	}
+}
+
+// writeStatus answers with a status object, kubectl shows its message
+func writeStatus(w http.ResponseWriter, code int, message string) {
+	writeObject(w, code, metav1.Status{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Status"},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Code:     int32(code),
+	})
+}
+
+// writeKubeError passes on errors of the kube apiserver like a missing
+// request, anything else is logged and hidden behind the message
+func writeKubeError(w http.ResponseWriter, err error, message string) {
+	var kerr *kubeError
+	if errors.As(err, &kerr) && kerr.Code >= 400 && kerr.Code < 500 {
+		writeStatus(w, kerr.Code, kerr.Message)
+		return
+	}
+	SysLogger.Error().Err(err).Msg(message)
+	writeStatus(w, http.StatusInternalServerError, message)
+}
+
+func writeObject(w http.ResponseWriter, code int, object interface{}) {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(httpInternalError))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(raw)
+}
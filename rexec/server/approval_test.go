@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func setApprovalMaxDuration(t *testing.T, duration time.Duration) {
+	old := ApprovalMaxDuration
+	t.Cleanup(func() { ApprovalMaxDuration = old })
+	ApprovalMaxDuration = duration
+}
+
+func TestApprovalPrepare(t *testing.T) {
+	setApprovalMaxDuration(t, time.Hour)
+
+	request := approvalRequest{Spec: approvalSpec{Requester: "mallory", Pod: "db-0", Reason: "stuck\nqueries", Duration: metav1.Duration{Duration: 3 * time.Hour}}}
+	request.Status.Phase = approvalApproved
+	if err := request.prepare("prod", "lauren"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if request.Spec.Requester != "lauren" || request.Status.Phase != approvalPending || request.Namespace != "prod" {
+		t.Fatalf("request was not reset: %+v", request)
+	}
+	if request.Spec.Duration.Duration != time.Hour {
+		t.Fatalf("duration = %s, want it capped at 1h", request.Spec.Duration.Duration)
+	}
+	if request.Spec.Reason != "stuck queries" {
+		t.Fatalf("reason = %q", request.Spec.Reason)
+	}
+
+	for _, spec := range []approvalSpec{{Reason: "no pod"}, {Pod: "db-0"}} {
+		request := approvalRequest{Spec: spec}
+		if err := request.prepare("prod", "lauren"); err == nil {
+			t.Fatalf("expected error for %+v", spec)
+		}
+	}
+}
+
+func TestApprovalDecide(t *testing.T) {
+	now := time.Now()
+	newRequest := func() *approvalRequest {
+		return &approvalRequest{
+			Spec:   approvalSpec{Requester: "lauren", Pod: "db-0", Duration: metav1.Duration{Duration: 30 * time.Minute}},
+			Status: approvalStatus{Phase: approvalPending},
+		}
+	}
+
+	request := newRequest()
+	if err := request.decide("lauren", true, "", now); err == nil {
+		t.Fatal("requester approved their own request")
+	}
+
+	if err := request.decide("bob", true, "go ahead", now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if request.Status.Phase != approvalApproved || request.Status.Approver != "bob" || !request.Status.ExpiresAt.Time.Equal(now.Add(30*time.Minute)) {
+		t.Fatalf("unexpected status: %+v", request.Status)
+	}
+	if err := request.decide("alice", false, "", now); err == nil {
+		t.Fatal("an approved request was decided again")
+	}
+
+	// requests fresh from create have no status yet
+	request = newRequest()
+	request.Status = approvalStatus{}
+	if err := request.decide("bob", true, "", now); err != nil {
+		t.Fatalf("unexpected error for a request without status: %v", err)
+	}
+
+	request = newRequest()
+	if err := request.decide("bob", false, "use the runbook", now); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if request.Status.Phase != approvalDenied || request.Status.ExpiresAt != nil {
+		t.Fatalf("unexpected status: %+v", request.Status)
+	}
+}
+
+func TestApprovalExpire(t *testing.T) {
+	now := time.Now()
+	past := metav1.NewTime(now.Add(-time.Minute))
+	future := metav1.NewTime(now.Add(time.Minute))
+
+	for _, tc := range []struct {
+		name    string
+		request approvalRequest
+		expired bool
+	}{
+		{"approved", approvalRequest{Status: approvalStatus{Phase: approvalApproved, ExpiresAt: &future}}, false},
+		{"approved and over", approvalRequest{Status: approvalStatus{Phase: approvalApproved, ExpiresAt: &past}}, true},
+		{"pending", approvalRequest{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.NewTime(now.Add(-time.Hour))}, Status: approvalStatus{Phase: approvalPending}}, false},
+		{"pending for long", approvalRequest{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.NewTime(now.Add(-25 * time.Hour))}, Status: approvalStatus{Phase: approvalPending}}, true},
+		{"denied", approvalRequest{Status: approvalStatus{Phase: approvalDenied}}, false},
+	} {
+		if got := tc.request.expire(now); got != tc.expired {
+			t.Errorf("%s: expired = %v, want %v", tc.name, got, tc.expired)
+		}
+	}
+}
+
+func TestFindApproval(t *testing.T) {
+	now := time.Now()
+	soon := metav1.NewTime(now.Add(10 * time.Minute))
+	later := metav1.NewTime(now.Add(time.Hour))
+	past := metav1.NewTime(now.Add(-time.Minute))
+	longest := metav1.NewTime(now.Add(2 * time.Hour))
+	approved := func(name, user, pod string, expires *metav1.Time) approvalRequest {
+		return approvalRequest{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       approvalSpec{Requester: user, Pod: pod},
+			Status:     approvalStatus{Phase: approvalApproved, Approver: "alice", ExpiresAt: expires},
+		}
+	}
+	selfApproved := approved("self-approved", "lauren", "db-0", &longest)
+	selfApproved.Status.Approver = "lauren"
+	unknownApprover := approved("no-approver", "lauren", "db-0", &longest)
+	unknownApprover.Status.Approver = ""
+	requests := []approvalRequest{
+		approved("other-user", "bob", "db-0", &later),
+		approved("other-pod", "lauren", "db-1", &later),
+		approved("over", "lauren", "db-0", &past),
+		approved("soon", "lauren", "db-0", &soon),
+		approved("later", "lauren", "db-0", &later),
+		selfApproved,
+		unknownApprover,
+		{Spec: approvalSpec{Requester: "lauren", Pod: "db-0"}, Status: approvalStatus{Phase: approvalPending}},
+	}
+
+	found := findApproval(requests, "lauren", "db-0", now)
+	if found == nil || found.Name != "later" {
+		t.Fatalf("found %+v, want the request lasting the longest", found)
+	}
+	if found := findApproval(requests, "lauren", "db-2", now); found != nil {
+		t.Fatalf("found %+v for a pod nobody approved", found)
+	}
+}
+
+func TestCloseExpiredSessions(t *testing.T) {
+	oldSessions := sessionMap
+	t.Cleanup(func() { sessionMap = oldSessions })
+	var buf bytes.Buffer
+	over := &session{id: "over", approval: "exec-1", approvalExpires: time.Now().Add(-time.Second), logger: zerolog.New(&buf)}
+	running := &session{id: "running", approval: "exec-2", approvalExpires: time.Now().Add(time.Hour), logger: zerolog.New(&buf)}
+	unbound := &session{id: "unbound", logger: zerolog.New(&buf)}
+	sessionMap = map[string]*session{"over": over, "running": running, "unbound": unbound}
+
+	closeExpiredSessions(time.Now())
+	if over.closeReason != "exec request expired" {
+		t.Fatalf("close reason = %q", over.closeReason)
+	}
+	if running.closeReason != "" || unbound.closeReason != "" {
+		t.Fatal("sessions with time left were closed")
+	}
+}
+
+func TestApprovalCreateHandlerRejects(t *testing.T) {
+	for _, tc := range []struct {
+		user string
+		body string
+		code int
+	}{
+		{"", `{"spec":{"pod":"db-0","reason":"stuck"}}`, http.StatusForbidden},
+		{"lauren", `{"spec":`, http.StatusBadRequest},
+		{"lauren", `{"spec":{"reason":"stuck"}}`, http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/apis/audit.adyen.internal/v1beta1/namespaces/prod/execrequests", strings.NewReader(tc.body))
+		req = mux.SetURLVars(req, map[string]string{"namespace": "prod"})
+		if tc.user != "" {
+			req.Header.Set("X-Remote-User", tc.user)
+		}
+		rr := httptest.NewRecorder()
+		approvalCreateHandler(rr, req)
+
+		status := metav1.Status{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+			t.Fatalf("unmarshal: %v\nbody: %s", err, rr.Body.String())
+		}
+		if rr.Code != tc.code || status.Code != int32(tc.code) || status.Message == "" {
+			t.Errorf("user %q body %s: got %d %+v, want %d", tc.user, tc.body, rr.Code, status, tc.code)
+		}
+	}
+}
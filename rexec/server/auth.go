@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	frontProxyNamespace      = "kube-system"
+	frontProxyConfigMap      = "extension-apiserver-authentication"
+	frontProxyReloadInterval = 1 * time.Minute
+)
+
+// frontProxyConfig holds the requestheader settings the kube apiserver
+// publishes for aggregated apiservers, we only trust the X-Remote-*
+// headers if the request was made with a client cert issued by clientCAs
+type frontProxyConfig struct {
+	clientCAs       *x509.CertPool
+	allowedNames    []string
+	usernameHeaders []string
+	groupHeaders    []string
+}
+
+var frontProxy *frontProxyConfig
+var frontProxySync sync.RWMutex
+
+// loadFrontProxyConfig fetches and parses the requestheader configuration
+// from kube-system/extension-apiserver-authentication
+func loadFrontProxyConfig(ctx context.Context) (*frontProxyConfig, error) {
+	cm := corev1.ConfigMap{}
+	err := kubeRequest(ctx, http.MethodGet, fmt.Sprintf("/api/v1/namespaces/%s/configmaps/%s", frontProxyNamespace, frontProxyConfigMap), nil, &cm)
+	if err != nil {
+		return nil, err
+	}
+	return parseFrontProxyConfig(cm.Data)
+}
+
+// parseFrontProxyConfig turns the data of the configmap into a frontProxyConfig
+func parseFrontProxyConfig(data map[string]string) (*frontProxyConfig, error) {
+	rawCA := data["requestheader-client-ca-file"]
+	if rawCA == "" {
+		return nil, errors.New("requestheader-client-ca-file is missing, is the aggregation layer enabled?")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(rawCA)) {
+		return nil, errors.New("requestheader-client-ca-file contains no valid certificate")
+	}
+
+	config := &frontProxyConfig{clientCAs: pool}
+
+	// the rest of the keys are json encoded string lists
+	lists := map[string]*[]string{
+		"requestheader-allowed-names":    &config.allowedNames,
+		"requestheader-username-headers": &config.usernameHeaders,
+		"requestheader-group-headers":    &config.groupHeaders,
+	}
+	for key, list := range lists {
+		raw, ok := data[key]
+		if !ok || raw == "" {
+			continue
+		}
+		err := json.Unmarshal([]byte(raw), list)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", key, err)
+		}
+	}
+
+	if len(config.usernameHeaders) == 0 {
+		config.usernameHeaders = []string{"X-Remote-User"}
+	}
+	if len(config.groupHeaders) == 0 {
+		config.groupHeaders = []string{"X-Remote-Group"}
+	}
+	return config, nil
+}
+
+// frontProxyReloader keeps the front proxy config up to date, so
+// rotation of the requestheader ca does not need a restart
+func frontProxyReloader() {
+	for {
+		time.Sleep(frontProxyReloadInterval)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		config, err := loadFrontProxyConfig(ctx)
+		cancel()
+		if err != nil {
+			SysLogger.Error().Err(err).Msg("failed to reload front proxy config, keeping the previous one")
+			continue
+		}
+		frontProxySync.Lock()
+		frontProxy = config
+		frontProxySync.Unlock()
+	}
+}
+
+// verify checks whether the client certificate presented on the
+// request was issued by the requestheader ca for an allowed name
+func (c *frontProxyConfig) verify(r *http.Request) error {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return errors.New("no client certificate provided")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	leaf := r.TLS.PeerCertificates[0]
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         c.clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return err
+	}
+
+	// an empty allowlist means any cert signed by the ca is fine
+	if len(c.allowedNames) == 0 {
+		return nil
+	}
+	for _, name := range c.allowedNames {
+		if name == leaf.Subject.CommonName {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate common name %q is not allowed", leaf.Subject.CommonName)
+}
+
+// requireFrontProxy only lets requests through which are coming
+// from the kube apiserver aggregation layer
+func requireFrontProxy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		frontProxySync.RLock()
+		config := frontProxy
+		frontProxySync.RUnlock()
+
+		if config == nil {
+			SysLogger.Error().Msg("front proxy config is not loaded, rejecting request")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(httpUnauthorized))
+			return
+		}
+
+		err := config.verify(r)
+		if err != nil {
+			SysLogger.Error().Err(err).Msgf("rejecting request from %s", r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(httpUnauthorized))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// remoteUser returns the user set by the aggregation layer
+func remoteUser(r *http.Request) string {
+	for _, header := range identityHeaders(func(c *frontProxyConfig) []string { return c.usernameHeaders }, "X-Remote-User") {
+		if user := r.Header.Get(header); user != "" {
+			return user
+		}
+	}
+	return ""
+}
+
+// remoteGroups returns the groups set by the aggregation layer
+func remoteGroups(r *http.Request) []string {
+	var groups []string
+	for _, header := range identityHeaders(func(c *frontProxyConfig) []string { return c.groupHeaders }, "X-Remote-Group") {
+		groups = append(groups, r.Header.Values(header)...)
+	}
+	return groups
+}
+
+// identityHeaders picks the configured header names, falling back to the
+// kubernetes defaults if the front proxy config is not loaded
+func identityHeaders(pick func(*frontProxyConfig) []string, fallback string) []string {
+	frontProxySync.RLock()
+	defer frontProxySync.RUnlock()
+	if frontProxy == nil {
+		return []string{fallback}
+	}
+	return pick(frontProxy)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// header the plugin marks break-glass sessions with
+	breakGlassHeader = "X-Rexec-Break-Glass"
+	// extra passed on to the webhook, it only counts next to the shared key
+	breakGlassExtra = "break-glass"
+)
+
+// breakGlassAllowed tells whether any of the groups may break the glass
+func breakGlassAllowed(groups []string) bool {
+	return slices.ContainsFunc(groups, func(group string) bool {
+		return slices.Contains(BreakGlassGroups, group)
+	})
+}
+
+// admitBreakGlass lets a session skip the checks, everything the session
+// does is audited and its start goes out as an error to stand out
+func admitBreakGlass(sess *session) error {
+	if !breakGlassAllowed(sess.groups) {
+		err := fmt.Errorf("%s is not in a break-glass group", sess.user)
+		sess.logger.Warn().Str("event", "exec_denied").Str("reason", err.Error()).Msg("")
+		return err
+	}
+	// what a tty session did can only be seen again in its recording
+	if sess.tty && RecordingDir == "" {
+		err := errors.New("break-glass sessions with a tty are recorded, but rexec runs without --recording-dir")
+		sess.logger.Warn().Str("event", "exec_denied").Str("reason", err.Error()).Msg("")
+		return err
+	}
+	sess.breakGlass = true
+	// keystrokes and output are audited whatever --audit-trace says
+	sess.logger = sess.logger.With().Bool("break_glass", true).Logger().Level(zerolog.TraceLevel)
+	sess.logger.Error().Str("event", "break_glass").Msg("")
+	return nil
+}
+
+// logStreamData audits what went through a stream of a break-glass
+// session, keystrokes of a tty are covered by the stroke events
+func (t *TCPLogger) logStreamData(stream byte, data []byte) {
+	if !t.session.breakGlass || len(data) == 0 {
+		return
+	}
+	t.session.logger.Trace().Str("event", "stream_data").Str("stream", streamName(stream)).Str("data", redact(string(data))).Msg("")
+}
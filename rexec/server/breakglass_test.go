@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func setBreakGlassGroups(t *testing.T, groups ...string) {
+	old := BreakGlassGroups
+	t.Cleanup(func() { BreakGlassGroups = old })
+	BreakGlassGroups = groups
+}
+
+func TestAdmitBreakGlass(t *testing.T) {
+	setBreakGlassGroups(t, "oncall")
+	setRedactPatterns(t)
+	// the audit logger is not tracing, break-glass sessions trace anyway
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf).Level(zerolog.InfoLevel)
+
+	sess := &session{id: "test", user: "bob", groups: []string{"devs"}, logger: logger}
+	if admitBreakGlass(sess) == nil || sess.breakGlass {
+		t.Fatal("user outside the break-glass groups broke the glass")
+	}
+	if !strings.Contains(buf.String(), `"event":"exec_denied"`) {
+		t.Fatalf("denial was not logged: %s", buf.String())
+	}
+
+	buf.Reset()
+	sess = &session{id: "test", user: "lauren", groups: []string{"devs", "oncall"}, logger: logger}
+	if err := admitBreakGlass(sess); err != nil || !sess.breakGlass {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"level":"error","break_glass":true,"event":"break_glass"`) {
+		t.Fatalf("break-glass event missing: %s", buf.String())
+	}
+
+	buf.Reset()
+	setEditors(t)
+	sess.tty = true
+	tl, _ := negotiatedLogger(t, sess)
+	tl.handleStdin([]byte("l"))
+	tl.inspectOutput(encodeWSFrame(wsOpBinary, append([]byte{streamStdout}, "ls output"...)))
+	for _, event := range []string{`"event":"stroke","stroke":"l"`, `"event":"stream_data","stream":"stdout","data":"ls output"`} {
+		if !strings.Contains(buf.String(), event) {
+			t.Fatalf("%s missing: %s", event, buf.String())
+		}
+	}
+}
+
+func TestBreakGlassNeedsRecording(t *testing.T) {
+	setBreakGlassGroups(t, "oncall")
+	var buf bytes.Buffer
+	sess := &session{id: "test", user: "lauren", groups: []string{"oncall"}, tty: true, logger: zerolog.New(&buf)}
+
+	setRecordingDir(t, "")
+	if admitBreakGlass(sess) == nil || sess.breakGlass {
+		t.Fatal("unrecorded tty session broke the glass")
+	}
+	// without a tty every stream is logged as it is
+	sess.tty = false
+	if err := admitBreakGlass(sess); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	setRecordingDir(t, t.TempDir())
+	sess = &session{id: "test", user: "lauren", groups: []string{"oncall"}, tty: true, logger: zerolog.New(&buf)}
+	if err := admitBreakGlass(sess); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestBreakGlassSkipsChecks(t *testing.T) {
+	setBreakGlassGroups(t, "oncall")
+	setPolicy(t, "rules:\n- command: '^reboot'\n  action: terminate\n")
+	setJustification(t, []string{"*"}, "")
+	var buf bytes.Buffer
+	sess := &session{id: "test", user: "lauren", groups: []string{"oncall"}, command: []string{"reboot"}, logger: zerolog.New(&buf)}
+
+	if _, _, ok := admit(context.Background(), sess, false); ok {
+		t.Fatal("session was admitted without breaking the glass")
+	}
+	if _, _, ok := admit(context.Background(), sess, true); !ok {
+		t.Fatal("break-glass session was not admitted")
+	}
+	buf.Reset()
+	if !enforcePolicy(sess, "reboot", false) {
+		t.Fatal("break-glass session was terminated")
+	}
+	if !strings.Contains(buf.String(), `"action":"terminate","command":"reboot","enforced":false`) {
+		t.Fatalf("policy event missing: %s", buf.String())
+	}
+}
+
+func TestExecHandlerBreakGlass(t *testing.T) {
+	oldSauce := SecretSauce
+	t.Cleanup(func() { SecretSauce = oldSauce })
+	SecretSauce = "the-right-sauce"
+	setExecRules(t, "rules:\n- allowExec: false\n")
+
+	ar := makeAdmissionReview("PodExecOptions", "lauren", map[string][]string{
+		"secret-sauce": {"the-right-sauce"},
+		"break-glass":  {"true"},
+	})
+	_, parsed := postExecHandler(t, ar, "application/json")
+	if parsed.Response == nil || !parsed.Response.Allowed {
+		t.Fatalf("expected Allowed=true for a break-glass session, got: %+v", parsed.Response)
+	}
+}
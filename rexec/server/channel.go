@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// stream ids of the kubernetes remotecommand protocols, each websocket
+// message starts with the id of the stream it belongs to
+const (
+	streamStdin  = 0
+	streamStdout = 1
+	streamStderr = 2
+	streamError  = 3
+	streamResize = 4
+	// v5 signals the closing of a stream with a message
+	// on this id, carrying the id of the closed stream
+	streamClose = 255
+)
+
+var streamNames = map[byte]string{
+	streamStdin:  "stdin",
+	streamStdout: "stdout",
+	streamStderr: "stderr",
+	streamError:  "error",
+	streamResize: "resize",
+}
+
+// streamIds maps the stream types spdy clients announce to stream ids
+var streamIds = map[string]byte{
+	"stdin":  streamStdin,
+	"stdout": streamStdout,
+	"stderr": streamStderr,
+	"error":  streamError,
+	"resize": streamResize,
+}
+
+// channelMessage is data sent on one of the streams, whichever
+// transport carried it
+type channelMessage struct {
+	stream byte
+	data   []byte
+}
+
+// streamName returns a readable name for a stream id
+func streamName(stream byte) string {
+	name, ok := streamNames[stream]
+	if !ok {
+		return fmt.Sprintf("%d", stream)
+	}
+	return name
+}
+
+// channelProtocol describes how a negotiated channel.k8s.io
+// subprotocol frames the streams into websocket messages
+type channelProtocol struct {
+	name string
+	// base64 protocols send text messages with the stream
+	// id as an ascii digit and the data base64 encoded
+	base64 bool
+	// v5 and later can signal closing a stream
+	closeSignal bool
+}
+
+// parseChannelProtocol understands the subprotocols the kube apiserver
+// negotiates for exec, like v5.channel.k8s.io or v4.base64.channel.k8s.io
+func parseChannelProtocol(name string) (*channelProtocol, error) {
+	version, rest, found := strings.Cut(name, ".")
+	if !found {
+		return nil, fmt.Errorf("unsupported subprotocol %q", name)
+	}
+	// channel.k8s.io and base64.channel.k8s.io have no version prefix
+	if version == "channel" || version == "base64" {
+		rest = name
+		version = ""
+	}
+	protocol := &channelProtocol{name: name}
+	switch rest {
+	case "channel.k8s.io":
+	case "base64.channel.k8s.io":
+		protocol.base64 = true
+	default:
+		return nil, fmt.Errorf("unsupported subprotocol %q", name)
+	}
+	switch version {
+	case "", "v2", "v3", "v4":
+	case "v5":
+		protocol.closeSignal = !protocol.base64
+	default:
+		return nil, fmt.Errorf("unsupported subprotocol %q", name)
+	}
+	return protocol, nil
+}
+
+// decode splits a websocket message into its stream id and data
+func (p *channelProtocol) decode(message wsMessage) (byte, []byte, error) {
+	if len(message.Payload) == 0 {
+		return 0, nil, errors.New("empty message")
+	}
+	if !p.base64 {
+		if message.Opcode != wsOpBinary {
+			return 0, nil, fmt.Errorf("unexpected opcode 0x%x for %s", message.Opcode, p.name)
+		}
+		return message.Payload[0], message.Payload[1:], nil
+	}
+
+	if message.Opcode != wsOpText {
+		return 0, nil, fmt.Errorf("unexpected opcode 0x%x for %s", message.Opcode, p.name)
+	}
+	digit := message.Payload[0]
+	if digit < '0' || digit > '9' {
+		return 0, nil, fmt.Errorf("invalid stream id %q", digit)
+	}
+	data, err := base64.StdEncoding.DecodeString(string(message.Payload[1:]))
+	if err != nil {
+		return 0, nil, err
+	}
+	return digit - '0', data, nil
+}
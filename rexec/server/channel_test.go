@@ -0,0 +1,242 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/moby/spdystream/spdy"
+	"github.com/rs/zerolog"
+)
+
+func TestParseChannelProtocol(t *testing.T) {
+	for name, want := range map[string]channelProtocol{
+		"channel.k8s.io":           {},
+		"base64.channel.k8s.io":    {base64: true},
+		"v4.channel.k8s.io":        {},
+		"v4.base64.channel.k8s.io": {base64: true},
+		"v5.channel.k8s.io":        {closeSignal: true},
+	} {
+		got, err := parseChannelProtocol(name)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if got.base64 != want.base64 || got.closeSignal != want.closeSignal {
+			t.Fatalf("%s: got %+v", name, got)
+		}
+	}
+	for _, name := range []string{"", "v6.channel.k8s.io", "v4.channel.example.com", "SPDY/3.1"} {
+		if _, err := parseChannelProtocol(name); err == nil {
+			t.Fatalf("%q: expected error", name)
+		}
+	}
+}
+
+func TestChannelProtocolDecode(t *testing.T) {
+	binary, _ := parseChannelProtocol("v5.channel.k8s.io")
+	stream, data, err := binary.decode(wsMessage{Opcode: wsOpBinary, Payload: []byte("\x04{\"Width\":80}")})
+	if err != nil || stream != streamResize || string(data) != "{\"Width\":80}" {
+		t.Fatalf("unexpected result: %d %q %v", stream, data, err)
+	}
+	if _, _, err := binary.decode(wsMessage{Opcode: wsOpText, Payload: []byte("0bHM=")}); err == nil {
+		t.Fatal("expected error for a text message on a binary protocol")
+	}
+
+	text, _ := parseChannelProtocol("v4.base64.channel.k8s.io")
+	payload := append([]byte("0"), base64.StdEncoding.EncodeToString([]byte("ls\r"))...)
+	stream, data, err = text.decode(wsMessage{Opcode: wsOpText, Payload: payload})
+	if err != nil || stream != streamStdin || string(data) != "ls\r" {
+		t.Fatalf("unexpected result: %d %q %v", stream, data, err)
+	}
+}
+
+func TestTCPLoggerRoutesStreams(t *testing.T) {
+	setEditors(t)
+
+	var buf bytes.Buffer
+	sess := &session{id: "test", tty: true, logger: zerolog.New(&buf)}
+	tl := &TCPLogger{ctxid: "test", session: sess}
+
+	tl.inspectOutput([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nSec-WebSocket-Protocol: v5.channel.k8s.io\r\n\r\n"))
+	if tl.protocol == nil || tl.protocol.name != "v5.channel.k8s.io" {
+		t.Fatalf("protocol was not negotiated: %+v", tl.protocol)
+	}
+
+	var stream []byte
+	stream = append(stream, []byte("GET /exec HTTP/1.1\r\nHost: kube\r\n\r\n")...)
+	stream = append(stream, wsFrame(true, wsOpBinary, true, []byte("\x04{\"Width\":80,\"Height\":24}"))...)
+	stream = append(stream, wsFrame(true, wsOpBinary, true, []byte("\x00id\r"))...)
+	tl.inspectInput(stream)
+
+	// resize messages must not end up as keystrokes
+	if !strings.Contains(buf.String(), `"event":"command","command":"id",`) {
+		t.Fatalf("unexpected keystrokes: %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `"event":"resize","width":80,"height":24`) {
+		t.Fatalf("resize was not logged: %s", buf.String())
+	}
+}
+
+func TestTCPLoggerInputBeforeUpgrade(t *testing.T) {
+	setStdinCaptureSize(t, 1024)
+	var buf bytes.Buffer
+	sess := &session{id: "test", stdin: true, logger: zerolog.New(&buf)}
+	tl := &TCPLogger{ctxid: "test", session: sess}
+
+	// stdin sent right behind the upgrade request, before the
+	// response picked the subprotocol
+	stream := []byte("GET /exec HTTP/1.1\r\nHost: kube\r\n\r\n")
+	stream = append(stream, wsFrame(true, wsOpBinary, true, []byte("\x00rm -rf /data\n"))...)
+	tl.inspectInput(stream)
+	tl.inspectOutput([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nSec-WebSocket-Protocol: v5.channel.k8s.io\r\n\r\n"))
+	tl.inspectInput(wsFrame(true, wsOpBinary, true, []byte("\x00exit\n")))
+	if event := stdinEvent(t, sess, &buf); event == nil || event["data"] != "rm -rf /data\nexit\n" {
+		t.Fatalf("stdin before the upgrade was not audited: %s", buf.String())
+	}
+}
+
+func TestTCPLoggerClosesOnMalformedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	sess := &session{id: "test", logger: zerolog.New(&buf)}
+	tl, _ := negotiatedLogger(t, sess)
+
+	stream := []byte("GET /exec HTTP/1.1\r\nHost: kube\r\n\r\n")
+	// a control frame longer than 125 bytes is not valid websocket
+	stream = append(stream, wsFrame(true, wsOpPing, true, bytes.Repeat([]byte("x"), 200))...)
+	if n, err := tl.Write(stream); n != 0 || err != errUninspectable {
+		t.Fatalf("malformed input went through: %d %v", n, err)
+	}
+	if n, err := tl.Write(wsFrame(true, wsOpBinary, true, []byte("\x00id\n"))); n != 0 || err != errUninspectable {
+		t.Fatalf("input went through after a malformed frame: %d %v", n, err)
+	}
+	if !strings.Contains(buf.String(), `"event":"inspection_failed","direction":"input"`) {
+		t.Fatalf("failure was not logged: %s", buf.String())
+	}
+}
+
+func TestTCPLoggerClosesOnOversizedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	sess := &session{id: "test", tty: true, logger: zerolog.New(&buf)}
+	client, user := net.Pipe()
+	upstream, kube := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		user.Close()
+		upstream.Close()
+		kube.Close()
+	})
+	go io.Copy(io.Discard, kube)
+	tl := &TCPLogger{Conn: upstream, ctxid: "test", session: sess, client: client}
+	tl.inspectOutput([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nSec-WebSocket-Protocol: v5.channel.k8s.io\r\n\r\n"))
+
+	// a command padded past the size limit, written in the chunks
+	// io.Copy hands over
+	payload := append([]byte("\x00reboot\r"), bytes.Repeat([]byte(" "), maxWSMessageSize)...)
+	stream := []byte("GET /exec HTTP/1.1\r\nHost: kube\r\n\r\n")
+	stream = append(stream, wsFrame(true, wsOpBinary, true, payload)...)
+	var forwarded int
+	for len(stream) > 0 {
+		chunk := stream[:min(len(stream), 32*1024)]
+		stream = stream[len(chunk):]
+		n, err := tl.Write(chunk)
+		forwarded += n
+		if err != nil {
+			break
+		}
+	}
+	if forwarded != 0 {
+		t.Fatalf("%d bytes of the oversized frame went through", forwarded)
+	}
+	if !tl.uninspectable.Load() || sess.closeReason != "inspection failed" {
+		t.Fatalf("session was not closed: %q", sess.closeReason)
+	}
+	if _, err := user.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("client connection is still open: %v", err)
+	}
+}
+
+func TestTCPLoggerSPDY(t *testing.T) {
+	setEditors(t)
+
+	var buf bytes.Buffer
+	sess := &session{id: "test", tty: true, logger: zerolog.New(&buf)}
+	tl := &TCPLogger{ctxid: "test", session: sess}
+
+	// frames as kubectl would send them, the header blocks
+	// are compressed so a real framer is used
+	var client, server bytes.Buffer
+	clientFramer, _ := spdy.NewFramer(&client, nil)
+	serverFramer, _ := spdy.NewFramer(&server, nil)
+	for id, streamType := range []string{"error", "stdin", "stdout", "resize"} {
+		clientFramer.WriteFrame(&spdy.SynStreamFrame{
+			StreamId: spdy.StreamId(2*id + 1),
+			Headers:  http.Header{"Streamtype": {streamType}},
+		})
+	}
+	clientFramer.WriteFrame(&spdy.DataFrame{StreamId: 7, Data: []byte(`{"Width":80,"Height":24}`)})
+	clientFramer.WriteFrame(&spdy.DataFrame{StreamId: 3, Data: []byte("id\r")})
+	clientFramer.WriteFrame(&spdy.DataFrame{StreamId: 3, Flags: spdy.DataFlagFin})
+	serverFramer.WriteFrame(&spdy.DataFrame{StreamId: 1, Data: []byte(`{"status":"Success"}`)})
+
+	tl.inspectInput([]byte("POST /exec HTTP/1.1\r\nHost: kube\r\nUpgrade: SPDY/3.1\r\nConnection: Upgrade\r\n\r\n"))
+	// feeding byte by byte as frames can be split by reads
+	for _, b := range client.Bytes() {
+		tl.inspectInput([]byte{b})
+	}
+	tl.inspectOutput([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: SPDY/3.1\r\nConnection: Upgrade\r\n\r\n"))
+	tl.inspectOutput(server.Bytes())
+
+	if !strings.Contains(buf.String(), `"event":"command","command":"id",`) {
+		t.Fatalf("unexpected keystrokes: %s", buf.String())
+	}
+	if tl.uninspectable.Load() || tl.outputPassthrough {
+		t.Fatal("spdy was not followed")
+	}
+	for _, want := range []string{`"event":"resize","width":80,"height":24`, `"event":"stream_close","stream":"stdin"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("missing %s in %s", want, buf.String())
+		}
+	}
+	if sess.exitCode == nil || *sess.exitCode != 0 {
+		t.Fatal("exit status was not decoded")
+	}
+}
+
+func TestSPDYDecoderOversizedFrames(t *testing.T) {
+	var frames bytes.Buffer
+	framer, _ := spdy.NewFramer(&frames, nil)
+	framer.WriteFrame(&spdy.DataFrame{StreamId: 3, Data: append([]byte("reboot\r"), bytes.Repeat([]byte(" "), maxWSMessageSize)...)})
+	framer.WriteFrame(&spdy.DataFrame{StreamId: 3, Data: []byte("id\r")})
+	stream := frames.Bytes()
+
+	feed := func(d *spdyDecoder) ([]channelMessage, error) {
+		var messages []channelMessage
+		for data := stream; len(data) > 0; {
+			chunk := data[:min(len(data), 32*1024)]
+			data = data[len(chunk):]
+			got, err := d.feed(chunk)
+			messages = append(messages, got...)
+			if err != nil {
+				return messages, err
+			}
+		}
+		return messages, nil
+	}
+
+	// stdin sent by the client has to be inspected whole
+	input, _ := newSPDYDecoder(&spdyStreams{types: map[spdy.StreamId]byte{3: streamStdin}}, false)
+	if messages, err := feed(input); err == nil || len(messages) != 0 {
+		t.Fatalf("oversized input was not refused: %d messages, %v", len(messages), err)
+	}
+
+	// output is only skipped
+	output, _ := newSPDYDecoder(&spdyStreams{types: map[spdy.StreamId]byte{3: streamStdout}}, true)
+	messages, err := feed(output)
+	if err != nil || len(messages) != 1 || string(messages[0].data) != "id\r" {
+		t.Fatalf("unexpected output: %d messages, %v", len(messages), err)
+	}
+}
@@ -1,29 +1,48 @@
 package server
 
 import (
+	"context"
 	"crypto/x509"
+	"io"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 )
 
 var token string
-var proxyMap map[string]bool
-var userMap map[string]string
+var sessionMap map[string]*session
 var mapSync sync.Mutex
 var SysLogger zerolog.Logger
 var auditLogger zerolog.Logger
 var SysDebugLog bool
 var AuditFullTraceLog bool
 var CAPool *x509.CertPool
-var asyncAuditChan chan asyncAudit
-var commandMap map[string][]byte
+var editorMap map[string]*lineEditor
 var commandSync sync.Mutex
 var SecretSauce string
 var ByPassedUsers []string
 var MaxStokesPerLine int
+var RecordingDir string
+var RecordingRetention time.Duration
+var AuditScreen bool
+var RedactPatterns []string
+var PolicyFile string
+var ExecRulesFile string
+var JustificationNamespaces []string
+var TicketPattern string
+var ApprovalNamespaces []string
+var ApprovalMaxDuration time.Duration
+var BreakGlassGroups []string
+var MaxSessionDuration time.Duration
+var IdleTimeout time.Duration
+var DebugImages []string
+var StdinCaptureSize int
+var DenyNativePortForward bool
+var recorderMap map[string]*castRecorder
+var recorderSync sync.Mutex
 
 func Init() {
 	auditLevel := zerolog.InfoLevel
@@ -34,9 +53,20 @@ func Init() {
 	if SysDebugLog {
 		sysLevel = zerolog.DebugLevel
 	}
-	auditLogger = zerolog.New(os.Stdout).With().Timestamp().Str("facility", "audit").Logger().Level(auditLevel)
 	SysLogger = zerolog.New(os.Stdout).With().Timestamp().Str("facility", "sys").Logger().Level(sysLevel)
 
+	// every audit event is fanned out to all the configured sinks
+	sinks, err := setupAuditSinks()
+	if err != nil {
+		SysLogger.Fatal().Err(err).Msg("failed to setup audit sinks")
+	}
+	auditSinks = sinks
+	writers := make([]io.Writer, len(sinks))
+	for i, sink := range sinks {
+		writers[i] = sink
+	}
+	auditLogger = zerolog.New(zerolog.MultiLevelWriter(writers...)).With().Timestamp().Str("facility", "audit").Logger().Level(auditLevel)
+
 	rawCaCert, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/ca.crt")
 	if err != nil {
 		SysLogger.Fatal().Err(err)
@@ -48,10 +78,9 @@ func Init() {
 		SysLogger.Fatal().Err(err)
 	}
 	token = string(rawToken)
-	proxyMap = make(map[string]bool)
-	userMap = make(map[string]string)
-	commandMap = make(map[string][]byte)
-	asyncAuditChan = make(chan asyncAudit)
+	sessionMap = make(map[string]*session)
+	editorMap = make(map[string]*lineEditor)
+	recorderMap = make(map[string]*castRecorder)
 
 	if SecretSauce == "" {
 		SecretSauce = uuid.New().String()
@@ -65,12 +94,70 @@ func Init() {
 	if MaxStokesPerLine == 0 {
 		MaxStokesPerLine = 2000
 	}
+	err = setupRedaction()
+	if err != nil {
+		SysLogger.Fatal().Err(err).Msg("failed to set up redaction")
+	}
+
+	// we only trust identity headers from the aggregation layer
+	// so we need the requestheader config before serving anything
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	frontProxy, err = loadFrontProxyConfig(ctx)
+	cancel()
+	if err != nil {
+		SysLogger.Fatal().Err(err).Msg("failed to load front proxy config")
+	}
+	go frontProxyReloader()
+
+	err = setupJustification()
+	if err != nil {
+		SysLogger.Fatal().Err(err).Msg("failed to setup justification")
+	}
+	err = setupDebugImages()
+	if err != nil {
+		SysLogger.Fatal().Err(err).Msg("failed to setup debug images")
+	}
+
+	if RecordingDir != "" && RecordingRetention > 0 {
+		go recordingJanitor()
+	}
 
-	go asyncAuditor()
+	if len(ApprovalNamespaces) > 0 {
+		go approvalController()
+	}
+	// limits can come from the exec rules at any time, so the
+	// watchdog runs even if there are no global ones
+	go sessionWatchdog()
+
+	if PolicyFile != "" {
+		raw, err := loadFile(PolicyFile, applyPolicy)
+		if err != nil {
+			SysLogger.Fatal().Err(err).Msg("failed to load policy")
+		}
+		go fileReloader(PolicyFile, raw, applyPolicy)
+	}
+	if ExecRulesFile != "" {
+		raw, err := loadFile(ExecRulesFile, applyExecRules)
+		if err != nil {
+			SysLogger.Fatal().Err(err).Msg("failed to load exec rules")
+		}
+		go fileReloader(ExecRulesFile, raw, applyExecRules)
+	}
 }
 
-func logCommand(command, user, ctxid string) {
-	auditLogger.Info().Str("user", user).Str("session", ctxid).Str("command", command).Msg("")
+func logCommand(sess *session, line editedLine) {
+	command := redacted
+	if !line.hidden {
+		command = redactCommand(sess, line.text)
+	}
+	event := sess.logger.Info().Str("event", "command").Str("command", command).Bool("uncertain", line.uncertain)
+	if line.uncertain {
+		event = event.Str("uncertain_reason", line.reason)
+	}
+	if line.screen != nil {
+		event = event.Str("screen_command", redact(line.screen.text)).Bool("screen_prompt_found", line.screen.found)
+	}
+	event.Msg("")
 }
 
 var httpSpec = `
@@ -78,7 +165,28 @@ var httpSpec = `
   "kind": "APIResourceList",
   "apiVersion": "v1",
   "groupVersion": "audit.adyen.internal/v1beta1",
-  "resources": []
+  "resources": [
+    {
+      "name": "execsessions",
+      "singularName": "execsession",
+      "namespaced": true,
+      "kind": "ExecSession",
+      "verbs": ["get", "list", "delete"],
+      "shortNames": ["es"]
+    },
+    {
+      "name": "execsessions/attach",
+      "namespaced": true,
+      "kind": "ExecSession",
+      "verbs": ["get"]
+    },
+    {
+      "name": "execsessions/recording",
+      "namespaced": true,
+      "kind": "ExecSession",
+      "verbs": ["get"]
+    }
+  ]
 }
 `
 
@@ -86,6 +194,14 @@ var httpForbidden = `
 No User found
 `
 
+var httpUnauthorized = `
+Client certificate of the aggregation layer required
+`
+
+var httpPolicyDenied = `
+Command denied by policy
+`
+
 var httpInternalError = `
 Internal errror
 `
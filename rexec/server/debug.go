@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	corev1 "k8s.io/api/core/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+)
+
+// ephemeral containers created by rexec are named like the ones of
+// kubectl debug unless the user picked a name
+const debugContainerPrefix = "debugger-"
+
+var debugImagePatterns []*regexp.Regexp
+
+// setupDebugImages compiles the images allowed for debug containers,
+// a pattern has to match the whole image
+func setupDebugImages() error {
+	debugImagePatterns = nil
+	for _, pattern := range DebugImages {
+		re, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", pattern))
+		if err != nil {
+			return fmt.Errorf("invalid debug image pattern %q: %w", pattern, err)
+		}
+		debugImagePatterns = append(debugImagePatterns, re)
+	}
+	return nil
+}
+
+// debugImageAllowed tells whether a debug container may run an image,
+// without patterns none may
+func debugImageAllowed(image string) bool {
+	return slices.ContainsFunc(debugImagePatterns, func(re *regexp.Regexp) bool { return re.MatchString(image) })
+}
+
+// debugContainer builds the ephemeral container asked for, only the
+// fields below can be set so debug containers get no privileges
+func debugContainer(pod *corev1.Pod, params url.Values) (*corev1.EphemeralContainer, error) {
+	image := params.Get("image")
+	if image == "" {
+		return nil, fmt.Errorf("an image is required")
+	}
+
+	var names []string
+	for _, container := range pod.Spec.Containers {
+		names = append(names, container.Name)
+	}
+	target := params.Get("target")
+	if target != "" && !slices.Contains(names, target) {
+		return nil, fmt.Errorf("pod %s has no container %s", pod.Name, target)
+	}
+	for _, container := range pod.Spec.InitContainers {
+		names = append(names, container.Name)
+	}
+	for _, container := range pod.Spec.EphemeralContainers {
+		names = append(names, container.Name)
+	}
+	name := params.Get("container")
+	if name == "" {
+		name = debugContainerPrefix + utilrand.String(5)
+	}
+	if slices.Contains(names, name) {
+		return nil, fmt.Errorf("pod %s already has a container named %s", pod.Name, name)
+	}
+
+	return &corev1.EphemeralContainer{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+			Name:                     name,
+			Image:                    image,
+			Command:                  params["command"],
+			Stdin:                    boolParam(params, "stdin"),
+			TTY:                      boolParam(params, "tty"),
+			TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+		},
+		TargetContainerName: target,
+	}, nil
+}
+
+// debugHandler adds an ephemeral container to a pod on behalf of the
+// user, it goes through the same checks as an exec, the user attaches
+// to it through rexec afterwards
+func debugHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	namespace, name := vars["namespace"], vars["pod"]
+	user := remoteUser(r)
+	if user == "" {
+		writeStatus(w, http.StatusForbidden, "no user found")
+		return
+	}
+	groups := remoteGroups(r)
+	breakGlass := r.Header.Get(breakGlassHeader) == "true"
+	params := r.URL.Query()
+
+	// the pod is read as the user, who has to be allowed to see it
+	identity := impersonate(user, groups)
+	podPath := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", url.PathEscape(namespace), url.PathEscape(name))
+	pod := &corev1.Pod{}
+	if err := kubeRequestAs(r.Context(), identity, http.MethodGet, podPath, nil, pod); err != nil {
+		writeKubeError(w, err, "failed to get the pod")
+		return
+	}
+	container, err := debugContainer(pod, params)
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	params.Set("container", container.Name)
+	// adding the container is a session of its own, so its events
+	// can be told apart from the ones of other debug containers
+	sess := newSession(uuid.New().String(), r, user, groups, namespace, name, "debug", params)
+	sess.logStart()
+	if !debugImageAllowed(container.Image) {
+		message := fmt.Sprintf("image %s is not allowed for debug containers", container.Image)
+		sess.logger.Warn().Str("event", "exec_denied").Str("reason", message).Msg("")
+		sess.end("exec denied")
+		writeStatus(w, http.StatusForbidden, message)
+		return
+	}
+	if reason, message, ok := admit(r.Context(), sess, breakGlass); !ok {
+		sess.end(reason)
+		writeStatus(w, http.StatusForbidden, strings.TrimSpace(message))
+		return
+	}
+
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, *container)
+	if err := kubeRequestAs(r.Context(), identity, http.MethodPut, podPath+"/ephemeralcontainers", pod, nil); err != nil {
+		sess.end("debug container failed")
+		writeKubeError(w, err, "failed to add the debug container")
+		return
+	}
+	sess.logger.Info().
+		Str("event", "debug_container").
+		Str("image", container.Image).
+		Str("target", container.TargetContainerName).
+		Str("command", redact(strings.Join(container.Command, " "))).
+		Msg("")
+	sess.end("debug container added")
+	writeObject(w, http.StatusCreated, container)
+}
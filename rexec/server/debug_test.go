@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func setDebugImages(t *testing.T, images ...string) {
+	old := DebugImages
+	t.Cleanup(func() {
+		DebugImages = old
+		setupDebugImages()
+	})
+	DebugImages = images
+	if err := setupDebugImages(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDebugImageAllowed(t *testing.T) {
+	setDebugImages(t)
+	if debugImageAllowed("busybox:1.36") {
+		t.Fatal("image allowed without any patterns")
+	}
+
+	setDebugImages(t, `busybox:1\.36`, `registry\.example\.com/debug/.*`)
+	for image, allowed := range map[string]bool{
+		"busybox:1.36":                           true,
+		"busybox:1.36-evil":                      false,
+		"evil/busybox:1.36":                      false,
+		"registry.example.com/debug/netshoot:v1": true,
+		"registry.example.com/app:v1":            false,
+	} {
+		if debugImageAllowed(image) != allowed {
+			t.Errorf("%s: allowed = %v, want %v", image, !allowed, allowed)
+		}
+	}
+
+	DebugImages = []string{"("}
+	if setupDebugImages() == nil {
+		t.Fatal("expected an error for an invalid pattern")
+	}
+}
+
+func TestDebugContainer(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "db-0"},
+		Spec: corev1.PodSpec{
+			InitContainers:      []corev1.Container{{Name: "init"}},
+			Containers:          []corev1.Container{{Name: "app"}},
+			EphemeralContainers: []corev1.EphemeralContainer{{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger-old"}}},
+		},
+	}
+
+	container, err := debugContainer(pod, url.Values{"image": {"busybox"}, "target": {"app"}, "command": {"sh", "-l"}, "stdin": {"true"}, "tty": {"true"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(container.Name, debugContainerPrefix) || container.TargetContainerName != "app" ||
+		!container.Stdin || !container.TTY || strings.Join(container.Command, " ") != "sh -l" {
+		t.Fatalf("unexpected container: %+v", container)
+	}
+	if container.SecurityContext != nil {
+		t.Fatal("debug container got a security context")
+	}
+
+	for _, params := range []url.Values{
+		{"target": {"app"}},
+		{"image": {"busybox"}, "target": {"init"}},
+		{"image": {"busybox"}, "container": {"app"}},
+		{"image": {"busybox"}, "container": {"debugger-old"}},
+	} {
+		if _, err := debugContainer(pod, params); err == nil {
+			t.Errorf("%v: expected an error", params)
+		}
+	}
+}
+
+func TestExecHandlerEphemeralContainers(t *testing.T) {
+	oldSauce := SecretSauce
+	t.Cleanup(func() { SecretSauce = oldSauce })
+	SecretSauce = "the-right-sauce"
+
+	ar := makeAdmissionReview("Pod", "lauren", nil)
+	ar.Request.SubResource = "ephemeralcontainers"
+	_, parsed := postExecHandler(t, ar, "application/json")
+	if parsed.Response == nil || parsed.Response.Allowed {
+		t.Fatalf("expected Allowed=false, got: %+v", parsed.Response)
+	}
+
+	ar = makeAdmissionReview("Pod", "lauren", map[string][]string{
+		"secret-sauce": {"the-right-sauce"},
+	})
+	ar.Request.SubResource = "ephemeralcontainers"
+	_, parsed = postExecHandler(t, ar, "application/json")
+	if parsed.Response == nil || !parsed.Response.Allowed {
+		t.Fatalf("expected Allowed=true through rexec, got: %+v", parsed.Response)
+	}
+
+	// other updates of pods are none of our business
+	ar = makeAdmissionReview("Pod", "lauren", nil)
+	_, parsed = postExecHandler(t, ar, "application/json")
+	if parsed.Response == nil || !parsed.Response.Allowed {
+		t.Fatalf("expected Allowed=true, got: %+v", parsed.Response)
+	}
+}
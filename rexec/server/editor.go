@@ -0,0 +1,375 @@
+package server
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// control keys readline binds by default
+const (
+	keyCtrlA     = 0x01
+	keyCtrlB     = 0x02
+	keyCtrlC     = 0x03
+	keyCtrlD     = 0x04
+	keyCtrlE     = 0x05
+	keyCtrlF     = 0x06
+	keyBackspace = 0x08
+	keyTab       = 0x09
+	keyLineFeed  = 0x0A
+	keyCtrlK     = 0x0B
+	keyEnter     = 0x0D
+	keyCtrlN     = 0x0E
+	keyCtrlP     = 0x10
+	keyCtrlR     = 0x12
+	keyCtrlS     = 0x13
+	keyCtrlT     = 0x14
+	keyCtrlU     = 0x15
+	keyCtrlW     = 0x17
+	keyCtrlY     = 0x19
+	keyEscape    = 0x1B
+	keyCtrlUnder = 0x1F
+	keyDelete    = 0x7F
+
+	// longest escape sequence we wait for, anything
+	// longer is not a key we know about
+	maxEscapeLen = 16
+)
+
+// editedLine is a line reconstructed from keystrokes, uncertain is set
+// when the line depends on something we can not see from the keys alone,
+// like the shell history or tab completion
+type editedLine struct {
+	text      string
+	uncertain bool
+	reason    string
+	// offset of the enter in the keystrokes that finished the
+	// line, -1 if the line was flushed for being too long
+	end int
+	// some of it was typed while the terminal did not echo
+	hidden bool
+	// what the terminal showed on enter, if the screen is audited
+	screen *screenLine
+}
+
+// lineEditor follows the keystrokes of a session the way readline would
+// apply them, so the audited command is what was on the line when enter
+// was pressed and not the keys that were typed
+type lineEditor struct {
+	line   []rune
+	cursor int
+	// last killed text, for yanking it back
+	killed []rune
+	// set once the line can not be reconstructed with certainty
+	uncertain bool
+	reason    string
+	// unfinished escape sequence or utf-8 rune split between messages
+	escape  []byte
+	partial []byte
+	// between the markers of a bracketed paste keys are literal
+	paste bool
+	// the line holds input typed while echo was off
+	hidden bool
+}
+
+// feed takes the next keystrokes and returns the lines they finished
+func (e *lineEditor) feed(data []byte) []editedLine {
+	var lines []editedLine
+	// offsets are reported relative to what was passed in
+	offset := len(e.partial)
+	data = append(e.partial, data...)
+	e.partial = nil
+	total := len(data)
+	for len(data) > 0 {
+		// to prevent oom kills by shoving too much input into one line
+		// we flush after the amount of strokes set in MaxStokesPerLine
+		if len(e.line) > MaxStokesPerLine {
+			// the rest of a hidden line is just as hidden
+			hidden := e.hidden
+			lines = append(lines, e.flush(-1))
+			e.hidden = hidden
+		}
+
+		if e.escape != nil {
+			e.escape = append(e.escape, data[0])
+			data = data[1:]
+			e.handleEscape()
+			continue
+		}
+
+		b := data[0]
+		if b >= utf8.RuneSelf {
+			if !utf8.FullRune(data) {
+				e.partial = append(e.partial, data...)
+				break
+			}
+			r, size := utf8.DecodeRune(data)
+			data = data[size:]
+			if r != utf8.RuneError {
+				e.insert(r)
+			}
+			continue
+		}
+		data = data[1:]
+
+		if e.paste && b != keyEscape {
+			// pasted newlines stay on the line, the shell does not run them
+			if b == keyEnter || b == keyLineFeed {
+				e.insert('\n')
+			} else if b >= 0x20 && b != keyDelete {
+				e.insert(rune(b))
+			}
+			continue
+		}
+
+		switch b {
+		case keyEnter, keyLineFeed:
+			lines = append(lines, e.flush(total-len(data)-1-offset))
+		case keyEscape:
+			e.escape = []byte{b}
+		case keyBackspace, keyDelete:
+			if e.cursor > 0 {
+				e.remove(e.cursor-1, e.cursor)
+			}
+		case keyCtrlA:
+			e.cursor = 0
+		case keyCtrlE:
+			e.cursor = len(e.line)
+		case keyCtrlB:
+			e.cursor = max(e.cursor-1, 0)
+		case keyCtrlF:
+			e.cursor = min(e.cursor+1, len(e.line))
+		case keyCtrlD:
+			if e.cursor < len(e.line) {
+				e.remove(e.cursor, e.cursor+1)
+			}
+		case keyCtrlC:
+			// the line is abandoned
+			e.reset()
+		case keyCtrlK:
+			e.kill(e.cursor, len(e.line))
+		case keyCtrlU:
+			e.kill(0, e.cursor)
+		case keyCtrlW:
+			e.kill(e.wordStart(unicode.IsSpace), e.cursor)
+		case keyCtrlY:
+			for _, r := range e.killed {
+				e.insert(r)
+			}
+		case keyCtrlT:
+			e.transpose()
+		case keyTab:
+			e.markUncertain("completion")
+		case keyCtrlP, keyCtrlN:
+			e.markUncertain("history")
+		case keyCtrlR, keyCtrlS:
+			e.markUncertain("history search")
+		case keyCtrlUnder:
+			e.markUncertain("undo")
+		default:
+			if b >= 0x20 {
+				e.insert(rune(b))
+			}
+			// other control keys do not change the line
+		}
+	}
+	return lines
+}
+
+// handleEscape acts on the escape sequence once it is complete
+func (e *lineEditor) handleEscape() {
+	seq := e.escape
+	if len(seq) > maxEscapeLen {
+		e.escape = nil
+		e.markUncertain("unknown escape sequence")
+		return
+	}
+	if len(seq) < 2 {
+		return
+	}
+
+	switch seq[1] {
+	case '[':
+		// csi, parameters until a final byte
+		if len(seq) < 3 || seq[len(seq)-1] < 0x40 || seq[len(seq)-1] > 0x7E {
+			return
+		}
+		e.escape = nil
+		e.handleCSI(string(seq[2:len(seq)-1]), seq[len(seq)-1])
+	case 'O':
+		// ss3, what application cursor mode sends for arrows
+		if len(seq) < 3 {
+			return
+		}
+		e.escape = nil
+		e.handleCSI("", seq[2])
+	default:
+		e.escape = nil
+		if !e.paste {
+			e.handleMeta(seq[1])
+		}
+	}
+}
+
+// handleCSI handles cursor keys, parameters like 1;5 carry modifiers
+func (e *lineEditor) handleCSI(params string, final byte) {
+	if e.paste {
+		if final == '~' && params == "201" {
+			e.paste = false
+		}
+		return
+	}
+	word := params == "1;5" || params == "1;3"
+	switch final {
+	case 'C':
+		if word {
+			e.cursor = e.wordEnd()
+		} else {
+			e.cursor = min(e.cursor+1, len(e.line))
+		}
+	case 'D':
+		if word {
+			e.cursor = e.wordStart(isWordSeparator)
+		} else {
+			e.cursor = max(e.cursor-1, 0)
+		}
+	case 'H':
+		e.cursor = 0
+	case 'F':
+		e.cursor = len(e.line)
+	case 'A', 'B':
+		e.markUncertain("history")
+	case '~':
+		switch params {
+		case "1", "7":
+			e.cursor = 0
+		case "4", "8":
+			e.cursor = len(e.line)
+		case "3":
+			if e.cursor < len(e.line) {
+				e.remove(e.cursor, e.cursor+1)
+			}
+		case "200":
+			e.paste = true
+		case "2":
+			// insert does not change the line
+		case "5", "6":
+			e.markUncertain("history")
+		default:
+			e.markUncertain("unknown escape sequence")
+		}
+	default:
+		e.markUncertain("unknown escape sequence")
+	}
+}
+
+// handleMeta handles alt and esc prefixed keys
+func (e *lineEditor) handleMeta(key byte) {
+	switch key {
+	case 'b', 'B':
+		e.cursor = e.wordStart(isWordSeparator)
+	case 'f', 'F':
+		e.cursor = e.wordEnd()
+	case 'd', 'D':
+		e.kill(e.cursor, e.wordEnd())
+	case keyDelete, keyBackspace:
+		e.kill(e.wordStart(isWordSeparator), e.cursor)
+	case keyEscape:
+		// a second escape, the sequence starts again
+		e.escape = []byte{keyEscape}
+	case '.', '_', '<', '>', 'p', 'n', 'r':
+		e.markUncertain("history")
+	case keyTab, '?', '*':
+		e.markUncertain("completion")
+	default:
+		e.markUncertain("unknown escape sequence")
+	}
+}
+
+func (e *lineEditor) insert(r rune) {
+	e.line = append(e.line, 0)
+	copy(e.line[e.cursor+1:], e.line[e.cursor:])
+	e.line[e.cursor] = r
+	e.cursor++
+}
+
+func (e *lineEditor) remove(from, to int) {
+	e.line = append(e.line[:from], e.line[to:]...)
+	if e.cursor > to {
+		e.cursor -= to - from
+	} else if e.cursor > from {
+		e.cursor = from
+	}
+}
+
+// kill removes text and keeps it for yanking
+func (e *lineEditor) kill(from, to int) {
+	if from >= to {
+		return
+	}
+	e.killed = append([]rune(nil), e.line[from:to]...)
+	e.remove(from, to)
+}
+
+// transpose swaps the characters around the cursor like readline does
+func (e *lineEditor) transpose() {
+	if len(e.line) < 2 || e.cursor == 0 {
+		return
+	}
+	if e.cursor == len(e.line) {
+		e.cursor--
+	}
+	e.line[e.cursor-1], e.line[e.cursor] = e.line[e.cursor], e.line[e.cursor-1]
+	e.cursor++
+}
+
+// wordStart finds the start of the word before the cursor
+func (e *lineEditor) wordStart(separator func(rune) bool) int {
+	i := e.cursor
+	for i > 0 && separator(e.line[i-1]) {
+		i--
+	}
+	for i > 0 && !separator(e.line[i-1]) {
+		i--
+	}
+	return i
+}
+
+// wordEnd finds the end of the word after the cursor
+func (e *lineEditor) wordEnd() int {
+	i := e.cursor
+	for i < len(e.line) && isWordSeparator(e.line[i]) {
+		i++
+	}
+	for i < len(e.line) && !isWordSeparator(e.line[i]) {
+		i++
+	}
+	return i
+}
+
+// isWordSeparator matches what readline does not consider a word
+func isWordSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+func (e *lineEditor) markUncertain(reason string) {
+	if !e.uncertain {
+		e.uncertain = true
+		e.reason = reason
+	}
+}
+
+// flush returns the current line and starts a new one
+func (e *lineEditor) flush(end int) editedLine {
+	line := editedLine{text: string(e.line), uncertain: e.uncertain, reason: e.reason, end: end, hidden: e.hidden}
+	e.reset()
+	return line
+}
+
+func (e *lineEditor) reset() {
+	e.line = nil
+	e.cursor = 0
+	e.uncertain = false
+	e.reason = ""
+	e.paste = false
+	e.hidden = false
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"testing"
+)
+
+// setEditors gives a test fresh line editors, keystrokes are fed to
+// them as they are inspected
+func setEditors(t *testing.T) {
+	oldMax := MaxStokesPerLine
+	oldEditors := editorMap
+	t.Cleanup(func() {
+		MaxStokesPerLine = oldMax
+		editorMap = oldEditors
+	})
+	MaxStokesPerLine = 2000
+	editorMap = map[string]*lineEditor{}
+}
+
+func TestLineEditor(t *testing.T) {
+	oldMax := MaxStokesPerLine
+	t.Cleanup(func() { MaxStokesPerLine = oldMax })
+	MaxStokesPerLine = 2000
+
+	for name, tc := range map[string]struct {
+		keys      string
+		want      string
+		uncertain bool
+	}{
+		"plain":              {keys: "ls -la\r", want: "ls -la"},
+		"backspace":          {keys: "lss\x7f -la\r", want: "ls -la"},
+		"arrows":             {keys: "l -la\x1b[D\x1b[D\x1b[D\x1b[Ds\r", want: "ls -la"},
+		"application arrows": {keys: "l -la\x1bOD\x1bOD\x1bOD\x1bODs\r", want: "ls -la"},
+		"home and end":       {keys: "s -l\x1b[Hl\x1b[Fa\r", want: "ls -la"},
+		"ctrl a and e":       {keys: "s -l\x01l\x05a\r", want: "ls -la"},
+		"delete":             {keys: "lxs -la\x01\x06\x1b[3~\r", want: "ls -la"},
+		"ctrl u":             {keys: "rm -rf /\x15ls -la\r", want: "ls -la"},
+		"ctrl u mid line":    {keys: "rm -rf ls -la\x01\x1b[C\x1b[C\x1b[C\x1b[C\x1b[C\x1b[C\x1b[C\x15\r", want: "ls -la"},
+		"ctrl w":             {keys: "ls /etc/passwd\x17-la\r", want: "ls -la"},
+		"alt backspace":      {keys: "ls -la /etc/passwd\x1b\x7f\x1b\x7f\x08\x08\r", want: "ls -la"},
+		"kill and yank":      {keys: "-la ls\x01\x0b\x1b[Fls \x19\x1b[D\x1b[D\x1b[D\x0b\r", want: "ls -la"},
+		"ctrl word motion":   {keys: "ls la\x1b[1;5D-\r", want: "ls -la"},
+		"transpose":          {keys: "sl\x14 -la\r", want: "ls -la"},
+		"ctrl c":             {keys: "rm -rf /\x03ls -la\r", want: "ls -la"},
+		"utf8":               {keys: "echo héllo\x7f\x7f\x7f\x7fello\r", want: "echo hello"},
+		"bracketed paste":    {keys: "\x1b[200~echo a\recho b\x1b[201~\r", want: "echo a\necho b"},
+		"history":            {keys: "\x1b[A\r", want: "", uncertain: true},
+		"history edited":     {keys: "\x1b[A -la\r", want: " -la", uncertain: true},
+		"completion":         {keys: "cat /etc/pas\t\r", want: "cat /etc/pas", uncertain: true},
+		"search":             {keys: "\x12kubectl\r", want: "kubectl", uncertain: true},
+	} {
+		e := &lineEditor{}
+		// feeding key by key, escape sequences arrive split as well
+		var lines []editedLine
+		for i := 0; i < len(tc.keys); i++ {
+			lines = append(lines, e.feed([]byte(tc.keys[i:i+1]))...)
+		}
+		if len(lines) != 1 {
+			t.Fatalf("%s: got %d lines: %+v", name, len(lines), lines)
+		}
+		if lines[0].text != tc.want || lines[0].uncertain != tc.uncertain {
+			t.Fatalf("%s: got %q uncertain %v, want %q uncertain %v", name, lines[0].text, lines[0].uncertain, tc.want, tc.uncertain)
+		}
+	}
+}
+
+func TestLineEditorResetsCertainty(t *testing.T) {
+	oldMax := MaxStokesPerLine
+	t.Cleanup(func() { MaxStokesPerLine = oldMax })
+	MaxStokesPerLine = 2000
+
+	e := &lineEditor{}
+	lines := e.feed([]byte("\x1b[A\rid\r"))
+	if len(lines) != 2 || !lines[0].uncertain || lines[0].reason != "history" || lines[1].uncertain {
+		t.Fatalf("unexpected lines: %+v", lines)
+	}
+}
+
+func TestLineEditorFlushesLongLines(t *testing.T) {
+	oldMax := MaxStokesPerLine
+	t.Cleanup(func() { MaxStokesPerLine = oldMax })
+	MaxStokesPerLine = 3
+
+	e := &lineEditor{}
+	lines := e.feed([]byte("abcdef\r"))
+	if len(lines) != 2 || lines[0].text != "abcd" || lines[1].text != "ef" {
+		t.Fatalf("unexpected lines: %+v", lines)
+	}
+}
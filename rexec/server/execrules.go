@@ -0,0 +1,358 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// how long the labels of a namespace are trusted before they are fetched again
+const namespaceLabelsTTL = time.Minute
+
+// execRules restrict what kind of exec is allowed where, the first
+// rule matching the namespace and the user decides, an exec matching
+// no rule is allowed
+type execRules struct {
+	Rules []*execRule `json:"rules"`
+}
+
+// execRule matches execs on the namespace and the user, empty fields
+// match everything, unset restrictions allow everything
+type execRule struct {
+	Name              string                `json:"name"`
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	Users             []string              `json:"users,omitempty"`
+	Groups            []string              `json:"groups,omitempty"`
+	AllowExec         *bool                 `json:"allowExec,omitempty"`
+	// without a tty only one-off commands can be run
+	AllowTTY   *bool    `json:"allowTTY,omitempty"`
+	Containers []string `json:"containers,omitempty"`
+	// commands a one-off may run, one pattern per argument, sessions
+	// with a tty are not checked as their commands are typed later
+	Commands [][]string `json:"commands,omitempty"`
+	// whether files may be copied into or out of containers, an
+	// archive going through stdin or stdout counts as a copy
+	AllowUpload   *bool `json:"allowUpload,omitempty"`
+	AllowDownload *bool `json:"allowDownload,omitempty"`
+	// port-forwards run nothing in the containers, only this applies
+	AllowPortForward *bool `json:"allowPortForward,omitempty"`
+	// limits of tty sessions overriding the global ones, zero
+	// lifts the limit
+	MaxSessionDuration *metav1.Duration `json:"maxSessionDuration,omitempty"`
+	IdleTimeout        *metav1.Duration `json:"idleTimeout,omitempty"`
+
+	selector labels.Selector
+	commands [][]*regexp.Regexp
+}
+
+// execRequest is what the rules need to know about an exec, it is
+// filled from the rexec url or from the admission review
+type execRequest struct {
+	user      string
+	groups    []string
+	namespace string
+	container string
+	command   []string
+	tty       bool
+	// attach runs no command of its own
+	attach bool
+	// port-forward reaches the pod without running anything
+	portForward bool
+}
+
+type namespaceLabels struct {
+	labels  map[string]string
+	fetched time.Time
+}
+
+var activeExecRules *execRules
+var execRulesSync sync.RWMutex
+var namespaceCache = map[string]namespaceLabels{}
+var namespaceSync sync.Mutex
+
+// parseExecRules reads an exec rules file and compiles its rules
+func parseExecRules(raw []byte) (*execRules, error) {
+	rules := &execRules{}
+	err := yaml.UnmarshalStrict(raw, rules)
+	if err != nil {
+		return nil, err
+	}
+	for i, rule := range rules.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if rule.NamespaceSelector != nil {
+			rule.selector, err = metav1.LabelSelectorAsSelector(rule.NamespaceSelector)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s has invalid namespace selector: %w", rule.Name, err)
+			}
+		}
+		for _, command := range rule.Commands {
+			if len(command) == 0 {
+				return nil, fmt.Errorf("rule %s has an empty command", rule.Name)
+			}
+			// a pattern has to match the whole argument
+			args := make([]*regexp.Regexp, len(command))
+			for i, pattern := range command {
+				args[i], err = regexp.Compile("^(?:" + pattern + ")$")
+				if err != nil {
+					return nil, fmt.Errorf("rule %s has invalid command pattern: %w", rule.Name, err)
+				}
+			}
+			rule.commands = append(rule.commands, args)
+		}
+	}
+	return rules, nil
+}
+
+// applyExecRules parses the exec rules file and puts it in effect
+func applyExecRules(raw []byte) error {
+	rules, err := parseExecRules(raw)
+	if err != nil {
+		return err
+	}
+	execRulesSync.Lock()
+	activeExecRules = rules
+	execRulesSync.Unlock()
+	return nil
+}
+
+// currentExecRules returns the rules in effect, nil if there are none
+func currentExecRules() *execRules {
+	execRulesSync.RLock()
+	defer execRulesSync.RUnlock()
+	return activeExecRules
+}
+
+// needsNamespaceLabels tells whether any rule selects on namespace labels
+func (e *execRules) needsNamespaceLabels() bool {
+	for _, rule := range e.Rules {
+		if rule.selector != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the first rule matching the request, or nil
+func (e *execRules) match(req execRequest, nsLabels map[string]string) *execRule {
+	for _, rule := range e.Rules {
+		if rule.matches(req, nsLabels) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (r *execRule) matches(req execRequest, nsLabels map[string]string) bool {
+	if len(r.Users) > 0 && !slices.Contains(r.Users, req.user) {
+		return false
+	}
+	if len(r.Groups) > 0 && !slices.ContainsFunc(req.groups, func(group string) bool {
+		return slices.Contains(r.Groups, group)
+	}) {
+		return false
+	}
+	if r.selector != nil && !r.selector.Matches(labels.Set(nsLabels)) {
+		return false
+	}
+	return true
+}
+
+// check returns why the rule does not allow the request, nil if it does
+func (r *execRule) check(req execRequest) error {
+	if req.portForward {
+		if r.AllowPortForward != nil && !*r.AllowPortForward {
+			return fmt.Errorf("port-forward is not allowed in namespace %s (rule %s)", req.namespace, r.Name)
+		}
+		return nil
+	}
+	if r.AllowExec != nil && !*r.AllowExec {
+		return fmt.Errorf("exec is not allowed in namespace %s (rule %s)", req.namespace, r.Name)
+	}
+	if req.tty && r.AllowTTY != nil && !*r.AllowTTY {
+		return fmt.Errorf("only commands without a tty are allowed in namespace %s (rule %s)", req.namespace, r.Name)
+	}
+	// an empty container means the default one, which cannot
+	// be known here so it is only allowed without a list
+	if len(r.Containers) > 0 && !slices.Contains(r.Containers, req.container) {
+		return fmt.Errorf("exec into container %q is not allowed in namespace %s, allowed are %s (rule %s)",
+			req.container, req.namespace, strings.Join(r.Containers, ", "), r.Name)
+	}
+	// attaching gets at the main process, whatever it is, which is
+	// not one of the commands allowed
+	if req.attach && !req.tty && len(r.commands) > 0 {
+		return fmt.Errorf("attach is not allowed in namespace %s, only the listed commands are (rule %s)", req.namespace, r.Name)
+	}
+	if !req.attach && !req.tty && len(r.commands) > 0 {
+		if !slices.ContainsFunc(r.commands, func(args []*regexp.Regexp) bool { return matchArgs(args, req.command) }) {
+			return fmt.Errorf("command %q is not allowed in namespace %s (rule %s)", redact(strings.Join(req.command, " ")), req.namespace, r.Name)
+		}
+	}
+	return nil
+}
+
+// matchArgs compares a command argument by argument, so a shell line
+// passed as one argument never matches a pattern of the program alone,
+// arguments missing from the command are matched as empty
+func matchArgs(args []*regexp.Regexp, command []string) bool {
+	if len(command) > len(args) {
+		return false
+	}
+	for i, re := range args {
+		arg := ""
+		if i < len(command) {
+			arg = command[i]
+		}
+		if !re.MatchString(arg) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkExecRules decides whether an exec is allowed, the error tells
+// the user why it was not
+func checkExecRules(ctx context.Context, req execRequest) error {
+	rule, err := matchExecRule(ctx, req)
+	if err != nil {
+		// without the labels the rules cannot be evaluated,
+		// guessing could let through what should be denied
+		SysLogger.Error().Err(err).Msgf("failed to fetch labels of namespace %s", req.namespace)
+		return fmt.Errorf("could not check the exec rules of namespace %s", req.namespace)
+	}
+	if rule == nil {
+		return nil
+	}
+	return rule.check(req)
+}
+
+// matchExecRule returns the rule deciding about a request, or nil
+func matchExecRule(ctx context.Context, req execRequest) (*execRule, error) {
+	rules := currentExecRules()
+	if rules == nil {
+		return nil, nil
+	}
+	var nsLabels map[string]string
+	if rules.needsNamespaceLabels() {
+		var err error
+		nsLabels, err = fetchNamespaceLabels(ctx, req.namespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rules.match(req, nsLabels), nil
+}
+
+// fetchNamespaceLabels looks up the labels of a namespace, they are
+// cached for a while as every exec needs them
+func fetchNamespaceLabels(ctx context.Context, namespace string) (map[string]string, error) {
+	namespaceSync.Lock()
+	cached, ok := namespaceCache[namespace]
+	namespaceSync.Unlock()
+	if ok && time.Since(cached.fetched) < namespaceLabelsTTL {
+		return cached.labels, nil
+	}
+
+	meta := metav1.PartialObjectMetadata{}
+	err := kubeRequest(ctx, http.MethodGet, fmt.Sprintf("/api/v1/namespaces/%s", namespace), nil, &meta)
+	if err != nil {
+		return nil, err
+	}
+	namespaceSync.Lock()
+	namespaceCache[namespace] = namespaceLabels{labels: meta.Labels, fetched: time.Now()}
+	namespaceSync.Unlock()
+	return meta.Labels, nil
+}
+
+// execRequest is what the exec rules look at of a session
+func (s *session) execRequest() execRequest {
+	return execRequest{
+		user:        s.user,
+		groups:      s.groups,
+		namespace:   s.namespace,
+		container:   s.container,
+		command:     s.command,
+		tty:         s.tty,
+		attach:      s.subresource == "attach",
+		portForward: s.subresource == "portforward",
+	}
+}
+
+// admitExec checks the justification, the approval and the exec rules of a session
+// before it is proxied, a denied exec is logged with the reason
+func admitExec(ctx context.Context, sess *session) error {
+	err := checkJustification(sess.namespace, sess.reason, sess.ticket)
+	if err == nil {
+		err = checkApproval(ctx, sess)
+	}
+	if err == nil {
+		err = checkExecRules(ctx, sess.execRequest())
+	}
+	if err != nil {
+		sess.logger.Warn().Str("event", "exec_denied").Str("reason", err.Error()).Msg("")
+	}
+	return err
+}
+
+// checkAdmissionExecRules applies the exec rules in the webhook too, so
+// they hold however the exec reached the apiserver, users with a bypass
+// are left alone like they are by canPass
+func checkAdmissionExecRules(ctx context.Context, rv admissionv1.AdmissionReview) error {
+	if slices.Contains(ByPassedUsers, rv.Request.UserInfo.Username) {
+		return nil
+	}
+	// past canPass only rexec could have set the extra, and it
+	// already decided to let the break-glass session through
+	if slices.Contains(rv.Request.UserInfo.Extra[breakGlassExtra], "true") {
+		return nil
+	}
+	req := execRequest{
+		user:        rv.Request.UserInfo.Username,
+		groups:      rv.Request.UserInfo.Groups,
+		namespace:   rv.Request.Namespace,
+		attach:      rv.Request.Kind.Kind == "PodAttachOptions",
+		portForward: rv.Request.Kind.Kind == "PodPortForwardOptions",
+	}
+	switch {
+	case req.portForward:
+		// none of its options matter to the rules
+	case req.attach:
+		options := corev1.PodAttachOptions{}
+		if err := decodeAdmissionObject(rv, &options); err != nil {
+			return err
+		}
+		req.container, req.tty = options.Container, options.TTY
+	default:
+		options := corev1.PodExecOptions{}
+		if err := decodeAdmissionObject(rv, &options); err != nil {
+			return err
+		}
+		req.container, req.command, req.tty = options.Container, options.Command, options.TTY
+	}
+	return checkExecRules(ctx, req)
+}
+
+// decodeAdmissionObject decodes the options of a connect request
+func decodeAdmissionObject(rv admissionv1.AdmissionReview, options interface{}) error {
+	if len(rv.Request.Object.Raw) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(rv.Request.Object.Raw, options)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", rv.Request.Kind.Kind, err)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var testExecRules = `
+rules:
+- name: admins
+  groups: [admins]
+- name: prod
+  namespaceSelector:
+    matchLabels:
+      env: prod
+  allowTTY: false
+  containers: [app]
+  commands:
+  - [cat, '/var/log/[^/]+']
+  - [ps, '(aux|-ef)?']
+- name: vault
+  namespaceSelector:
+    matchLabels:
+      team: vault
+  allowExec: false
+`
+
+func setExecRules(t *testing.T, raw string) {
+	rules, err := parseExecRules([]byte(raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	oldRules := activeExecRules
+	t.Cleanup(func() { activeExecRules = oldRules })
+	activeExecRules = rules
+}
+
+// setNamespaceLabels fills the cache so no labels are fetched
+func setNamespaceLabels(t *testing.T, namespaces map[string]map[string]string) {
+	oldCache := namespaceCache
+	t.Cleanup(func() { namespaceCache = oldCache })
+	namespaceCache = map[string]namespaceLabels{}
+	for namespace, nsLabels := range namespaces {
+		namespaceCache[namespace] = namespaceLabels{labels: nsLabels, fetched: time.Now()}
+	}
+}
+
+func TestParseExecRulesErrors(t *testing.T) {
+	for _, raw := range []string{
+		"rules:\n- commands: [['(']]\n",
+		"rules:\n- commands: [[]]\n",
+		"rules:\n- commands: ['^ps']\n",
+		"rules:\n- namespaceSelector:\n    matchExpressions:\n    - {key: env, operator: Bad}\n",
+		"rules:\n- allowShell: true\n",
+	} {
+		if _, err := parseExecRules([]byte(raw)); err == nil {
+			t.Fatalf("expected error for %q", raw)
+		}
+	}
+}
+
+func TestCheckExecRules(t *testing.T) {
+	setExecRules(t, testExecRules)
+	setNamespaceLabels(t, map[string]map[string]string{
+		"shop":    {"env": "prod"},
+		"secrets": {"team": "vault"},
+		"dev":     {"env": "dev"},
+	})
+
+	for _, tc := range []struct {
+		req     execRequest
+		allowed bool
+	}{
+		{execRequest{user: "alice", groups: []string{"admins"}, namespace: "secrets", tty: true}, true},
+		{execRequest{user: "bob", namespace: "secrets", command: []string{"ls"}}, false},
+		{execRequest{user: "bob", namespace: "shop", container: "app", tty: true}, false},
+		{execRequest{user: "bob", namespace: "shop", container: "app", command: []string{"cat", "/var/log/app.log"}}, true},
+		{execRequest{user: "bob", namespace: "shop", container: "app", command: []string{"ps", "aux"}}, true},
+		{execRequest{user: "bob", namespace: "shop", container: "app", command: []string{"ps"}}, true},
+		{execRequest{user: "bob", namespace: "shop", container: "app", command: []string{"rm", "-rf", "/"}}, false},
+		// patterns match whole arguments, one by one
+		{execRequest{user: "bob", namespace: "shop", container: "app", command: []string{"cat", "/var/log/../../etc/shadow"}}, false},
+		{execRequest{user: "bob", namespace: "shop", container: "app", command: []string{"ps aux; rm -rf /"}}, false},
+		{execRequest{user: "bob", namespace: "shop", container: "app", command: []string{"sh", "-c", "ps aux; rm -rf /"}}, false},
+		{execRequest{user: "bob", namespace: "shop", container: "app", command: []string{"ps", "aux", "-x"}}, false},
+		{execRequest{user: "bob", namespace: "shop", container: "app", command: []string{"/bin/ps", "aux"}}, false},
+		{execRequest{user: "bob", namespace: "shop", container: "sidecar", command: []string{"ps"}}, false},
+		{execRequest{user: "bob", namespace: "shop", command: []string{"ps"}}, false},
+		{execRequest{user: "bob", namespace: "dev", tty: true}, true},
+		{execRequest{user: "bob", namespace: "shop", container: "app", attach: true}, false},
+		{execRequest{user: "bob", namespace: "dev", attach: true}, true},
+	} {
+		err := checkExecRules(context.Background(), tc.req)
+		if (err == nil) != tc.allowed {
+			t.Errorf("%+v: got error %v, want allowed=%v", tc.req, err, tc.allowed)
+		}
+	}
+}
+
+func TestAdmitExecLogsDenial(t *testing.T) {
+	setExecRules(t, "rules:\n- users: [bob]\n  allowTTY: false\n")
+	var buf bytes.Buffer
+	sess := &session{id: "test", user: "bob", namespace: "dev", tty: true, logger: zerolog.New(&buf)}
+	if admitExec(context.Background(), sess) == nil {
+		t.Fatal("tty session was admitted")
+	}
+	if !strings.Contains(buf.String(), `"event":"exec_denied"`) {
+		t.Fatalf("denial was not logged: %s", buf.String())
+	}
+}
+
+func TestExecHandlerExecRules(t *testing.T) {
+	oldBypass := ByPassedUsers
+	oldSauce := SecretSauce
+	t.Cleanup(func() {
+		ByPassedUsers = oldBypass
+		SecretSauce = oldSauce
+	})
+	ByPassedUsers = []string{"ci"}
+	SecretSauce = "the-right-sauce"
+	setExecRules(t, "rules:\n- containers: [app]\n")
+
+	options, _ := json.Marshal(map[string]any{"kind": "PodExecOptions", "container": "db", "command": []string{"sh"}})
+	ar := makeAdmissionReview("PodExecOptions", "lauren", map[string][]string{
+		"secret-sauce": {"the-right-sauce"},
+	})
+	ar.Request.Namespace = "shop"
+	ar.Request.Object = runtime.RawExtension{Raw: options}
+
+	_, parsed := postExecHandler(t, ar, "application/json")
+	if parsed.Response == nil || parsed.Response.Allowed {
+		t.Fatalf("expected Allowed=false, got: %+v", parsed.Response)
+	}
+	if parsed.Response.Result == nil || !strings.Contains(parsed.Response.Result.Message, `container "db"`) {
+		t.Fatalf("unexpected denial message: %+v", parsed.Response.Result)
+	}
+
+	// bypassed users are not restricted
+	ar.Request.UserInfo.Username = "ci"
+	_, parsed = postExecHandler(t, ar, "application/json")
+	if parsed.Response == nil || !parsed.Response.Allowed {
+		t.Fatalf("expected Allowed=true for a bypassed user, got: %+v", parsed.Response)
+	}
+}
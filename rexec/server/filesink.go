@@ -0,0 +1,110 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// fileSink writes audit events into a local file and rotates it
+// once it grows over maxSize, keeping maxBackups old files around
+type fileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// newFileSink opens path for appending, maxSize is in megabytes
+func newFileSink(path string, maxSize, maxBackups int) (*fileSink, error) {
+	if path == "" {
+		return nil, errors.New("--audit-file-path is required")
+	}
+	if maxSize <= 0 {
+		maxSize = 100
+	}
+	s := &fileSink{
+		path:       path,
+		maxSize:    int64(maxSize) * 1024 * 1024,
+		maxBackups: maxBackups,
+	}
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// rotate shifts path.N-1 to path.N, ..., path to path.1
+// and starts a fresh file, callers must hold the lock
+func (s *fileSink) rotate() error {
+	err := s.file.Close()
+	if err != nil {
+		return err
+	}
+	if s.maxBackups > 0 {
+		for i := s.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		}
+		err = os.Rename(s.path, fmt.Sprintf("%s.1", s.path))
+	} else {
+		err = os.Remove(s.path)
+	}
+	if err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileSink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return 0, errors.New("audit file sink is closed")
+	}
+	if s.size > 0 && s.size+int64(len(p)) > s.maxSize {
+		err := s.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.file.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+func (s *fileSink) WriteLevel(_ zerolog.Level, p []byte) (int, error) {
+	return s.Write(p)
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
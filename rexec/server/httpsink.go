@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// httpSink posts audit events in batches as newline delimited json,
+// batches which could not be delivered are spilled into bufferDir
+// and retried once the endpoint is reachable again
+type httpSink struct {
+	url           string
+	headers       http.Header
+	batchSize     int
+	flushInterval time.Duration
+	retries       int
+	bufferDir     string
+	client        *http.Client
+	queue         chan []byte
+	done          chan struct{}
+	// closeSync guards the queue from being written after close
+	closeSync sync.RWMutex
+	closed    bool
+	// bufferSync keeps drain from listing a file spill is still
+	// writing, it is never held while posting
+	bufferSync sync.Mutex
+}
+
+func newHTTPSink(url string, headers []string, batchSize int, flushInterval time.Duration, retries int, bufferDir string) (*httpSink, error) {
+	if url == "" {
+		return nil, errors.New("--audit-http-url is required")
+	}
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	if flushInterval <= 0 {
+		flushInterval = 5 * time.Second
+	}
+	if retries < 0 {
+		retries = 0
+	}
+
+	h := http.Header{}
+	for _, header := range headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid header %q, expected Name: value", header)
+		}
+		h.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	if bufferDir != "" {
+		err := os.MkdirAll(bufferDir, 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := &httpSink{
+		url:           url,
+		headers:       h,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		retries:       retries,
+		bufferDir:     bufferDir,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		queue:         make(chan []byte, batchSize*10),
+		done:          make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *httpSink) Write(p []byte) (int, error) {
+	// zerolog reuses the buffer once we return
+	event := append([]byte(nil), p...)
+
+	s.closeSync.RLock()
+	defer s.closeSync.RUnlock()
+	if s.closed {
+		return 0, errors.New("audit http sink is closed")
+	}
+	select {
+	case s.queue <- event:
+	default:
+		// if the endpoint is too slow we rather go to
+		// disk than blocking the sessions being audited
+		err := s.spill([][]byte{event})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (s *httpSink) WriteLevel(_ zerolog.Level, p []byte) (int, error) {
+	return s.Write(p)
+}
+
+// run collects events from the queue and flushes them
+// once the batch is full or the flush interval passed
+func (s *httpSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	var batch [][]byte
+	for {
+		select {
+		case event, ok := <-s.queue:
+			if !ok {
+				s.flush(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= s.batchSize {
+				s.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			s.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+// flush delivers the batch, events buffered on disk are
+// delivered first so the endpoint receives them in order
+func (s *httpSink) flush(batch [][]byte) {
+	if len(batch) == 0 {
+		s.drain()
+		return
+	}
+
+	var err error
+	if s.drain() {
+		err = s.send(bytes.Join(batch, nil))
+	} else {
+		err = errors.New("audit endpoint is not reachable")
+	}
+	if err != nil {
+		SysLogger.Error().Err(err).Msgf("failed to deliver %d audit events", len(batch))
+		err = s.spill(batch)
+		if err != nil {
+			SysLogger.Error().Err(err).Msgf("dropping %d audit events", len(batch))
+		}
+	}
+}
+
+// send posts the payload, retrying with a backoff
+func (s *httpSink) send(payload []byte) error {
+	var err error
+	backoff := 500 * time.Millisecond
+	for try := 0; try <= s.retries; try++ {
+		if try > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		err = s.post(payload)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *httpSink) post(payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	for name, values := range s.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit endpoint responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// spill writes events into a new file in the buffer dir
+func (s *httpSink) spill(events [][]byte) error {
+	if s.bufferDir == "" {
+		return errors.New("no --audit-http-buffer-dir configured")
+	}
+	s.bufferSync.Lock()
+	defer s.bufferSync.Unlock()
+	name := filepath.Join(s.bufferDir, fmt.Sprintf("%d.ndjson", time.Now().UnixNano()))
+	return os.WriteFile(name, bytes.Join(events, nil), 0600)
+}
+
+// drain sends the buffered files oldest first, stopping at the
+// first failure, it reports whether the buffer is empty afterwards,
+// only run drains so the listed files are not touched by anyone else
+func (s *httpSink) drain() bool {
+	if s.bufferDir == "" {
+		return true
+	}
+	s.bufferSync.Lock()
+	files, err := filepath.Glob(filepath.Join(s.bufferDir, "*.ndjson"))
+	s.bufferSync.Unlock()
+	if err != nil {
+		SysLogger.Error().Err(err).Msg("failed to list buffered audit events")
+		return false
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		payload, err := os.ReadFile(file)
+		if err != nil {
+			SysLogger.Error().Err(err).Msgf("failed to read buffered audit events from %s", file)
+			return false
+		}
+		err = s.post(payload)
+		if err != nil {
+			return false
+		}
+		os.Remove(file)
+	}
+	return true
+}
+
+// Close flushes the pending events and stops the sink
+func (s *httpSink) Close() error {
+	s.closeSync.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.closeSync.Unlock()
+	<-s.done
+	return nil
+}
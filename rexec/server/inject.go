@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+// websocket close codes for a connection that ran its course
+// and for one closed by a policy
+const (
+	wsCloseNormal          = 1000
+	wsClosePolicyViolation = 1008
+)
+
+// copyOutput replaces io.Copy on the way back to the user, messages of
+// rexec can only be slipped in between frames so every write remembers
+// whether the stream toward the user ended on a frame boundary
+func (t *TCPLogger) copyOutput() error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := t.Read(buf)
+		if n > 0 {
+			boundary := t.outputBoundary()
+			t.clientSync.Lock()
+			_, werr := t.client.Write(buf[:n])
+			t.atBoundary = boundary
+			if werr == nil {
+				werr = t.flushNotices()
+			}
+			t.clientSync.Unlock()
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// outputBoundary tells whether the output read so far ends with a
+// complete frame, it has to run on the goroutine reading the output
+func (t *TCPLogger) outputBoundary() bool {
+	if t.outputPassthrough || !t.responseHead.done {
+		return false
+	}
+	if t.spdyOutput != nil {
+		return len(t.spdyOutput.buf) == 0 && t.spdyOutput.skip == 0
+	}
+	return len(t.output.buf) == 0 && t.output.skip == 0 && !t.output.fragmented && !t.output.skipFragmented
+}
+
+// notify shows a message to the user, it waits for the next frame
+// boundary if the output is in the middle of a frame
+func (t *TCPLogger) notify(message string) {
+	t.clientSync.Lock()
+	defer t.clientSync.Unlock()
+	t.notices = append(t.notices, message)
+	if t.atBoundary {
+		t.flushNotices()
+	}
+}
+
+// flushNotices writes the waiting messages, clientSync has to be held
+func (t *TCPLogger) flushNotices() error {
+	for len(t.notices) > 0 {
+		frame := t.noticeFrame(t.notices[0])
+		t.notices = t.notices[1:]
+		if frame == nil {
+			continue
+		}
+		_, err := t.client.Write(frame)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// terminate shows a message to the user and closes the session, a
+// websocket is closed with the given code and reason
+func (t *TCPLogger) terminate(message string, code uint16, reason string) {
+	if message != "" {
+		t.notify(message)
+	}
+	t.clientSync.Lock()
+	if t.atBoundary && t.websocket() {
+		payload := binary.BigEndian.AppendUint16(nil, code)
+		t.client.Write(encodeWSFrame(wsOpClose, append(payload, reason...)))
+	}
+	t.clientSync.Unlock()
+	// closing both sides ends the copies and with them the session
+	t.Conn.Close()
+	t.client.Close()
+}
+
+// websocket tells whether the session was upgraded to a websocket
+func (t *TCPLogger) websocket() bool {
+	t.protocolSync.Lock()
+	defer t.protocolSync.Unlock()
+	return t.protocol != nil
+}
+
+// noticeFrame wraps a message into a frame of the stream the user
+// reads, with a tty everything is on stdout, otherwise stderr is used
+// if it was requested
+func (t *TCPLogger) noticeFrame(message string) []byte {
+	stream := byte(streamStdout)
+	data := []byte(message + "\n")
+	if t.session.tty {
+		data = []byte("\r\n" + message + "\r\n")
+	} else if t.session.stderr {
+		stream = streamStderr
+	} else if !t.session.stdout {
+		return nil
+	}
+
+	t.protocolSync.Lock()
+	protocol := t.protocol
+	t.protocolSync.Unlock()
+	if protocol != nil {
+		if protocol.base64 {
+			payload := append([]byte{'0' + stream}, base64.StdEncoding.EncodeToString(data)...)
+			return encodeWSFrame(wsOpText, payload)
+		}
+		return encodeWSFrame(wsOpBinary, append([]byte{stream}, data...))
+	}
+
+	id, ok := t.spdyStreams.id(stream)
+	if !ok {
+		return nil
+	}
+	return encodeSPDYData(id, data)
+}
+
+// encodeWSFrame builds an unmasked frame as a server sends it
+func encodeWSFrame(opcode byte, payload []byte) []byte {
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	return append(frame, payload...)
+}
+
+// encodeSPDYData builds a spdy data frame
+func encodeSPDYData(id spdy.StreamId, data []byte) []byte {
+	frame := binary.BigEndian.AppendUint32(nil, uint32(id)&0x7FFFFFFF)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(data))&0xFFFFFF)
+	return append(frame, data...)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	// query parameters the plugin sends the justification in
+	reasonParam = "reason"
+	ticketParam = "ticket"
+	// longer reasons are cut, they end up on every audit event
+	maxReasonLength = 512
+)
+
+var ticketPattern *regexp.Regexp
+
+// setupJustification compiles the ticket pattern, the whole ticket
+// has to match
+func setupJustification() error {
+	ticketPattern = nil
+	if TicketPattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", TicketPattern))
+	if err != nil {
+		return fmt.Errorf("invalid ticket pattern %q: %w", TicketPattern, err)
+	}
+	ticketPattern = re
+	return nil
+}
+
+// justificationRequired tells whether sessions in a namespace need a reason
+func justificationRequired(namespace string) bool {
+	return slices.Contains(JustificationNamespaces, namespace) || slices.Contains(JustificationNamespaces, "*")
+}
+
+// checkJustification returns why the justification of a session is not
+// good enough, a ticket is optional but has to look like one if given
+func checkJustification(namespace, reason, ticket string) error {
+	if ticket != "" && ticketPattern != nil && !ticketPattern.MatchString(ticket) {
+		return fmt.Errorf("ticket %q does not match %s", ticket, TicketPattern)
+	}
+	if reason == "" && justificationRequired(namespace) {
+		return fmt.Errorf("sessions in namespace %s need a justification, pass it with --reason", namespace)
+	}
+	return nil
+}
+
+// cleanReason keeps a reason to a single line of reasonable length
+func cleanReason(reason string) string {
+	reason = strings.Join(strings.Fields(reason), " ")
+	if len(reason) > maxReasonLength {
+		reason = strings.ToValidUTF8(reason[:maxReasonLength], "")
+	}
+	return redact(reason)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func setJustification(t *testing.T, namespaces []string, pattern string) {
+	oldNamespaces := JustificationNamespaces
+	oldPattern := TicketPattern
+	t.Cleanup(func() {
+		JustificationNamespaces = oldNamespaces
+		TicketPattern = oldPattern
+		setupJustification()
+	})
+	JustificationNamespaces = namespaces
+	TicketPattern = pattern
+	if err := setupJustification(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckJustification(t *testing.T) {
+	setJustification(t, []string{"prod"}, `INC-\d+`)
+
+	for _, tc := range []struct {
+		namespace, reason, ticket string
+		allowed                   bool
+	}{
+		{"prod", "debugging checkout", "INC-42", true},
+		{"prod", "debugging checkout", "", true},
+		{"prod", "", "INC-42", false},
+		{"prod", "debugging checkout", "whatever", false},
+		{"prod", "debugging checkout", "xINC-1junk", false},
+		{"dev", "", "", true},
+		{"dev", "", "whatever", false},
+	} {
+		err := checkJustification(tc.namespace, tc.reason, tc.ticket)
+		if (err == nil) != tc.allowed {
+			t.Errorf("%+v: got error %v, want allowed=%v", tc, err, tc.allowed)
+		}
+	}
+
+	setJustification(t, []string{"*"}, "")
+	if checkJustification("dev", "", "") == nil {
+		t.Fatal("session without a reason was allowed with *")
+	}
+}
+
+func TestInvalidTicketPattern(t *testing.T) {
+	setJustification(t, nil, "")
+	TicketPattern = "("
+	if err := setupJustification(); err == nil {
+		t.Fatal("expected error for invalid ticket pattern")
+	}
+}
+
+func TestSessionJustification(t *testing.T) {
+	setJustification(t, []string{"prod"}, "")
+	oldLogger := auditLogger
+	t.Cleanup(func() { auditLogger = oldLogger })
+	var buf bytes.Buffer
+	auditLogger = zerolog.New(&buf)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	params := url.Values{
+		"command": {"bash"},
+		"reason":  {"  restarting\n the worker  "},
+		"ticket":  {"INC-42"},
+	}
+	sess := newSession("oneoff", req, "lauren", nil, "prod", "pod", "exec", params)
+	if err := admitExec(context.Background(), sess); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sess.logStart()
+
+	event := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if event["justification"] != "restarting the worker" || event["ticket"] != "INC-42" {
+		t.Fatalf("justification missing from event: %v", event)
+	}
+
+	buf.Reset()
+	sess = newSession("oneoff", req, "lauren", nil, "prod", "pod", "exec", url.Values{"command": {"bash"}})
+	if err := admitExec(context.Background(), sess); err == nil {
+		t.Fatal("session without a reason was admitted")
+	}
+	if !strings.Contains(buf.String(), `"event":"exec_denied"`) {
+		t.Fatalf("denial was not logged: %s", buf.String())
+	}
+}
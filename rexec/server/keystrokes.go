@@ -0,0 +1,54 @@
+package server
+
+// storeOrFlush will feed keystrokes into the line editor of the
+// session and log the lines finished by enter or a certain limit, it
+// runs before the keystrokes are forwarded, so it returns false when a
+// line got the session terminated and the keystrokes have to be dropped
+func storeOrFlush(audit keystrokes) bool {
+	// only the editor needs the lock, the policy may write to the
+	// client and a slow one must not hold up the other sessions
+	commandSync.Lock()
+	editor, ok := editorMap[audit.ctxid]
+	if !ok {
+		editor = &lineEditor{}
+		editorMap[audit.ctxid] = editor
+	}
+	if audit.hidden {
+		editor.hidden = true
+	}
+	lines := editor.feed(audit.ascii)
+	commandSync.Unlock()
+
+	for _, line := range lines {
+		if screen, ok := audit.screens[line.end]; ok {
+			line.screen = &screen
+		}
+		// a line typed at a prompt is logged once it is known
+		// whether the terminal echoed it
+		if line.hidden && audit.echo != nil {
+			audit.echo.hold(audit.session, line)
+		} else {
+			logCommand(audit.session, line)
+		}
+		// the screen shows what history or completion filled
+		// in, so both versions of the command are checked
+		if !enforcePolicy(audit.session, line.text, line.hidden) {
+			return false
+		}
+		if line.screen != nil && line.screen.text != line.text && !enforcePolicy(audit.session, line.screen.text, false) {
+			return false
+		}
+	}
+	return true
+}
+
+type keystrokes struct {
+	ctxid   string
+	session *session
+	ascii   []byte
+	// the keys up to the first enter were typed with echo off
+	hidden bool
+	echo   *echoWatch
+	// lines taken from the screen, keyed by the offset of their enter
+	screens map[int]screenLine
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// kubeError is returned by kubeRequest when the apiserver
+// responds with a non 2xx status code
+type kubeError struct {
+	Code    int
+	Message string
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("kube apiserver responded with %d: %s", e.Code, e.Message)
+}
+
+// kubeRequest talks to the kube apiserver with the service account
+// token of rexec, body and out are json encoded/decoded if not nil
+func kubeRequest(ctx context.Context, method, path string, body, out interface{}) error {
+	return kubeRequestAs(ctx, nil, method, path, body, out)
+}
+
+// impersonate returns the headers acting as a user, the shared key
+// lets the request past the webhook as it comes through rexec
+func impersonate(user string, groups []string) http.Header {
+	header := http.Header{}
+	header.Set("Impersonate-User", user)
+	for _, group := range groups {
+		header.Add("Impersonate-Group", group)
+	}
+	header.Set("Impersonate-Extra-Secret-Sauce", SecretSauce)
+	return header
+}
+
+// kubeRequestAs is kubeRequest with extra headers, like the ones
+// impersonating a user
+func kubeRequestAs(ctx context.Context, header http.Header, method, path string, body, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("https://%s%s", targetAddress, path), reqBody)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: CAPool,
+			},
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// the apiserver usually sends a status object explaining
+		// what went wrong, if not we pass the body as is
+		status := metav1.Status{}
+		if json.Unmarshal(raw, &status) == nil && status.Message != "" {
+			return &kubeError{Code: resp.StatusCode, Message: status.Message}
+		}
+		return &kubeError{Code: resp.StatusCode, Message: string(raw)}
+	}
+
+	if out != nil {
+		return json.Unmarshal(raw, out)
+	}
+	return nil
+}
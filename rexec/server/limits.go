@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// how often the sessions are checked against their limits
+const watchdogInterval = 5 * time.Second
+
+// setLimits picks the duration and idle limits of a session, an exec
+// rule matching the session overrides the global ones
+func (s *session) setLimits(ctx context.Context) {
+	s.maxDuration = MaxSessionDuration
+	s.idleTimeout = IdleTimeout
+	rule, err := matchExecRule(ctx, s.execRequest())
+	if err != nil {
+		SysLogger.Error().Err(err).Msgf("failed to look up the limits of %s, using the global ones", s.id)
+		return
+	}
+	if rule == nil {
+		return
+	}
+	if rule.MaxSessionDuration != nil {
+		s.maxDuration = rule.MaxSessionDuration.Duration
+	}
+	if rule.IdleTimeout != nil {
+		s.idleTimeout = rule.IdleTimeout.Duration
+	}
+}
+
+// sessionWatchdog closes the sessions which are over their limits
+func sessionWatchdog() {
+	for {
+		time.Sleep(watchdogInterval)
+		enforceLimits(time.Now())
+	}
+}
+
+func enforceLimits(now time.Time) {
+	mapSync.Lock()
+	sessions := make([]*session, 0, len(sessionMap))
+	for _, sess := range sessionMap {
+		sessions = append(sessions, sess)
+	}
+	mapSync.Unlock()
+
+	for _, sess := range sessions {
+		if sess.closing() {
+			continue
+		}
+		if sess.maxDuration > 0 && now.Sub(sess.start) >= sess.maxDuration {
+			sess.timeout(fmt.Sprintf("rexec closed the session: it reached the maximum duration of %s", sess.maxDuration), "max duration reached")
+			continue
+		}
+		idle := now.Sub(time.Unix(0, sess.lastInput.Load()))
+		if sess.idleTimeout > 0 && idle >= sess.idleTimeout {
+			sess.timeout(fmt.Sprintf("rexec closed the session: it was idle for %s", sess.idleTimeout), "idle timeout")
+		}
+	}
+}
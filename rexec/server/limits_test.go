@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func setLimits(t *testing.T, maxDuration, idleTimeout time.Duration) {
+	oldMax, oldIdle := MaxSessionDuration, IdleTimeout
+	t.Cleanup(func() { MaxSessionDuration, IdleTimeout = oldMax, oldIdle })
+	MaxSessionDuration, IdleTimeout = maxDuration, idleTimeout
+}
+
+func TestSessionSetLimits(t *testing.T) {
+	setLimits(t, 8*time.Hour, 30*time.Minute)
+	setExecRules(t, "rules:\n- users: [lauren]\n  maxSessionDuration: 1h\n  idleTimeout: 0s\n")
+
+	sess := &session{user: "bob"}
+	sess.setLimits(context.Background())
+	if sess.maxDuration != 8*time.Hour || sess.idleTimeout != 30*time.Minute {
+		t.Fatalf("got %s and %s, want the global limits", sess.maxDuration, sess.idleTimeout)
+	}
+	sess = &session{user: "lauren"}
+	sess.setLimits(context.Background())
+	if sess.maxDuration != time.Hour || sess.idleTimeout != 0 {
+		t.Fatalf("got %s and %s, want the limits of the rule", sess.maxDuration, sess.idleTimeout)
+	}
+}
+
+func TestEnforceLimits(t *testing.T) {
+	oldSessions := sessionMap
+	t.Cleanup(func() { sessionMap = oldSessions })
+
+	now := time.Now()
+	newSess := func(id string, started, input time.Time) *session {
+		sess := &session{id: id, tty: true, start: started, maxDuration: time.Hour, idleTimeout: 10 * time.Minute, logger: zerolog.Nop()}
+		sess.lastInput.Store(input.UnixNano())
+		return sess
+	}
+	long := newSess("long", now.Add(-2*time.Hour), now)
+	idle := newSess("idle", now.Add(-20*time.Minute), now.Add(-15*time.Minute))
+	busy := newSess("busy", now.Add(-20*time.Minute), now.Add(-time.Minute))
+	_, user := negotiatedLogger(t, long)
+	sessionMap = map[string]*session{"long": long, "idle": idle, "busy": busy}
+
+	raw := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(user)
+		raw <- data
+	}()
+	enforceLimits(now)
+
+	if long.closeReason != "max duration reached" || idle.closeReason != "idle timeout" || busy.closeReason != "" {
+		t.Fatalf("unexpected close reasons %q, %q and %q", long.closeReason, idle.closeReason, busy.closeReason)
+	}
+	messages, err := (&wsDecoder{}).feed(<-raw)
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("unexpected messages: %q %v", messages, err)
+	}
+	if !strings.Contains(string(messages[0].Payload), "maximum duration of 1h0m0s") {
+		t.Fatalf("unexpected message: %q", messages[0].Payload)
+	}
+	if messages[1].Opcode != wsOpClose || binary.BigEndian.Uint16(messages[1].Payload) != wsCloseNormal {
+		t.Fatalf("expected a normal close frame, got %q", messages[1].Payload)
+	}
+}
@@ -1,10 +1,160 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"net/http"
 )
 
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	// messages bigger than this are not held in memory, kubernetes
+	// sends way smaller chunks anyway, the output skips them but the
+	// input has to be inspected whole so it is closed instead
+	maxWSMessageSize = 4 * 1024 * 1024
+	// an http head bigger than this is not an upgrade we understand
+	maxHTTPHeadSize = 64 * 1024
+)
+
+// wsMessage is a complete websocket message, fragmented messages
+// are already merged and the payload is unmasked
+type wsMessage struct {
+	Opcode  byte
+	Payload []byte
+}
+
+// wsDecoder reassembles websocket messages from a byte stream, as
+// reads do not respect frame boundaries it keeps the unparsed bytes
+// and the state of fragmented messages between calls
+type wsDecoder struct {
+	buf []byte
+	// opcode and payload of the fragmented message being assembled
+	fragmented  bool
+	fragOpcode  byte
+	fragPayload []byte
+	// bytes left of a frame we decided to skip
+	skip int
+	// the skipped frame was part of a fragmented message
+	skipFragmented bool
+	// oversized messages are skipped rather than being an error
+	skipOversized bool
+}
+
+// feed takes the next chunk of the stream and returns the messages
+// completed by it, an error means the stream is not websocket anymore
+func (d *wsDecoder) feed(data []byte) ([]wsMessage, error) {
+	d.buf = append(d.buf, data...)
+	var messages []wsMessage
+	consumed := 0
+	for consumed < len(d.buf) {
+		rest := d.buf[consumed:]
+
+		if d.skip > 0 {
+			n := min(d.skip, len(rest))
+			d.skip -= n
+			consumed += n
+			continue
+		}
+
+		frame, size, err := parseWebSocketFrame(rest)
+		if err != nil {
+			d.buf = nil
+			return messages, err
+		}
+		if frame == nil {
+			// waiting for the rest of the frame, unless it is too big
+			// to wait for, then we drop its payload as it passes
+			if size > 0 && size-wsHeaderLen(rest) > maxWSMessageSize {
+				header := wsHeaderLen(rest)
+				if !d.skipOversized {
+					d.buf = nil
+					return messages, fmt.Errorf("websocket frame of %d bytes", size-header)
+				}
+				d.skip = size - header
+				d.skipFragmented = !finBit(rest)
+				d.fragmented = false
+				d.fragPayload = nil
+				consumed += header
+				SysLogger.Error().Msgf("skipping websocket frame of %d bytes", d.skip)
+				continue
+			}
+			break
+		}
+		consumed += size
+
+		message, err := d.assemble(frame)
+		if err != nil {
+			d.buf = nil
+			return messages, err
+		}
+		if message != nil {
+			messages = append(messages, *message)
+		}
+	}
+
+	// keeping only what was not consumed yet
+	d.buf = append(d.buf[:0], d.buf[consumed:]...)
+	return messages, nil
+}
+
+// assemble merges fragments into messages, control frames
+// can be interleaved with fragments so they pass through
+func (d *wsDecoder) assemble(frame *webSocketFrame) (*wsMessage, error) {
+	if frame.Opcode >= wsOpClose {
+		return &wsMessage{Opcode: frame.Opcode, Payload: frame.Payload}, nil
+	}
+
+	if frame.Opcode == wsOpContinuation {
+		if d.skipFragmented {
+			// the start of this message was already skipped
+			d.skipFragmented = !frame.Fin
+			return nil, nil
+		}
+		if !d.fragmented {
+			return nil, errors.New("continuation frame without a fragmented message")
+		}
+		if len(d.fragPayload)+len(frame.Payload) > maxWSMessageSize {
+			if !d.skipOversized {
+				return nil, errors.New("fragmented websocket message over the size limit")
+			}
+			SysLogger.Error().Msg("skipping fragmented websocket message over the size limit")
+			d.fragmented = false
+			d.fragPayload = nil
+			d.skipFragmented = !frame.Fin
+			return nil, nil
+		}
+		d.fragPayload = append(d.fragPayload, frame.Payload...)
+		if !frame.Fin {
+			return nil, nil
+		}
+		message := &wsMessage{Opcode: d.fragOpcode, Payload: d.fragPayload}
+		d.fragmented = false
+		d.fragPayload = nil
+		return message, nil
+	}
+
+	if d.fragmented {
+		return nil, errors.New("new message before the fragmented one finished")
+	}
+	d.skipFragmented = false
+	if !frame.Fin {
+		d.fragmented = true
+		d.fragOpcode = frame.Opcode
+		d.fragPayload = frame.Payload
+		return nil, nil
+	}
+	return &wsMessage{Opcode: frame.Opcode, Payload: frame.Payload}, nil
+}
+
 type webSocketFrame struct {
 	Fin     bool
 	Opcode  byte
@@ -12,47 +162,90 @@ type webSocketFrame struct {
 	Payload []byte
 }
 
-// parseWebSocketFrame is for parsing websocket traffic
-func parseWebSocketFrame(data []byte) (*webSocketFrame, error) {
+// wsHeaderLen returns the length of the frame header at the start of data,
+// it is only valid once parseWebSocketFrame returned a size for data
+func wsHeaderLen(data []byte) int {
+	offset := 2
+	switch data[1] & 0x7F {
+	case 126:
+		offset = 4
+	case 127:
+		offset = 10
+	}
+	if data[1]&0x80 != 0 {
+		offset += 4
+	}
+	return offset
+}
+
+func finBit(data []byte) bool {
+	return data[0]&0x80 != 0
+}
+
+// parseWebSocketFrame parses the frame at the start of data, returning the
+// frame and its size on the wire, if data does not hold the whole frame
+// yet the frame is nil and the size is what is needed, or 0 if even the
+// header is incomplete, the payload is copied so data is never altered
+func parseWebSocketFrame(data []byte) (*webSocketFrame, int, error) {
 	if len(data) < 2 {
-		return nil, errors.New("data too short to be a WebSocket frame")
+		return nil, 0, nil
 	}
 
 	fin := data[0]&0x80 != 0
+	if data[0]&0x70 != 0 {
+		return nil, 0, errors.New("reserved bits set, extensions are not supported")
+	}
 	opcode := data[0] & 0x0F
+	switch opcode {
+	case wsOpContinuation, wsOpText, wsOpBinary, wsOpClose, wsOpPing, wsOpPong:
+	default:
+		return nil, 0, fmt.Errorf("unknown opcode 0x%x", opcode)
+	}
 
 	mask := data[1]&0x80 != 0
-	payloadLen := int(data[1] & 0x7F)
+	payloadLen := uint64(data[1] & 0x7F)
 
 	var offset int
 	switch payloadLen {
 	case 126:
 		if len(data) < 4 {
-			return nil, errors.New("data too short for extended payload length")
+			return nil, 0, nil
 		}
-		payloadLen = int(binary.BigEndian.Uint16(data[2:4]))
+		payloadLen = uint64(binary.BigEndian.Uint16(data[2:4]))
 		offset = 4
 	case 127:
 		if len(data) < 10 {
-			return nil, errors.New("data too short for extended payload length")
+			return nil, 0, nil
 		}
-		payloadLen = int(binary.BigEndian.Uint64(data[2:10]))
+		payloadLen = binary.BigEndian.Uint64(data[2:10])
 		offset = 10
 	default:
 		offset = 2
 	}
 
-	if mask {
-		offset += 4
+	if opcode >= wsOpClose && (payloadLen > 125 || !fin) {
+		return nil, 0, errors.New("invalid control frame")
+	}
+	if payloadLen > 1<<40 {
+		return nil, 0, errors.New("frame too large")
 	}
 
 	var maskingKey []byte
 	if mask {
-		maskingKey = data[offset-4 : offset]
+		if len(data) < offset+4 {
+			return nil, 0, nil
+		}
+		maskingKey = data[offset : offset+4]
+		offset += 4
 	}
 
-	payload := data[offset:]
+	size := offset + int(payloadLen)
+	if len(data) < size {
+		return nil, size, nil
+	}
 
+	payload := make([]byte, payloadLen)
+	copy(payload, data[offset:size])
 	if mask {
 		for i := 0; i < len(payload); i++ {
 			payload[i] ^= maskingKey[i%4]
@@ -64,5 +257,41 @@ func parseWebSocketFrame(data []byte) (*webSocketFrame, error) {
 		Opcode:  opcode,
 		Mask:    mask,
 		Payload: payload,
-	}, nil
+	}, size, nil
+}
+
+// httpHead collects the http request or response of an upgrade,
+// everything after it belongs to the upgraded protocol
+type httpHead struct {
+	buf  []byte
+	done bool
+}
+
+// feed returns the bytes following the head, once it is complete
+func (h *httpHead) feed(data []byte) ([]byte, bool, error) {
+	if h.done {
+		return data, true, nil
+	}
+	h.buf = append(h.buf, data...)
+	end := bytes.Index(h.buf, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(h.buf) > maxHTTPHeadSize {
+			return nil, false, errors.New("http head too large")
+		}
+		return nil, false, nil
+	}
+	h.done = true
+	rest := h.buf[end+4:]
+	h.buf = h.buf[:end+4]
+	return rest, true, nil
+}
+
+// response parses the collected head as an http response
+func (h *httpHead) response() (*http.Response, error) {
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(h.buf)), nil)
+}
+
+// request parses the collected head as an http request
+func (h *httpHead) request() (*http.Request, error) {
+	return http.ReadRequest(bufio.NewReader(bytes.NewReader(h.buf)))
 }
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// wsFrame encodes a single websocket frame, masked like a client would
+func wsFrame(fin bool, opcode byte, mask bool, payload []byte) []byte {
+	var frame []byte
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame = append(frame, first)
+
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if !mask {
+		return append(frame, payload...)
+	}
+	key := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, key...)
+	for i, b := range payload {
+		frame = append(frame, b^key[i%4])
+	}
+	return frame
+}
+
+func TestWSDecoderSplitFrame(t *testing.T) {
+	d := &wsDecoder{}
+	frame := wsFrame(true, wsOpBinary, true, []byte("\x00ls -la\r"))
+
+	// feeding the frame byte by byte
+	var messages []wsMessage
+	for i := range frame {
+		got, err := d.feed(frame[i : i+1])
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if i < len(frame)-1 && len(got) != 0 {
+			t.Fatalf("got a message before the frame was complete")
+		}
+		messages = append(messages, got...)
+	}
+	if len(messages) != 1 || string(messages[0].Payload) != "\x00ls -la\r" {
+		t.Fatalf("unexpected messages: %q", messages)
+	}
+}
+
+func TestWSDecoderCoalescedFrames(t *testing.T) {
+	d := &wsDecoder{}
+	var stream []byte
+	stream = append(stream, wsFrame(true, wsOpBinary, true, []byte("\x00l"))...)
+	stream = append(stream, wsFrame(true, wsOpBinary, true, []byte("\x00s"))...)
+	stream = append(stream, wsFrame(true, wsOpBinary, true, []byte("\x00\r"))...)
+
+	messages, err := d.feed(stream)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != 3 || string(messages[1].Payload) != "\x00s" {
+		t.Fatalf("unexpected messages: %q", messages)
+	}
+}
+
+func TestWSDecoderFragmentedWithControlFrame(t *testing.T) {
+	d := &wsDecoder{}
+	var stream []byte
+	stream = append(stream, wsFrame(false, wsOpBinary, true, []byte("\x00echo "))...)
+	// control frames may come in between fragments
+	stream = append(stream, wsFrame(true, wsOpPing, true, []byte("ping"))...)
+	stream = append(stream, wsFrame(false, wsOpContinuation, true, []byte("hello "))...)
+	stream = append(stream, wsFrame(true, wsOpContinuation, true, []byte("world\r"))...)
+
+	messages, err := d.feed(stream)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("got %d messages, want 2: %q", len(messages), messages)
+	}
+	if messages[0].Opcode != wsOpPing || string(messages[0].Payload) != "ping" {
+		t.Fatalf("unexpected control message: %q", messages[0])
+	}
+	if messages[1].Opcode != wsOpBinary || string(messages[1].Payload) != "\x00echo hello world\r" {
+		t.Fatalf("unexpected data message: %q", messages[1])
+	}
+}
+
+func TestWSDecoderExtendedLengths(t *testing.T) {
+	for _, size := range []int{125, 126, 0xFFFF, 0x10000} {
+		d := &wsDecoder{}
+		payload := bytes.Repeat([]byte("a"), size)
+		frame := wsFrame(true, wsOpBinary, false, payload)
+
+		// split in the middle of the payload, like a short read would
+		messages, err := d.feed(frame[:len(frame)/2])
+		if err != nil || len(messages) != 0 {
+			t.Fatalf("size %d: unexpected result %d messages, %v", size, len(messages), err)
+		}
+		messages, err = d.feed(frame[len(frame)/2:])
+		if err != nil {
+			t.Fatalf("size %d: unexpected error: %v", size, err)
+		}
+		if len(messages) != 1 || !bytes.Equal(messages[0].Payload, payload) {
+			t.Fatalf("size %d: payload was not reassembled", size)
+		}
+	}
+}
+
+func TestWSDecoderSkipsOversizedFrames(t *testing.T) {
+	d := &wsDecoder{skipOversized: true}
+	big := wsFrame(true, wsOpBinary, false, bytes.Repeat([]byte("a"), maxWSMessageSize+1))
+	next := wsFrame(true, wsOpBinary, false, []byte("\x01after"))
+
+	var messages []wsMessage
+	stream := append(big, next...)
+	for len(stream) > 0 {
+		chunk := stream[:min(len(stream), 32*1024)]
+		stream = stream[len(chunk):]
+		got, err := d.feed(chunk)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		messages = append(messages, got...)
+	}
+	if len(messages) != 1 || string(messages[0].Payload) != "\x01after" {
+		t.Fatalf("expected only the frame after the oversized one, got %d messages", len(messages))
+	}
+	if len(d.buf) > 32*1024 {
+		t.Fatalf("decoder held on to %d bytes", len(d.buf))
+	}
+}
+
+func TestWSDecoderRefusesOversizedFrames(t *testing.T) {
+	d := &wsDecoder{}
+	big := wsFrame(true, wsOpBinary, true, bytes.Repeat([]byte("a"), maxWSMessageSize+1))
+	if _, err := d.feed(big[:32*1024]); err == nil {
+		t.Fatal("expected error for an oversized frame")
+	}
+
+	// the same limit applies to a message split into fragments
+	d = &wsDecoder{}
+	half := bytes.Repeat([]byte("a"), maxWSMessageSize/2+1)
+	stream := wsFrame(false, wsOpBinary, true, half)
+	stream = append(stream, wsFrame(true, wsOpContinuation, true, half)...)
+	if _, err := d.feed(stream); err == nil {
+		t.Fatal("expected error for an oversized fragmented message")
+	}
+}
+
+func TestWSDecoderInvalidStream(t *testing.T) {
+	d := &wsDecoder{}
+	if _, err := d.feed(wsFrame(true, wsOpContinuation, true, []byte("orphan"))); err == nil {
+		t.Fatal("expected error for continuation without a fragmented message")
+	}
+}
+
+func TestHTTPHead(t *testing.T) {
+	h := &httpHead{}
+	frame := wsFrame(true, wsOpBinary, false, []byte("\x01hi"))
+	head := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nSec-Websocket-Protocol: v5.channel.k8s.io\r\n\r\n"
+
+	rest, done, err := h.feed([]byte(head[:20]))
+	if err != nil || done || len(rest) != 0 {
+		t.Fatalf("unexpected result for partial head: %q %v %v", rest, done, err)
+	}
+	rest, done, err = h.feed(append([]byte(head[20:]), frame...))
+	if err != nil || !done || !bytes.Equal(rest, frame) {
+		t.Fatalf("unexpected result for complete head: %q %v %v", rest, done, err)
+	}
+	resp, err := h.response()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.StatusCode != 101 || resp.Header.Get("Sec-WebSocket-Protocol") != "v5.channel.k8s.io" {
+		t.Fatalf("unexpected response: %d %v", resp.StatusCode, resp.Header)
+	}
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	policyAllow     = "allow"
+	policyWarn      = "warn"
+	policyTerminate = "terminate"
+)
+
+// policy is a list of rules evaluated against each command, the first
+// matching rule decides, commands matching no rule are allowed
+type policy struct {
+	Rules []*policyRule `json:"rules"`
+}
+
+// policyRule matches commands, empty fields match everything
+type policyRule struct {
+	Name        string                `json:"name"`
+	Users       []string              `json:"users,omitempty"`
+	Groups      []string              `json:"groups,omitempty"`
+	Namespaces  []string              `json:"namespaces,omitempty"`
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+	Command     string                `json:"command,omitempty"`
+	Action      string                `json:"action"`
+	// shown to the user when the rule warns or terminates
+	Message string `json:"message,omitempty"`
+
+	command  *regexp.Regexp
+	selector labels.Selector
+}
+
+var activePolicy *policy
+
+// errPolicyDenied ends a session once a command it ran was terminated
+var errPolicyDenied = errors.New("command denied by policy")
+var policySync sync.RWMutex
+
+// parsePolicy reads a policy file and compiles its rules
+func parsePolicy(raw []byte) (*policy, error) {
+	p := &policy{}
+	err := yaml.UnmarshalStrict(raw, p)
+	if err != nil {
+		return nil, err
+	}
+	for i, rule := range p.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		switch rule.Action {
+		case policyAllow, policyWarn, policyTerminate:
+		default:
+			return nil, fmt.Errorf("rule %s has unknown action %q", rule.Name, rule.Action)
+		}
+		if rule.Command != "" {
+			rule.command, err = regexp.Compile(rule.Command)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s has invalid command pattern: %w", rule.Name, err)
+			}
+		}
+		if rule.PodSelector != nil {
+			rule.selector, err = metav1.LabelSelectorAsSelector(rule.PodSelector)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s has invalid pod selector: %w", rule.Name, err)
+			}
+		}
+	}
+	return p, nil
+}
+
+// applyPolicy parses the policy file and puts it in effect
+func applyPolicy(raw []byte) error {
+	p, err := parsePolicy(raw)
+	if err != nil {
+		return err
+	}
+	policySync.Lock()
+	activePolicy = p
+	policySync.Unlock()
+	return nil
+}
+
+// currentPolicy returns the policy in effect, nil if there is none
+func currentPolicy() *policy {
+	policySync.RLock()
+	defer policySync.RUnlock()
+	return activePolicy
+}
+
+// needsPodLabels tells whether any rule selects on pod labels
+func (p *policy) needsPodLabels() bool {
+	for _, rule := range p.Rules {
+		if rule.selector != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate returns the first rule matching the command, or nil, the
+// labels of the pod are fetched once a rule selecting on them is
+// reached, so rules added by a reload apply to running sessions too
+func (p *policy) evaluate(ctx context.Context, sess *session, command string) (*policyRule, error) {
+	for _, rule := range p.Rules {
+		if rule.selector != nil {
+			if err := sess.loadPodLabels(ctx); err != nil {
+				return nil, err
+			}
+		}
+		if rule.matches(sess, command) {
+			return rule, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *policyRule) matches(sess *session, command string) bool {
+	if len(r.Users) > 0 && !slices.Contains(r.Users, sess.user) {
+		return false
+	}
+	if len(r.Groups) > 0 && !slices.ContainsFunc(sess.groups, func(group string) bool {
+		return slices.Contains(r.Groups, group)
+	}) {
+		return false
+	}
+	if len(r.Namespaces) > 0 && !slices.Contains(r.Namespaces, sess.namespace) {
+		return false
+	}
+	if r.selector != nil && !r.selector.Matches(labels.Set(sess.podLabels)) {
+		return false
+	}
+	if r.command != nil && !r.command.MatchString(command) {
+		return false
+	}
+	return true
+}
+
+// loadPodLabels fetches the labels of the pod of a session unless
+// it already has them
+func (s *session) loadPodLabels(ctx context.Context) error {
+	if s.podLabels != nil {
+		return nil
+	}
+	podLabels, err := fetchPodLabels(ctx, s.namespace, s.pod)
+	if err != nil {
+		// without the labels the rules cannot be evaluated,
+		// guessing could let through what should be denied
+		SysLogger.Error().Err(err).Msgf("failed to fetch labels of %s/%s", s.namespace, s.pod)
+		return fmt.Errorf("could not check the command policy of pod %s/%s", s.namespace, s.pod)
+	}
+	if podLabels == nil {
+		podLabels = map[string]string{}
+	}
+	s.podLabels = podLabels
+	return nil
+}
+
+// fetchPodLabels looks up the labels of the pod a session targets
+func fetchPodLabels(ctx context.Context, namespace, pod string) (map[string]string, error) {
+	meta := metav1.PartialObjectMetadata{}
+	err := kubeRequest(ctx, http.MethodGet, fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", namespace, pod), nil, &meta)
+	if err != nil {
+		return nil, err
+	}
+	return meta.Labels, nil
+}
+
+// enforcePolicy evaluates a command of a session and acts on the
+// matching rule, it returns false if the session has to go, a hidden
+// command was typed with echo off and is not shown in the audit
+func enforcePolicy(sess *session, command string, hidden bool) bool {
+	p := currentPolicy()
+	if p == nil {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rule, err := p.evaluate(ctx, sess, command)
+	if err != nil {
+		// break-glass sessions are only audited
+		if sess.breakGlass {
+			return true
+		}
+		sess.terminate(fmt.Sprintf("rexec terminated the session: %s", err), "policy check failed")
+		return false
+	}
+	if rule == nil || rule.Action == policyAllow {
+		return true
+	}
+
+	shown := redacted
+	if !hidden {
+		shown = redact(command)
+	}
+	sess.logger.Warn().
+		Str("event", "policy").
+		Str("rule", rule.Name).
+		Str("action", rule.Action).
+		Str("command", shown).
+		Bool("enforced", !sess.breakGlass).
+		Msg("")
+	// break-glass sessions are only audited
+	if sess.breakGlass {
+		return true
+	}
+
+	message := rule.Message
+	if message == "" {
+		message = fmt.Sprintf("command matched policy rule %s", rule.Name)
+	}
+	if rule.Action == policyWarn {
+		sess.notify(fmt.Sprintf("rexec warning: %s", message))
+		return true
+	}
+	sess.terminate(fmt.Sprintf("rexec terminated the session: %s", message), fmt.Sprintf("policy rule %s", rule.Name))
+	return false
+}
+
+// admitSession checks the initial command before the exec is proxied,
+// a session the policy terminates is refused right away
+func admitSession(ctx context.Context, sess *session) error {
+	p := currentPolicy()
+	if p == nil {
+		return nil
+	}
+	if p.needsPodLabels() {
+		if err := sess.loadPodLabels(ctx); err != nil {
+			return err
+		}
+	}
+	if !enforcePolicy(sess, strings.Join(sess.command, " "), false) {
+		return errPolicyDenied
+	}
+	return nil
+}
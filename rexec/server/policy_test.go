@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var testPolicy = `
+rules:
+- name: admins
+  groups: [admins]
+  action: allow
+- name: no-shutdown
+  command: '^(shutdown|reboot)\b'
+  action: terminate
+  message: rebooting is not allowed
+- name: prod-db
+  namespaces: [prod]
+  podSelector:
+    matchLabels:
+      app: db
+  command: '^psql\b'
+  action: warn
+`
+
+func setPolicy(t *testing.T, raw string) {
+	p, err := parsePolicy([]byte(raw))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	oldPolicy := activePolicy
+	t.Cleanup(func() { activePolicy = oldPolicy })
+	activePolicy = p
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	for _, raw := range []string{
+		"rules:\n- action: block\n",
+		"rules:\n- action: warn\n  command: '('\n",
+		"rules:\n- action: warn\n  podSelector:\n    matchExpressions:\n    - {key: app, operator: Bad}\n",
+		"rules:\n- action: warn\n  unknown: field\n",
+	} {
+		if _, err := parsePolicy([]byte(raw)); err == nil {
+			t.Fatalf("expected error for %q", raw)
+		}
+	}
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	setPolicy(t, testPolicy)
+	p := currentPolicy()
+
+	admin := &session{user: "alice", groups: []string{"admins"}}
+	dev := &session{user: "bob", groups: []string{"devs"}, namespace: "prod", podLabels: map[string]string{"app": "db"}}
+	other := &session{user: "bob", groups: []string{"devs"}, namespace: "prod", podLabels: map[string]string{"app": "web"}}
+
+	for _, tc := range []struct {
+		sess    *session
+		command string
+		want    string
+	}{
+		{admin, "reboot", "admins"},
+		{dev, "reboot now", "no-shutdown"},
+		{dev, "psql -U postgres", "prod-db"},
+		{other, "psql -U postgres", ""},
+		{dev, "ls", ""},
+	} {
+		rule, _ := p.evaluate(context.Background(), tc.sess, tc.command)
+		got := ""
+		if rule != nil {
+			got = rule.Name
+		}
+		if got != tc.want {
+			t.Errorf("%s running %q matched %q, want %q", tc.sess.user, tc.command, got, tc.want)
+		}
+	}
+}
+
+// negotiatedLogger returns a TCPLogger past the websocket upgrade, with
+// the user side of the connection to read what rexec sends there
+func negotiatedLogger(t *testing.T, sess *session) (*TCPLogger, net.Conn) {
+	client, user := net.Pipe()
+	upstream, _ := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		user.Close()
+		upstream.Close()
+	})
+	tl := &TCPLogger{Conn: upstream, ctxid: sess.id, session: sess, client: client}
+	tl.inspectOutput([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nSec-WebSocket-Protocol: v5.channel.k8s.io\r\n\r\n"))
+	tl.atBoundary = tl.outputBoundary()
+	sess.attach(tl)
+	return tl, user
+}
+
+func TestEnforcePolicyWarns(t *testing.T) {
+	setPolicy(t, testPolicy)
+	var buf bytes.Buffer
+	sess := &session{id: "test", user: "bob", namespace: "prod", tty: true, podLabels: map[string]string{"app": "db"}, logger: zerolog.New(&buf)}
+	_, user := negotiatedLogger(t, sess)
+
+	go enforcePolicy(sess, "psql -U postgres", false)
+	frame := make([]byte, 256)
+	n, err := user.Read(frame)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	messages, err := (&wsDecoder{}).feed(frame[:n])
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("unexpected messages: %q %v", messages, err)
+	}
+	if messages[0].Payload[0] != streamStdout || !strings.Contains(string(messages[0].Payload), "rexec warning: command matched policy rule prod-db") {
+		t.Fatalf("unexpected warning: %q", messages[0].Payload)
+	}
+	if !strings.Contains(buf.String(), `"event":"policy","rule":"prod-db","action":"warn"`) {
+		t.Fatalf("policy event missing: %s", buf.String())
+	}
+}
+
+func TestEnforcePolicyTerminates(t *testing.T) {
+	setPolicy(t, testPolicy)
+	sess := &session{id: "test", user: "bob", stderr: true, logger: zerolog.Nop()}
+	_, user := negotiatedLogger(t, sess)
+
+	done := make(chan bool)
+	go func() { done <- enforcePolicy(sess, "shutdown -h now", false) }()
+	raw, _ := io.ReadAll(user)
+	if <-done {
+		t.Fatal("session was not terminated")
+	}
+	messages, err := (&wsDecoder{}).feed(raw)
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("unexpected messages: %q %v", messages, err)
+	}
+	if messages[0].Payload[0] != streamStderr || !strings.Contains(string(messages[0].Payload), "rebooting is not allowed") {
+		t.Fatalf("unexpected message: %q", messages[0].Payload)
+	}
+	if messages[1].Opcode != wsOpClose {
+		t.Fatalf("expected a close frame, got opcode %d", messages[1].Opcode)
+	}
+	if sess.closeReason != "policy rule no-shutdown" {
+		t.Fatalf("unexpected close reason %q", sess.closeReason)
+	}
+}
+
+func TestAdmitSession(t *testing.T) {
+	// no pod selectors, so no labels are fetched
+	setPolicy(t, "rules:\n- command: '^reboot'\n  action: terminate\n")
+	var buf bytes.Buffer
+	sess := &session{id: "test", user: "bob", command: []string{"reboot"}, logger: zerolog.New(&buf)}
+	if err := admitSession(context.Background(), sess); err != errPolicyDenied {
+		t.Fatalf("session running reboot was admitted: %v", err)
+	}
+	sess = &session{id: "test", user: "bob", command: []string{"bash"}, logger: zerolog.New(&buf)}
+	if err := admitSession(context.Background(), sess); err != nil {
+		t.Fatalf("session running bash was not admitted: %v", err)
+	}
+
+	// rules on pod labels cannot be checked without them
+	setPolicy(t, "rules:\n- podSelector:\n    matchLabels:\n      app: db\n  action: terminate\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := admitSession(ctx, sess); err == nil || err == errPolicyDenied {
+		t.Fatalf("session was admitted without the pod labels: %v", err)
+	}
+}
+
+func TestWriteDropsTerminatedCommand(t *testing.T) {
+	setPolicy(t, testPolicy)
+	setEditors(t)
+	var buf bytes.Buffer
+	sess := &session{id: "test", user: "bob", namespace: "prod", tty: true, logger: zerolog.New(&buf)}
+	tl, user := negotiatedLogger(t, sess)
+	upstream, pod := net.Pipe()
+	t.Cleanup(func() { upstream.Close(); pod.Close() })
+	tl.Conn = upstream
+	tl.inspectInput([]byte("GET /exec HTTP/1.1\r\nHost: kube\r\n\r\n"))
+
+	// whatever reaches the pod is collected until the connection closes
+	forwarded := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(pod)
+		forwarded <- data
+	}()
+	go io.Copy(io.Discard, user)
+
+	if n, err := tl.Write(wsFrame(true, wsOpBinary, true, []byte("\x00reboot\r"))); n != 0 || err != errPolicyDenied {
+		t.Fatalf("terminated command went through: %d %v", n, err)
+	}
+	if data := <-forwarded; len(data) != 0 {
+		t.Fatalf("the pod got %q", data)
+	}
+	if sess.closeReason != "policy rule no-shutdown" {
+		t.Fatalf("unexpected close reason %q", sess.closeReason)
+	}
+}
+
+func TestEnforcePolicyOnHiddenInput(t *testing.T) {
+	setPolicy(t, testPolicy)
+	setEditors(t)
+	var buf bytes.Buffer
+	sess := &session{id: "test", user: "bob", namespace: "prod", tty: true, logger: zerolog.New(&buf)}
+	tl, user := negotiatedLogger(t, sess)
+	go io.Copy(io.Discard, user)
+
+	// a prompt looking like a password prompt hides what is typed
+	// from the audit, but not from the policy
+	tl.echo.output([]byte("Password: "))
+	tl.handleStdin([]byte("reboot\r"))
+	if !tl.policyDenied.Load() || sess.closeReason != "policy rule no-shutdown" {
+		t.Fatalf("hidden command was not checked: %q", sess.closeReason)
+	}
+	if strings.Contains(buf.String(), "reboot") || !strings.Contains(buf.String(), `"event":"policy","rule":"no-shutdown","action":"terminate","command":"[REDACTED]"`) {
+		t.Fatalf("unexpected audit: %s", buf.String())
+	}
+}
+
+func TestTerminateDoesNotHoldUpOtherSessions(t *testing.T) {
+	setPolicy(t, testPolicy)
+	setEditors(t)
+	// nobody reads from the client, so telling it about the
+	// termination blocks
+	events, log := io.Pipe()
+	t.Cleanup(func() { events.Close() })
+	stuck := &session{id: "stuck", user: "bob", namespace: "prod", tty: true, logger: zerolog.New(log)}
+	negotiatedLogger(t, stuck)
+	go storeOrFlush(keystrokes{ctxid: "stuck", session: stuck, ascii: []byte("reboot\r")})
+	scanner := bufio.NewScanner(events)
+	for scanner.Scan() && !strings.Contains(scanner.Text(), `"event":"policy"`) {
+	}
+	go io.Copy(io.Discard, events)
+
+	other := &session{id: "other", user: "bob", namespace: "prod", tty: true, podLabels: map[string]string{"app": "web"}, logger: zerolog.New(io.Discard)}
+	done := make(chan bool)
+	go func() { done <- storeOrFlush(keystrokes{ctxid: "other", session: other, ascii: []byte("id\r")}) }()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal("unexpected termination")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a stuck session held up the audit of another one")
+	}
+}
+
+func TestEnforcePolicyReloadedSelector(t *testing.T) {
+	setPolicy(t, "rules:\n- command: '^reboot'\n  action: terminate\n")
+	var buf bytes.Buffer
+	sess := &session{id: "test", user: "bob", namespace: "prod", tty: true, logger: zerolog.New(&buf)}
+	_, user := negotiatedLogger(t, sess)
+	go io.Copy(io.Discard, user)
+	if !enforcePolicy(sess, "psql", false) {
+		t.Fatal("session was terminated")
+	}
+
+	// a rule on pod labels added while the session runs needs the
+	// labels, which can not be fetched here
+	setPolicy(t, "rules:\n- podSelector:\n    matchLabels:\n      app: db\n  command: '^psql'\n  action: terminate\n")
+	if enforcePolicy(sess, "psql", false) || sess.closeReason != "policy check failed" {
+		t.Fatalf("command was not checked against the new rule: %q", sess.closeReason)
+	}
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+// errPortForwardProtocol refuses port-forwards rexec can not follow,
+// only spdy is decoded so anything else would go by unaudited
+var errPortForwardProtocol = errors.New("port-forwards through rexec have to use spdy")
+
+// admitPortForward refuses port-forwards not upgrading to spdy
+// before they reach the kube apiserver
+func admitPortForward(sess *session, header http.Header) error {
+	if sess.forwards == nil || isSPDYUpgrade(header) {
+		return nil
+	}
+	sess.logger.Warn().Str("event", "exec_denied").Str("reason", errPortForwardProtocol.Error()).Msg("")
+	return errPortForwardProtocol
+}
+
+// forwardedPort sums up the connections made to a port of the pod
+type forwardedPort struct {
+	connections int
+	// bytes sent by the user toward the pod and back
+	bytesIn  int64
+	bytesOut int64
+	// how long the connections were open, added up
+	open time.Duration
+}
+
+// forwardedConn is a connection to a port, carried by a data stream
+type forwardedConn struct {
+	port  string
+	start time.Time
+	// the connection is over once both sides are done
+	closedIn  bool
+	closedOut bool
+}
+
+// portForwards follows the connections of a port-forward session,
+// both directions of the connection update it
+type portForwards struct {
+	mu      sync.Mutex
+	ports   map[string]*forwardedPort
+	streams map[spdy.StreamId]*forwardedConn
+}
+
+func newPortForwards() *portForwards {
+	return &portForwards{ports: map[string]*forwardedPort{}, streams: map[spdy.StreamId]*forwardedConn{}}
+}
+
+// open notes a new connection, every one comes with a data stream
+func (p *portForwards) open(id spdy.StreamId, port string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	forwarded, ok := p.ports[port]
+	if !ok {
+		forwarded = &forwardedPort{}
+		p.ports[port] = forwarded
+	}
+	forwarded.connections++
+	p.streams[id] = &forwardedConn{port: port, start: now}
+}
+
+// count adds bytes which went through a connection
+func (p *portForwards) count(id spdy.StreamId, input bool, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn, ok := p.streams[id]
+	if !ok {
+		return
+	}
+	if input {
+		p.ports[conn.port].bytesIn += int64(n)
+	} else {
+		p.ports[conn.port].bytesOut += int64(n)
+	}
+}
+
+// finish notes that one side of a connection is done, reset ends
+// the connection for both
+func (p *portForwards) finish(id spdy.StreamId, input, reset bool, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn, ok := p.streams[id]
+	if !ok {
+		return
+	}
+	if input || reset {
+		conn.closedIn = true
+	}
+	if !input || reset {
+		conn.closedOut = true
+	}
+	if conn.closedIn && conn.closedOut {
+		p.ports[conn.port].open += now.Sub(conn.start)
+		delete(p.streams, id)
+	}
+}
+
+// log emits a port_forward event for every port used, connections
+// still open count until now
+func (p *portForwards) log(s *session, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.streams {
+		p.ports[conn.port].open += now.Sub(conn.start)
+	}
+	p.streams = map[spdy.StreamId]*forwardedConn{}
+
+	ports := make([]string, 0, len(p.ports))
+	for port := range p.ports {
+		ports = append(ports, port)
+	}
+	slices.Sort(ports)
+	for _, port := range ports {
+		forwarded := p.ports[port]
+		s.logger.Info().
+			Str("event", "port_forward").
+			Str("port", port).
+			Int("connections", forwarded.connections).
+			Int64("bytes_in", forwarded.bytesIn).
+			Int64("bytes_out", forwarded.bytesOut).
+			Int64("duration_ms", forwarded.open.Milliseconds()).
+			Msg("")
+	}
+}
+
+// portForwardDecoder follows one direction of a spdy port-forward, only
+// control frames are parsed, data frames are counted as they pass so
+// the connections are not held in memory
+type portForwardDecoder struct {
+	buf      []byte
+	frames   bytes.Buffer
+	framer   *spdy.Framer
+	forwards *portForwards
+	input    bool
+	// bytes left of the data frame passing, its stream and
+	// whether the frame closes the stream
+	skip       int
+	skipStream spdy.StreamId
+	skipFin    bool
+}
+
+func newPortForwardDecoder(forwards *portForwards, input bool) (*portForwardDecoder, error) {
+	d := &portForwardDecoder{forwards: forwards, input: input}
+	framer, err := spdy.NewFramer(io.Discard, &d.frames)
+	if err != nil {
+		return nil, err
+	}
+	d.framer = framer
+	return d, nil
+}
+
+// feed takes the next chunk of the stream, an error means the stream
+// is not spdy anymore
+func (d *portForwardDecoder) feed(data []byte) error {
+	d.buf = append(d.buf, data...)
+	consumed := 0
+	for consumed < len(d.buf) {
+		rest := d.buf[consumed:]
+
+		if d.skip > 0 {
+			n := min(d.skip, len(rest))
+			d.forwards.count(d.skipStream, d.input, n)
+			d.skip -= n
+			consumed += n
+			if d.skip == 0 {
+				d.endDataFrame()
+			}
+			continue
+		}
+
+		if len(rest) < spdyHeaderLen {
+			break
+		}
+		length := int(binary.BigEndian.Uint32(rest[4:8]) & 0xFFFFFF)
+		if rest[0]&0x80 == 0 {
+			// a data frame, the first 4 bytes are the stream id
+			d.skipStream = spdy.StreamId(binary.BigEndian.Uint32(rest[0:4]) & 0x7FFFFFFF)
+			d.skipFin = rest[4]&byte(spdy.DataFlagFin) != 0
+			d.skip = length
+			consumed += spdyHeaderLen
+			if d.skip == 0 {
+				d.endDataFrame()
+			}
+			continue
+		}
+
+		if length > maxWSMessageSize {
+			d.buf = nil
+			return fmt.Errorf("spdy control frame of %d bytes", length)
+		}
+		if len(rest) < spdyHeaderLen+length {
+			break
+		}
+		d.frames.Write(rest[:spdyHeaderLen+length])
+		consumed += spdyHeaderLen + length
+		frame, err := d.framer.ReadFrame()
+		if err != nil {
+			d.buf = nil
+			return err
+		}
+		d.route(frame)
+	}
+
+	// keeping only what was not consumed yet
+	d.buf = append(d.buf[:0], d.buf[consumed:]...)
+	return nil
+}
+
+// endDataFrame runs once a data frame passed
+func (d *portForwardDecoder) endDataFrame() {
+	if d.skipFin {
+		d.forwards.finish(d.skipStream, d.input, false, time.Now())
+	}
+}
+
+// route follows the streams the client opens, each connection to a
+// port comes with an error and a data stream
+func (d *portForwardDecoder) route(frame spdy.Frame) {
+	switch frame := frame.(type) {
+	case *spdy.SynStreamFrame:
+		if frame.Headers.Get("streamType") == "data" {
+			d.forwards.open(frame.StreamId, frame.Headers.Get("port"), time.Now())
+		}
+	case *spdy.RstStreamFrame:
+		d.forwards.finish(frame.StreamId, d.input, true, time.Now())
+	}
+}
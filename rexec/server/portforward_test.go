@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moby/spdystream/spdy"
+	"github.com/rs/zerolog"
+)
+
+func TestTCPLoggerPortForward(t *testing.T) {
+	var buf bytes.Buffer
+	sess := &session{id: "test", subresource: "portforward", forwards: newPortForwards(), logger: zerolog.New(&buf)}
+	tl := &TCPLogger{ctxid: "test", session: sess}
+	tl.watchTransfers()
+
+	// two connections to 5432 and one to 8080, as kubectl opens them
+	var client, server bytes.Buffer
+	clientFramer, _ := spdy.NewFramer(&client, nil)
+	serverFramer, _ := spdy.NewFramer(&server, nil)
+	for i, port := range []string{"5432", "5432", "8080"} {
+		for j, streamType := range []string{"error", "data"} {
+			clientFramer.WriteFrame(&spdy.SynStreamFrame{
+				StreamId: spdy.StreamId(4*i + 2*j + 1),
+				Headers:  http.Header{"Streamtype": {streamType}, "Port": {port}},
+			})
+		}
+	}
+	clientFramer.WriteFrame(&spdy.DataFrame{StreamId: 3, Data: []byte("select 1;")})
+	clientFramer.WriteFrame(&spdy.DataFrame{StreamId: 3, Flags: spdy.DataFlagFin})
+	clientFramer.WriteFrame(&spdy.DataFrame{StreamId: 7, Data: []byte("select 2;"), Flags: spdy.DataFlagFin})
+	clientFramer.WriteFrame(&spdy.DataFrame{StreamId: 11, Data: []byte("GET / HTTP/1.1\r\n\r\n")})
+	serverFramer.WriteFrame(&spdy.DataFrame{StreamId: 3, Data: []byte("1"), Flags: spdy.DataFlagFin})
+	serverFramer.WriteFrame(&spdy.DataFrame{StreamId: 7, Data: bytes.Repeat([]byte("x"), 100)})
+	serverFramer.WriteFrame(&spdy.RstStreamFrame{StreamId: 7, Status: spdy.Cancel})
+
+	tl.inspectInput([]byte("POST /portforward HTTP/1.1\r\nHost: kube\r\nUpgrade: SPDY/3.1\r\nConnection: Upgrade\r\n\r\n"))
+	// feeding byte by byte as frames can be split by reads
+	for _, b := range client.Bytes() {
+		tl.inspectInput([]byte{b})
+	}
+	tl.inspectOutput([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: SPDY/3.1\r\nConnection: Upgrade\r\n\r\n"))
+	tl.inspectOutput(server.Bytes())
+	if tl.uninspectable.Load() || tl.outputPassthrough || tl.upload != nil {
+		t.Fatal("port-forward was not followed")
+	}
+	if len(sess.forwards.streams) != 1 {
+		t.Fatalf("got %d open connections, want 1", len(sess.forwards.streams))
+	}
+
+	sess.forwards.log(sess, time.Now())
+	for _, want := range []string{
+		`"event":"port_forward","port":"5432","connections":2,"bytes_in":18,"bytes_out":101,`,
+		`"event":"port_forward","port":"8080","connections":1,"bytes_in":18,"bytes_out":0,`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %s in %s", want, buf.String())
+		}
+	}
+}
+
+func TestTCPLoggerRefusesWebsocketPortForward(t *testing.T) {
+	var buf bytes.Buffer
+	sess := &session{id: "test", subresource: "portforward", forwards: newPortForwards(), logger: zerolog.New(&buf)}
+	client, _ := net.Pipe()
+	upstream, _ := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		upstream.Close()
+	})
+	tl := &TCPLogger{Conn: upstream, ctxid: "test", session: sess, client: client}
+
+	request := []byte("GET /portforward HTTP/1.1\r\nHost: kube\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Protocol: v4.channel.k8s.io\r\n\r\n")
+	if n, err := tl.Write(request); n != 0 || err != errUninspectable {
+		t.Fatalf("websocket port-forward went through: %d %v", n, err)
+	}
+	if !strings.Contains(buf.String(), `"event":"inspection_failed","direction":"input"`) {
+		t.Fatalf("refusal was not logged: %s", buf.String())
+	}
+}
+
+func TestAdmitPortForward(t *testing.T) {
+	var buf bytes.Buffer
+	sess := &session{id: "test", subresource: "portforward", forwards: newPortForwards(), logger: zerolog.New(&buf)}
+	if err := admitPortForward(sess, http.Header{"Upgrade": {"SPDY/3.1"}}); err != nil {
+		t.Fatalf("spdy port-forward was refused: %v", err)
+	}
+	if err := admitPortForward(sess, http.Header{"Upgrade": {"websocket"}}); err != errPortForwardProtocol {
+		t.Fatalf("websocket port-forward was not refused: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"event":"exec_denied"`) {
+		t.Fatalf("refusal was not logged: %s", buf.String())
+	}
+	exec := &session{id: "test", subresource: "exec", logger: zerolog.New(&buf)}
+	if err := admitPortForward(exec, http.Header{"Upgrade": {"websocket"}}); err != nil {
+		t.Fatalf("exec was refused: %v", err)
+	}
+}
+
+func TestPortForwardsDuration(t *testing.T) {
+	var buf bytes.Buffer
+	sess := &session{id: "test", logger: zerolog.New(&buf)}
+	forwards := newPortForwards()
+	start := time.Now()
+	forwards.open(1, "8080", start)
+	forwards.finish(1, true, false, start.Add(time.Second))
+	forwards.finish(1, false, false, start.Add(2*time.Second))
+	forwards.open(3, "8080", start)
+	forwards.log(sess, start.Add(3*time.Second))
+	if !strings.Contains(buf.String(), `"connections":2,"bytes_in":0,"bytes_out":0,"duration_ms":5000`) {
+		t.Fatalf("unexpected event: %s", buf.String())
+	}
+}
+
+func TestCheckExecRulesPortForward(t *testing.T) {
+	setExecRules(t, "rules:\n- users: [bob]\n  allowPortForward: false\n- users: [carol]\n  allowExec: false\n  commands: [[ps]]\n")
+	for user, allowed := range map[string]bool{"bob": false, "carol": true, "dave": true} {
+		err := checkExecRules(t.Context(), execRequest{user: user, namespace: "dev", portForward: true})
+		if (err == nil) != allowed {
+			t.Errorf("%s: got error %v, want allowed=%v", user, err, allowed)
+		}
+	}
+}
+
+func TestExecHandlerPortForward(t *testing.T) {
+	oldSauce := SecretSauce
+	oldDeny := DenyNativePortForward
+	t.Cleanup(func() {
+		SecretSauce = oldSauce
+		DenyNativePortForward = oldDeny
+	})
+	SecretSauce = "the-right-sauce"
+
+	DenyNativePortForward = false
+	_, parsed := postExecHandler(t, makeAdmissionReview("PodPortForwardOptions", "lauren", nil), "application/json")
+	if parsed.Response == nil || !parsed.Response.Allowed {
+		t.Fatalf("expected Allowed=true without --deny-native-port-forward, got: %+v", parsed.Response)
+	}
+
+	DenyNativePortForward = true
+	_, parsed = postExecHandler(t, makeAdmissionReview("PodPortForwardOptions", "lauren", nil), "application/json")
+	if parsed.Response == nil || parsed.Response.Allowed {
+		t.Fatalf("expected Allowed=false, got: %+v", parsed.Response)
+	}
+	_, parsed = postExecHandler(t, makeAdmissionReview("PodPortForwardOptions", "lauren", map[string][]string{
+		"secret-sauce": {"the-right-sauce"},
+	}), "application/json")
+	if parsed.Response == nil || !parsed.Response.Allowed {
+		t.Fatalf("expected Allowed=true through rexec, got: %+v", parsed.Response)
+	}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// castHeader is the first line of an asciinema v2 recording
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// castRecorder writes both directions of a tty session
+// into an asciinema v2 compatible cast file
+type castRecorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	start   time.Time
+	header  castHeader
+	started bool
+	// bytes of multibyte characters split between two frames
+	// are held back per event type until they are complete
+	pending map[string][]byte
+}
+
+// newCastRecorder creates the cast file for a session under RecordingDir
+func newCastRecorder(namespace, ctxid, title, command string) (*castRecorder, error) {
+	dir := filepath.Join(RecordingDir, namespace)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%s.cast", ctxid)), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &castRecorder{
+		file:  file,
+		start: now,
+		header: castHeader{
+			Version: 2,
+			// kubectl sends the real size right after the upgrade,
+			// this is just a sane default until then
+			Width:     80,
+			Height:    24,
+			Timestamp: now.Unix(),
+			Command:   command,
+			Title:     title,
+			Env:       map[string]string{"TERM": "xterm"},
+		},
+		pending: make(map[string][]byte),
+	}, nil
+}
+
+// input records bytes typed by the user
+func (c *castRecorder) input(data []byte) {
+	c.event("i", data)
+}
+
+// output records bytes printed by the container
+func (c *castRecorder) output(data []byte) {
+	c.event("o", data)
+}
+
+// resize records a change of the terminal size, if nothing was
+// recorded yet the header simply gets the new size
+func (c *castRecorder) resize(width, height int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.started {
+		c.header.Width = width
+		c.header.Height = height
+		return
+	}
+	c.write("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+func (c *castRecorder) event(kind string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data = append(c.pending[kind], data...)
+	cut := incompleteRuneStart(data)
+	c.pending[kind] = append([]byte(nil), data[cut:]...)
+	if cut == 0 {
+		return
+	}
+	c.write(kind, string(data[:cut]))
+}
+
+// write appends an event line, callers must hold the lock
+func (c *castRecorder) write(kind, data string) {
+	if c.file == nil {
+		return
+	}
+	if !c.started {
+		c.started = true
+		header, err := json.Marshal(c.header)
+		if err != nil {
+			SysLogger.Error().Err(err).Msg("failed to encode cast header")
+			return
+		}
+		c.file.Write(append(header, '\n'))
+	}
+	line, err := json.Marshal([]interface{}{time.Since(c.start).Seconds(), kind, data})
+	if err != nil {
+		SysLogger.Error().Err(err).Msg("failed to encode cast event")
+		return
+	}
+	_, err = c.file.Write(append(line, '\n'))
+	if err != nil {
+		SysLogger.Error().Err(err).Msgf("failed to write recording %s", c.file.Name())
+	}
+}
+
+// Close flushes whatever is held back and closes the file
+func (c *castRecorder) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for kind, data := range c.pending {
+		if len(data) > 0 {
+			c.write(kind, string(data))
+		}
+	}
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// how often recordings past --recording-retention are looked for
+const recordingPruneInterval = time.Hour
+
+// recordingJanitor keeps the recording dir from filling up
+func recordingJanitor() {
+	for {
+		pruneRecordings(time.Now())
+		time.Sleep(recordingPruneInterval)
+	}
+}
+
+// pruneRecordings deletes the recordings last written before the
+// retention, the ones of sessions still running are kept whatever
+// their age
+func pruneRecordings(now time.Time) {
+	namespaces, err := os.ReadDir(RecordingDir)
+	if err != nil {
+		SysLogger.Error().Err(err).Msgf("failed to read recordings in %s", RecordingDir)
+		return
+	}
+	for _, namespace := range namespaces {
+		if !namespace.IsDir() {
+			continue
+		}
+		dir := filepath.Join(RecordingDir, namespace.Name())
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			SysLogger.Error().Err(err).Msgf("failed to read recordings in %s", dir)
+			continue
+		}
+		for _, file := range files {
+			ctxid, ok := strings.CutSuffix(file.Name(), ".cast")
+			if !ok || file.IsDir() {
+				continue
+			}
+			recorderSync.Lock()
+			_, running := recorderMap[ctxid]
+			recorderSync.Unlock()
+			info, err := file.Info()
+			if running || err != nil || now.Sub(info.ModTime()) < RecordingRetention {
+				continue
+			}
+			err = os.Remove(filepath.Join(dir, file.Name()))
+			if err != nil {
+				SysLogger.Error().Err(err).Msgf("failed to delete recording %s", file.Name())
+			}
+		}
+	}
+}
+
+// incompleteRuneStart returns the index where a trailing,
+// not yet complete utf8 sequence starts, or len(data)
+func incompleteRuneStart(data []byte) int {
+	// a utf8 sequence is at most 4 bytes long so we only
+	// need to look at the last 3 bytes
+	for i := len(data) - 1; i >= 0 && i >= len(data)-3; i-- {
+		if !utf8.RuneStart(data[i]) {
+			continue
+		}
+		if !utf8.FullRune(data[i:]) {
+			return i
+		}
+		break
+	}
+	return len(data)
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	redacted = "[REDACTED]"
+	// how much of the last output line is kept to look for prompts
+	maxPromptTail = 256
+)
+
+// defaultRedactPatterns catch the secrets people tend to type, if a
+// pattern has a group named secret only that part is masked, so the
+// audit still shows what was being set
+var defaultRedactPatterns = []string{
+	// password=..., API_KEY: ..., "token": "..."
+	`(?i)[\w.-]*(?:passw(?:or)?d|passphrase|pwd|secret|token|api[_-]?key|access[_-]?key|private[_-]?key|credentials?)[\w.-]*["']?\s*[=:]\s*(?P<secret>"[^"]*"|'[^']*'|[^\s"'&;|]+)`,
+	// --password ..., --token ...
+	`(?i)\s--?[\w-]*(?:passw(?:or)?d|passphrase|secret|token|api-?key|access-?key)[\w-]*\s+(?P<secret>"[^"]*"|'[^']*'|[^\s"'&;|-][^\s"'&;|]*)`,
+	// authorization headers
+	`(?i)\b(?:bearer|basic)\s+(?P<secret>[\w.~+/=-]{8,})`,
+	// credentials in urls
+	`://[^/\s:@]+:(?P<secret>[^/\s@]+)@`,
+	// mysql -pPASSWORD and sshpass -p PASSWORD
+	`\b(?:mysql|mysqldump|mysqladmin|mariadb)\b.*?\s-p(?P<secret>\S+)`,
+	`\bsshpass\s+-p\s*(?P<secret>\S+)`,
+	// aws access key ids
+	`\b(?:AKIA|ASIA)[A-Z0-9]{16}\b`,
+	// json web tokens
+	`\beyJ[\w-]+\.[\w-]+\.[\w-]+`,
+	// private keys, even if only the start made it into the line
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?(?:-----END [A-Z ]*PRIVATE KEY-----|$)`,
+}
+
+// passwordPrompt matches the output programs print before reading a
+// secret with echo turned off, like sudo, su, ssh or mysql do
+var passwordPrompt = regexp.MustCompile(`(?i)(?:password|passphrase|passcode|pin|secret|token)[^:\n]{0,64}:\s*$`)
+
+// ansiEscape matches the escape sequences a prompt might be colored with
+var ansiEscape = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|.)`)
+
+var redactPatterns []*regexp.Regexp
+
+// setupRedaction compiles the built in and the operator supplied patterns
+func setupRedaction() error {
+	redactPatterns = nil
+	for _, pattern := range append(defaultRedactPatterns, RedactPatterns...) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid redact pattern %q: %w", pattern, err)
+		}
+		redactPatterns = append(redactPatterns, re)
+	}
+	return nil
+}
+
+// redact masks everything the patterns consider a secret
+func redact(text string) string {
+	for _, re := range redactPatterns {
+		secret := re.SubexpIndex("secret")
+		text = re.ReplaceAllStringFunc(text, func(match string) string {
+			if secret < 0 {
+				return redacted
+			}
+			loc := re.FindStringSubmatchIndex(match)
+			if loc == nil || loc[2*secret] < 0 {
+				return redacted
+			}
+			return match[:loc[2*secret]] + redacted + match[loc[2*secret+1]:]
+		})
+	}
+	return text
+}
+
+// redactCommand redacts a line of a session, lines pasted without
+// bracketed paste come one by one so a private key spans several
+func redactCommand(sess *session, text string) string {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.privateKey {
+		if strings.Contains(text, "PRIVATE KEY-----") {
+			sess.privateKey = false
+		}
+		return redacted
+	}
+	if strings.Contains(text, "-----BEGIN ") && strings.Contains(text, "PRIVATE KEY-----") &&
+		!strings.Contains(text, "-----END ") {
+		sess.privateKey = true
+	}
+	return redact(text)
+}
+
+// echoWatch notices when a program asks for a secret, the keys typed
+// until the next enter are not echoed and do not belong in the audit,
+// a prompt only looking like one is told apart by the echo coming back
+type echoWatch struct {
+	mu sync.Mutex
+	// the last line of output, without a newline yet
+	tail []byte
+	// what was typed on the current line, a prompt made of
+	// the echo of these is just someone typing the word
+	typed []byte
+	// input is hidden and the placeholder was already passed on
+	hidden   bool
+	reported bool
+	// what was typed since the prompt and the output seen since
+	// then, if it shows up there the terminal echoed after all
+	secret []byte
+	seen   []byte
+	// the secret of the line finished last, until it is held
+	finished []byte
+	// lines typed at a prompt, logged once the output moved on
+	held []heldLine
+}
+
+// heldLine is a command waiting for the output to tell whether
+// it was echoed
+type heldLine struct {
+	session *session
+	line    editedLine
+	secret  []byte
+}
+
+// output follows the output of the container
+func (w *echoWatch) output(data []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.hidden || len(w.held) > 0 {
+		// only what came before the first newline can be an echo,
+		// what follows is the program already answering
+		seen := data
+		if first := bytes.IndexByte(data, '\n'); first >= 0 {
+			seen = data[:first+1]
+		}
+		w.seen = appendCapped(w.seen, ansiEscape.ReplaceAll(seen, nil), 2*maxPromptTail)
+		if w.hidden && len(w.secret) > 0 && bytes.Contains(w.seen, w.secret) {
+			// the keys came back, so the prompt was not asking for a secret
+			w.hidden = false
+			w.reported = false
+			w.typed = appendCapped(w.typed, w.secret, maxPromptTail)
+		}
+	}
+	if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+		// the prompt is gone once the program moved to a new line
+		w.tail = w.tail[:0]
+		w.hidden = false
+		w.reported = false
+		w.release()
+		data = data[i+1:]
+	}
+	w.tail = appendCapped(w.tail, data, maxPromptTail)
+}
+
+// mask returns the keystrokes as they may be audited, hidden input is
+// replaced by a single placeholder for the whole secret, hidden tells
+// whether the keys up to the first enter were typed with echo off
+func (w *echoWatch) mask(data []byte) ([]byte, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.hidden && len(w.tail) > 0 {
+		tail := ansiEscape.ReplaceAll(w.tail, nil)
+		echoed := len(w.typed) > 0 && bytes.HasSuffix(tail, w.typed)
+		w.hidden = !echoed && passwordPrompt.Match(tail)
+		if w.hidden {
+			w.secret = nil
+			if len(w.held) == 0 {
+				w.seen = w.seen[:0]
+			}
+		}
+	}
+	if !w.hidden {
+		w.track(data)
+		return data, false
+	}
+
+	masked := make([]byte, 0, len(data))
+	for i, b := range data {
+		if b == '\r' || b == '\n' {
+			// enter ends the secret, the rest is typed in the open
+			w.tail = w.tail[:0]
+			w.hidden = false
+			w.reported = false
+			w.finished = w.secret
+			w.secret = nil
+			masked = append(masked, b)
+			w.track(data[i+1:])
+			return append(masked, data[i+1:]...), true
+		}
+		if b >= 0x20 && b != 0x7F {
+			w.secret = appendCapped(w.secret, []byte{b}, maxPromptTail)
+		}
+		if !w.reported {
+			w.reported = true
+			masked = append(masked, redacted...)
+		}
+	}
+	return masked, true
+}
+
+// hold keeps a line typed at a prompt until the output tells whether
+// the terminal echoed it, only then it is logged
+func (w *echoWatch) hold(sess *session, line editedLine) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	secret := w.finished
+	if secret == nil {
+		// the line was cut for being too long, its keys are still typed
+		secret = w.secret
+	}
+	w.finished = nil
+	w.held = append(w.held, heldLine{session: sess, line: line, secret: secret})
+}
+
+// release logs the held lines, the ones whose keys did not come
+// back are masked, callers hold the lock
+func (w *echoWatch) release() {
+	for _, held := range w.held {
+		held.line.hidden = len(held.secret) == 0 || !bytes.Contains(w.seen, held.secret)
+		logCommand(held.session, held.line)
+	}
+	w.held = nil
+	w.seen = w.seen[:0]
+}
+
+// flush logs what is still held once the connection is gone
+func (w *echoWatch) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.release()
+}
+
+// appendCapped appends to buf and keeps only its last limit bytes
+func appendCapped(buf, data []byte, limit int) []byte {
+	buf = append(buf, data...)
+	if len(buf) > limit {
+		buf = append(buf[:0], buf[len(buf)-limit:]...)
+	}
+	return buf
+}
+
+// track keeps what is typed in the open on the current line
+func (w *echoWatch) track(data []byte) {
+	for _, b := range data {
+		switch {
+		case b == '\r' || b == '\n':
+			w.typed = w.typed[:0]
+		case b >= 0x20 && b != 0x7F && len(w.typed) < maxPromptTail:
+			w.typed = append(w.typed, b)
+		}
+	}
+}
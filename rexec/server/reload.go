@@ -0,0 +1,44 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"time"
+)
+
+// how often files mounted from configmaps are checked for changes
+const fileReloadInterval = 10 * time.Second
+
+// loadFile reads a config file and applies it, it is used on startup
+// where a broken file should stop rexec from coming up
+func loadFile(path string, apply func([]byte) error) ([]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return raw, apply(raw)
+}
+
+// fileReloader applies a file again whenever it changes, configmap mounts
+// swap the file behind a symlink so the content is compared, a broken
+// file keeps the previous config and is not retried until it changes
+func fileReloader(path string, last []byte, apply func([]byte) error) {
+	for {
+		time.Sleep(fileReloadInterval)
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			SysLogger.Error().Err(err).Msgf("failed to read %s, keeping the previous config", path)
+			continue
+		}
+		if bytes.Equal(raw, last) {
+			continue
+		}
+		last = raw
+		err = apply(raw)
+		if err != nil {
+			SysLogger.Error().Err(err).Msgf("failed to apply %s, keeping the previous config", path)
+			continue
+		}
+		SysLogger.Info().Msgf("reloaded %s", path)
+	}
+}
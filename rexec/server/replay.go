@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// longest event line we read back from a recording
+const maxCastLine = 4 * 1024 * 1024
+
+// recordedCommand is a command typed in a recorded session, at the
+// seconds since the session started
+type recordedCommand struct {
+	Time      float64 `json:"time"`
+	Command   string  `json:"command"`
+	Uncertain bool    `json:"uncertain,omitempty"`
+}
+
+type recordedCommands struct {
+	Session  string            `json:"session"`
+	Commands []recordedCommand `json:"commands"`
+}
+
+// recordingFile returns where the recording of a session is kept, names
+// coming from the url must not lead out of the recording dir
+func recordingFile(namespace, id string) (string, error) {
+	if RecordingDir == "" {
+		return "", errors.New("sessions are not recorded")
+	}
+	for _, part := range []string{namespace, id} {
+		if part == "" || part != filepath.Base(part) || strings.HasPrefix(part, ".") {
+			return "", fmt.Errorf("invalid name %q", part)
+		}
+	}
+	return filepath.Join(RecordingDir, namespace, fmt.Sprintf("%s.cast", id)), nil
+}
+
+// castCommands rebuilds the commands typed in a recording the same way
+// the audit log does
+func castCommands(cast io.Reader) ([]recordedCommand, error) {
+	scanner := bufio.NewScanner(cast)
+	scanner.Buffer(make([]byte, 64*1024), maxCastLine)
+	// the first line is the header
+	if !scanner.Scan() {
+		return nil, scanner.Err()
+	}
+	editor := &lineEditor{}
+	commands := []recordedCommand{}
+	for scanner.Scan() {
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+			continue
+		}
+		kind, _ := event[1].(string)
+		if kind != "i" {
+			continue
+		}
+		at, _ := event[0].(float64)
+		data, _ := event[2].(string)
+		for _, line := range editor.feed([]byte(data)) {
+			if line.text == "" {
+				continue
+			}
+			commands = append(commands, recordedCommand{Time: at, Command: redact(line.text), Uncertain: line.uncertain})
+		}
+	}
+	return commands, scanner.Err()
+}
+
+// sessionRecordingHandler serves the recording of a session, or only the
+// commands typed in it, reading recordings is audited as they hold
+// everything the user saw
+func sessionRecordingHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !authorize(w, r, "get", vars["namespace"], vars["name"], "recording") {
+		return
+	}
+	path, err := recordingFile(vars["namespace"], vars["name"])
+	if err != nil {
+		writeStatus(w, http.StatusNotFound, fmt.Sprintf("no recording of session %s: %s", vars["name"], err))
+		return
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		writeStatus(w, http.StatusNotFound, fmt.Sprintf("no recording of session %s on this replica", vars["name"]))
+		return
+	}
+	if err != nil {
+		SysLogger.Error().Err(err).Msgf("failed to open recording %s", path)
+		writeStatus(w, http.StatusInternalServerError, "failed to read the recording")
+		return
+	}
+	defer file.Close()
+
+	commandsOnly := boolParam(r.URL.Query(), "commands")
+	auditLogger.Info().
+		Str("event", "recording_read").
+		Str("session", vars["name"]).
+		Str("namespace", vars["namespace"]).
+		Str("user", remoteUser(r)).
+		Bool("commands_only", commandsOnly).
+		Msg("")
+
+	if commandsOnly {
+		commands, err := castCommands(file)
+		if err != nil {
+			SysLogger.Error().Err(err).Msgf("failed to read recording %s", path)
+			writeStatus(w, http.StatusInternalServerError, "failed to read the recording")
+			return
+		}
+		writeObject(w, http.StatusOK, recordedCommands{Session: vars["name"], Commands: commands})
+		return
+	}
+	info, err := file.Stat()
+	if err != nil {
+		writeStatus(w, http.StatusInternalServerError, "failed to read the recording")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), file)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"os"
+	"testing"
+)
+
+func setRecordingDir(t *testing.T, dir string) {
+	old := RecordingDir
+	t.Cleanup(func() { RecordingDir = old })
+	RecordingDir = dir
+}
+
+func TestRecordingFile(t *testing.T) {
+	setRecordingDir(t, "")
+	if _, err := recordingFile("prod", "test"); err == nil {
+		t.Fatal("expected an error without recordings")
+	}
+
+	setRecordingDir(t, "/recordings")
+	if path, err := recordingFile("prod", "test"); err != nil || path != "/recordings/prod/test.cast" {
+		t.Fatalf("got %q %v", path, err)
+	}
+	for _, name := range [][2]string{{"prod", "../../etc/passwd"}, {"..", "test"}, {"prod", ".."}, {"", "test"}, {"prod", "a/b"}} {
+		if path, err := recordingFile(name[0], name[1]); err == nil {
+			t.Errorf("%q/%q led to %q", name[0], name[1], path)
+		}
+	}
+}
+
+func TestCastCommands(t *testing.T) {
+	setRecordingDir(t, t.TempDir())
+	setRedactPatterns(t)
+	oldMax := MaxStokesPerLine
+	t.Cleanup(func() { MaxStokesPerLine = oldMax })
+	MaxStokesPerLine = 2000
+	recorder, err := newCastRecorder("prod", "test", "lauren@prod/db-0", "bash")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	recorder.input([]byte("lx\x7fs\r"))
+	recorder.output([]byte("ls\r\nfile\r\n"))
+	recorder.input([]byte("\r"))
+	recorder.input([]byte("mysql password=hunter2\r"))
+	recorder.Close()
+
+	path, err := recordingFile("prod", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer file.Close()
+	commands, err := castCommands(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(commands) != 2 || commands[0].Command != "ls" || commands[1].Command != "mysql password=[REDACTED]" {
+		t.Fatalf("unexpected commands: %+v", commands)
+	}
+}
@@ -0,0 +1,484 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	// size until the client tells us the real one
+	defaultScreenWidth  = 80
+	defaultScreenHeight = 24
+	// terminals do not send bigger ones, this just caps
+	// what a malicious resize message could allocate
+	maxScreenSize = 1000
+	// longest csi parameter list we keep
+	maxCSIParams = 32
+)
+
+// states of the escape sequence parser
+const (
+	vtGround = iota
+	vtEscape
+	vtCSI
+	vtOSC
+	vtCharset
+)
+
+// screenLine is the line the terminal showed when enter was pressed,
+// found is false if the prompt could not be located on it, then text
+// holds the whole line including whatever the prompt was
+type screenLine struct {
+	text  string
+	found bool
+}
+
+// screenGrid is the content of one of the screen buffers
+type screenGrid struct {
+	cells [][]rune
+	// the row continues on the next one because of an automatic wrap
+	wrapped []bool
+}
+
+// screen emulates enough of a vt100/xterm to know what the user saw,
+// it is fed from the output goroutine and read from the input one
+type screen struct {
+	mu     sync.Mutex
+	width  int
+	height int
+	grid   screenGrid
+	// the main buffer while an application uses the alternate one
+	main      *screenGrid
+	row       int
+	col       int
+	savedRow  int
+	savedCol  int
+	wrapNext  bool
+	scrollTop int
+	scrollBot int
+	// escape sequence parser
+	state   int
+	params  []byte
+	partial []byte
+	// the prompt in front of the line being typed
+	typing bool
+	prompt string
+}
+
+func newScreen() *screen {
+	s := &screen{width: defaultScreenWidth, height: defaultScreenHeight}
+	s.grid = newScreenGrid(s.width, s.height)
+	s.scrollBot = s.height - 1
+	return s
+}
+
+func newScreenGrid(width, height int) screenGrid {
+	g := screenGrid{cells: make([][]rune, height), wrapped: make([]bool, height)}
+	for i := range g.cells {
+		g.cells[i] = blankRow(width)
+	}
+	return g
+}
+
+func blankRow(width int) []rune {
+	row := make([]rune, width)
+	for i := range row {
+		row[i] = ' '
+	}
+	return row
+}
+
+// resize keeps the top left of the content like xterm does
+func (s *screen) resize(width, height int) {
+	if width <= 0 || height <= 0 || width > maxScreenSize || height > maxScreenSize {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.grid = s.grid.resized(width, height)
+	if s.main != nil {
+		main := s.main.resized(width, height)
+		s.main = &main
+	}
+	s.width, s.height = width, height
+	s.row = min(s.row, height-1)
+	s.col = min(s.col, width-1)
+	s.savedRow = min(s.savedRow, height-1)
+	s.savedCol = min(s.savedCol, width-1)
+	s.scrollTop, s.scrollBot = 0, height-1
+	s.wrapNext = false
+}
+
+func (g screenGrid) resized(width, height int) screenGrid {
+	resized := newScreenGrid(width, height)
+	for i := 0; i < min(height, len(g.cells)); i++ {
+		copy(resized.cells[i], g.cells[i])
+		resized.wrapped[i] = g.wrapped[i]
+	}
+	return resized
+}
+
+// write applies output of the container to the screen
+func (s *screen) write(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data = append(s.partial, data...)
+	s.partial = nil
+	for len(data) > 0 {
+		b := data[0]
+		if b >= utf8.RuneSelf && s.state == vtGround {
+			if !utf8.FullRune(data) {
+				s.partial = append(s.partial, data...)
+				return
+			}
+			r, size := utf8.DecodeRune(data)
+			data = data[size:]
+			s.put(r)
+			continue
+		}
+		data = data[1:]
+		s.step(b)
+	}
+}
+
+// step feeds a single byte to the escape sequence parser
+func (s *screen) step(b byte) {
+	switch s.state {
+	case vtEscape:
+		s.state = vtGround
+		s.escape(b)
+	case vtCSI:
+		switch {
+		case b == 0x1B:
+			s.state = vtEscape
+		case b == 0x18 || b == 0x1A:
+			// cancelled
+			s.state = vtGround
+		case b >= 0x40 && b <= 0x7E:
+			s.state = vtGround
+			s.csi(string(s.params), b)
+		case b >= 0x20:
+			if len(s.params) > maxCSIParams {
+				s.state = vtGround
+				return
+			}
+			s.params = append(s.params, b)
+		default:
+			s.control(b)
+		}
+	case vtOSC:
+		// titles and such, until bel or string terminator
+		switch b {
+		case 0x07:
+			s.state = vtGround
+		case 0x1B:
+			s.state = vtEscape
+		}
+	case vtCharset:
+		s.state = vtGround
+	default:
+		if b == 0x1B {
+			s.state = vtEscape
+			return
+		}
+		if b < 0x20 || b == 0x7F {
+			s.control(b)
+			return
+		}
+		s.put(rune(b))
+	}
+}
+
+func (s *screen) control(b byte) {
+	switch b {
+	case '\r':
+		s.col = 0
+		s.wrapNext = false
+	case '\n', '\v', '\f':
+		s.lineFeed()
+	case '\b':
+		s.col = max(s.col-1, 0)
+		s.wrapNext = false
+	case '\t':
+		s.col = min((s.col/8+1)*8, s.width-1)
+	}
+}
+
+func (s *screen) escape(b byte) {
+	switch b {
+	case '[':
+		s.state = vtCSI
+		s.params = s.params[:0]
+	case ']', 'P', '_', '^':
+		s.state = vtOSC
+	case '(', ')', '*', '+', '#', '%':
+		s.state = vtCharset
+	case '7':
+		s.savedRow, s.savedCol = s.row, s.col
+	case '8':
+		s.row, s.col = s.savedRow, s.savedCol
+		s.wrapNext = false
+	case 'D':
+		s.lineFeed()
+	case 'E':
+		s.col = 0
+		s.lineFeed()
+	case 'M':
+		if s.row == s.scrollTop {
+			s.scrollDown(1)
+		} else {
+			s.row = max(s.row-1, 0)
+		}
+	case 'c':
+		s.grid = newScreenGrid(s.width, s.height)
+		s.main = nil
+		s.row, s.col = 0, 0
+		s.scrollTop, s.scrollBot = 0, s.height-1
+	}
+}
+
+// csi handles the control sequences shells and readline use
+func (s *screen) csi(params string, final byte) {
+	if strings.HasPrefix(params, "?") {
+		s.privateMode(params[1:], final)
+		return
+	}
+	args := strings.Split(params, ";")
+	arg := func(i, def int) int {
+		if i >= len(args) {
+			return def
+		}
+		n, err := strconv.Atoi(args[i])
+		if err != nil || n == 0 {
+			return def
+		}
+		return min(n, maxScreenSize)
+	}
+	n := arg(0, 1)
+	s.wrapNext = false
+
+	switch final {
+	case 'A':
+		s.row = max(s.row-n, 0)
+	case 'B', 'e':
+		s.row = min(s.row+n, s.height-1)
+	case 'C', 'a':
+		s.col = min(s.col+n, s.width-1)
+	case 'D':
+		s.col = max(s.col-n, 0)
+	case 'E':
+		s.row = min(s.row+n, s.height-1)
+		s.col = 0
+	case 'F':
+		s.row = max(s.row-n, 0)
+		s.col = 0
+	case 'G', '`':
+		s.col = min(n-1, s.width-1)
+	case 'd':
+		s.row = min(n-1, s.height-1)
+	case 'H', 'f':
+		s.row = min(n-1, s.height-1)
+		s.col = min(arg(1, 1)-1, s.width-1)
+	case 'J':
+		s.eraseDisplay(arg(0, 0))
+	case 'K':
+		s.eraseLine(arg(0, 0))
+	case 'X':
+		row := s.grid.cells[s.row]
+		for i := s.col; i < min(s.col+n, s.width); i++ {
+			row[i] = ' '
+		}
+	case 'P':
+		row := s.grid.cells[s.row]
+		n = min(n, s.width-s.col)
+		copy(row[s.col:], row[s.col+n:])
+		for i := s.width - n; i < s.width; i++ {
+			row[i] = ' '
+		}
+	case '@':
+		row := s.grid.cells[s.row]
+		n = min(n, s.width-s.col)
+		copy(row[s.col+n:], row[s.col:])
+		for i := s.col; i < s.col+n; i++ {
+			row[i] = ' '
+		}
+	case 'L':
+		if s.row >= s.scrollTop && s.row <= s.scrollBot {
+			s.scrollRegion(s.row, s.scrollBot, -n)
+		}
+	case 'M':
+		if s.row >= s.scrollTop && s.row <= s.scrollBot {
+			s.scrollRegion(s.row, s.scrollBot, n)
+		}
+	case 'S':
+		s.scrollRegion(s.scrollTop, s.scrollBot, n)
+	case 'T':
+		s.scrollDown(n)
+	case 'r':
+		top, bottom := arg(0, 1)-1, arg(1, s.height)-1
+		if top < bottom && bottom < s.height {
+			s.scrollTop, s.scrollBot = top, bottom
+			s.row, s.col = 0, 0
+		}
+	case 's':
+		s.savedRow, s.savedCol = s.row, s.col
+	case 'u':
+		s.row, s.col = s.savedRow, s.savedCol
+	}
+}
+
+// privateMode only cares about the alternate screen, what full screen
+// applications draw there is not part of the shell session
+func (s *screen) privateMode(params string, final byte) {
+	if params != "1049" && params != "1047" && params != "47" {
+		return
+	}
+	switch {
+	case final == 'h' && s.main == nil:
+		main := s.grid
+		s.main = &main
+		s.savedRow, s.savedCol = s.row, s.col
+		s.grid = newScreenGrid(s.width, s.height)
+	case final == 'l' && s.main != nil:
+		s.grid = *s.main
+		s.main = nil
+		s.row, s.col = s.savedRow, s.savedCol
+	}
+}
+
+// put writes a character at the cursor, wrapping like xterm does
+// only once the next character comes in
+func (s *screen) put(r rune) {
+	if s.wrapNext {
+		s.grid.wrapped[s.row] = true
+		s.col = 0
+		s.lineFeed()
+	}
+	s.grid.cells[s.row][s.col] = r
+	if s.col == s.width-1 {
+		s.wrapNext = true
+	} else {
+		s.col++
+	}
+}
+
+func (s *screen) lineFeed() {
+	s.wrapNext = false
+	if s.row == s.scrollBot {
+		s.scrollRegion(s.scrollTop, s.scrollBot, 1)
+		return
+	}
+	s.row = min(s.row+1, s.height-1)
+}
+
+func (s *screen) scrollDown(n int) {
+	s.scrollRegion(s.scrollTop, s.scrollBot, -n)
+}
+
+// scrollRegion moves rows top to bottom up by n, or down if n is negative
+func (s *screen) scrollRegion(top, bottom, n int) {
+	g := s.grid
+	size := bottom - top + 1
+	if n > 0 {
+		n = min(n, size)
+		copy(g.cells[top:], g.cells[top+n:bottom+1])
+		copy(g.wrapped[top:], g.wrapped[top+n:bottom+1])
+		for i := bottom - n + 1; i <= bottom; i++ {
+			g.cells[i] = blankRow(s.width)
+			g.wrapped[i] = false
+		}
+		return
+	}
+	n = min(-n, size)
+	copy(g.cells[top+n:bottom+1], g.cells[top:bottom+1-n])
+	copy(g.wrapped[top+n:bottom+1], g.wrapped[top:bottom+1-n])
+	for i := top; i < top+n; i++ {
+		g.cells[i] = blankRow(s.width)
+		g.wrapped[i] = false
+	}
+}
+
+func (s *screen) eraseLine(mode int) {
+	row := s.grid.cells[s.row]
+	from, to := s.col, s.width
+	switch mode {
+	case 1:
+		from, to = 0, s.col+1
+	case 2:
+		from = 0
+	}
+	for i := from; i < min(to, s.width); i++ {
+		row[i] = ' '
+	}
+	if mode != 1 {
+		s.grid.wrapped[s.row] = false
+	}
+}
+
+func (s *screen) eraseDisplay(mode int) {
+	from, to := s.row+1, s.height
+	switch mode {
+	case 0:
+		s.eraseLine(0)
+	case 1:
+		s.eraseLine(1)
+		from, to = 0, s.row
+	default:
+		from = 0
+	}
+	for i := from; i < to; i++ {
+		s.grid.cells[i] = blankRow(s.width)
+		s.grid.wrapped[i] = false
+	}
+}
+
+// input looks at the keystrokes before they are forwarded, the prompt is
+// taken when a line starts and the line is taken on enter, the returned
+// lines are keyed by the offset of their enter in data
+func (s *screen) input(data []byte) map[int]screenLine {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lines map[int]screenLine
+	for i, b := range data {
+		if s.main != nil {
+			// a full screen application is running
+			continue
+		}
+		if !s.typing {
+			s.typing = true
+			s.prompt = string(s.grid.cells[s.row][:s.col])
+		}
+		if b != '\r' && b != '\n' {
+			continue
+		}
+		if lines == nil {
+			lines = map[int]screenLine{}
+		}
+		lines[i] = s.currentLine()
+		s.typing = false
+	}
+	return lines
+}
+
+// currentLine returns the logical line under the cursor with the prompt
+// cut off, a line wrapped over several rows is joined back together
+func (s *screen) currentLine() screenLine {
+	first, last := s.row, s.row
+	for first > 0 && s.grid.wrapped[first-1] {
+		first--
+	}
+	for last < s.height-1 && s.grid.wrapped[last] {
+		last++
+	}
+	var text strings.Builder
+	for i := first; i <= last; i++ {
+		text.WriteString(string(s.grid.cells[i]))
+	}
+	line := text.String()
+	if strings.HasPrefix(line, s.prompt) {
+		return screenLine{text: strings.TrimRight(line[len(s.prompt):], " "), found: true}
+	}
+	return screenLine{text: strings.TrimRight(line, " ")}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestScreenHistoryRecall(t *testing.T) {
+	s := newScreen()
+	s.write([]byte("\x1b]0;root@pod: /\x07root@pod:/# "))
+	if lines := s.input([]byte("\x1b[A")); len(lines) != 0 {
+		t.Fatalf("unexpected lines: %+v", lines)
+	}
+	// bash redraws the line with the command from the history
+	s.write([]byte("cat /etc/hostname"))
+	lines := s.input([]byte("\r"))
+	if lines[0] != (screenLine{text: "cat /etc/hostname", found: true}) {
+		t.Fatalf("unexpected line: %+v", lines[0])
+	}
+}
+
+func TestScreenTabCompletion(t *testing.T) {
+	s := newScreen()
+	s.write([]byte("$ "))
+	s.input([]byte("c"))
+	s.write([]byte("cat /etc/pa"))
+	// the candidates are listed and the prompt is drawn again below them
+	s.write([]byte("\r\npasswd  paths\r\n$ cat /etc/pa"))
+	s.write([]byte("sswd "))
+	lines := s.input([]byte("\r"))
+	if lines[0] != (screenLine{text: "cat /etc/passwd", found: true}) {
+		t.Fatalf("unexpected line: %+v", lines[0])
+	}
+}
+
+func TestScreenWrappedLine(t *testing.T) {
+	s := newScreen()
+	s.resize(10, 5)
+	s.write([]byte("$ "))
+	s.input([]byte("e"))
+	s.write([]byte("echo 0123456789abc"))
+	// readline moving back over the wrap and editing in place
+	s.write([]byte("\x1b[A\x1b[3GE\x1b[B"))
+	lines := s.input([]byte("x\r"))
+	if _, ok := lines[1]; !ok || lines[1] != (screenLine{text: "Echo 0123456789abc", found: true}) {
+		t.Fatalf("unexpected lines: %+v", lines)
+	}
+}
+
+func TestScreenAlternateBuffer(t *testing.T) {
+	s := newScreen()
+	s.write([]byte("$ vim\r\n\x1b[?1049h\x1b[H\x1b[2Jfile content"))
+	if lines := s.input([]byte("ihello\r")); len(lines) != 0 {
+		t.Fatalf("lines taken from the alternate screen: %+v", lines)
+	}
+	s.write([]byte("\x1b[?1049l\r\n$ "))
+	lines := s.input([]byte("\r"))
+	if lines[0] != (screenLine{text: "", found: true}) {
+		t.Fatalf("unexpected line: %+v", lines[0])
+	}
+}
+
+func TestScreenScroll(t *testing.T) {
+	s := newScreen()
+	s.resize(20, 3)
+	s.write([]byte("one\r\ntwo\r\nthree\r\nfour\r\n$ "))
+	s.input([]byte("i"))
+	s.write([]byte("id"))
+	lines := s.input([]byte("\r"))
+	if lines[0] != (screenLine{text: "id", found: true}) {
+		t.Fatalf("unexpected line: %+v", lines[0])
+	}
+	if got := strings.TrimRight(string(s.grid.cells[0]), " "); got != "three" {
+		t.Fatalf("screen did not scroll, first row is %q", got)
+	}
+}
+
+func TestStoreOrFlushLogsScreen(t *testing.T) {
+	setEditors(t)
+
+	var buf bytes.Buffer
+	sess := &session{id: "test", logger: zerolog.New(&buf)}
+	storeOrFlush(keystrokes{
+		ctxid:   "test",
+		session: sess,
+		ascii:   []byte("\x1b[A\r"),
+		screens: map[int]screenLine{3: {text: "cat /etc/hostname", found: true}},
+	})
+	want := `"command":"","uncertain":true,"uncertain_reason":"history","screen_command":"cat /etc/hostname","screen_prompt_found":true`
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("unexpected event: %s", buf.String())
+	}
+}
@@ -4,14 +4,16 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"maps"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
 	"strings"
-	"time"
+	"syscall"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -23,28 +25,71 @@ func Server() {
 	// creating a mux router
 	r := mux.NewRouter()
 
-	// handling rexec request to handler
-	r.HandleFunc("/apis/audit.adyen.internal/v1beta1/namespaces/{namespace}/pods/{pod}/exec", rexecHandler)
-	// returning some dummy json making kubeapiserver happier
-	r.HandleFunc("/apis/audit.adyen.internal/v1beta1", func(w http.ResponseWriter, r *http.Request) {
+	// handling rexec request to handler, the apis routes are only
+	// served to the kube apiserver aggregation layer, attach and
+	// port-forward go the same way as exec
+	r.Handle("/apis/audit.adyen.internal/v1beta1/namespaces/{namespace}/pods/{pod}/{subresource:exec|attach|portforward}", requireFrontProxy(http.HandlerFunc(rexecHandler)))
+	// debug containers are added through rexec, which picks what they may run
+	r.Handle("/apis/audit.adyen.internal/v1beta1/namespaces/{namespace}/pods/{pod}/debug", requireFrontProxy(http.HandlerFunc(debugHandler))).Methods(http.MethodPost)
+	// exec requests are created and decided through rexec, so the
+	// identity of the requester and the approver can be trusted
+	r.Handle("/apis/audit.adyen.internal/v1beta1/namespaces/{namespace}/execrequests", requireFrontProxy(http.HandlerFunc(approvalCreateHandler))).Methods(http.MethodPost)
+	r.Handle("/apis/audit.adyen.internal/v1beta1/namespaces/{namespace}/execrequests/{name}/approve", requireFrontProxy(approvalDecisionHandler(true))).Methods(http.MethodPost)
+	r.Handle("/apis/audit.adyen.internal/v1beta1/namespaces/{namespace}/execrequests/{name}/deny", requireFrontProxy(approvalDecisionHandler(false))).Methods(http.MethodPost)
+	// live tty sessions can be listed, watched and closed, access is reviewed
+	// again by rexec as closing someone's session is no small thing
+	r.Handle("/apis/audit.adyen.internal/v1beta1/execsessions", requireFrontProxy(http.HandlerFunc(sessionListHandler))).Methods(http.MethodGet)
+	r.Handle("/apis/audit.adyen.internal/v1beta1/namespaces/{namespace}/execsessions", requireFrontProxy(http.HandlerFunc(sessionListHandler))).Methods(http.MethodGet)
+	r.Handle("/apis/audit.adyen.internal/v1beta1/namespaces/{namespace}/execsessions/{name}", requireFrontProxy(http.HandlerFunc(sessionGetHandler))).Methods(http.MethodGet)
+	r.Handle("/apis/audit.adyen.internal/v1beta1/namespaces/{namespace}/execsessions/{name}", requireFrontProxy(http.HandlerFunc(sessionDeleteHandler))).Methods(http.MethodDelete)
+	r.Handle("/apis/audit.adyen.internal/v1beta1/namespaces/{namespace}/execsessions/{name}/attach", requireFrontProxy(http.HandlerFunc(sessionWatchHandler))).Methods(http.MethodGet)
+	// recordings outlive their sessions, so they are served for
+	// sessions which are not listed anymore as well
+	r.Handle("/apis/audit.adyen.internal/v1beta1/namespaces/{namespace}/execsessions/{name}/recording", requireFrontProxy(http.HandlerFunc(sessionRecordingHandler))).Methods(http.MethodGet)
+	// returning the resources served here making kubeapiserver happier
+	r.Handle("/apis/audit.adyen.internal/v1beta1", requireFrontProxy(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(httpSpec))
-	})
+	})))
 	// handle native pod exec through a validating webhook
 	r.HandleFunc("/validate-exec", execHandler)
 
-	// start tls listener
-	http.ListenAndServeTLS(":8443", "/etc/pki/rexec/tls.crt", "/etc/pki/rexec/tls.key", r)
+	// start tls listener, client certs are requested but verified
+	// by requireFrontProxy, as the webhook calls come without one
+	// and the requestheader ca can rotate at runtime
+	srv := &http.Server{
+		Addr:    ":8443",
+		Handler: r,
+		TLSConfig: &tls.Config{
+			ClientAuth: tls.RequestClientCert,
+		},
+	}
+	// on shutdown the audit sinks get a chance to flush
+	// what they are still holding in memory
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+		SysLogger.Debug().Msg("shutting down, closing audit sinks")
+		closeAuditSinks()
+		os.Exit(0)
+	}()
+
+	err := srv.ListenAndServeTLS("/etc/pki/rexec/tls.crt", "/etc/pki/rexec/tls.key")
+	if err != nil {
+		SysLogger.Fatal().Err(err).Msg("failed to serve")
+	}
 }
 
-// rexecHandler is responsible for rewrite the request to an exec request
-// and proxy it back to k8s api
+// rexecHandler is responsible for rewrite the request to an exec or
+// attach request and proxy it back to k8s api
 func rexecHandler(w http.ResponseWriter, r *http.Request) {
 	// parsing for vars
 	pathParams := mux.Vars(r)
 	namespace := pathParams["namespace"]
 	pod := pathParams["pod"]
-	user := r.Header.Get("X-Remote-User")
+	subresource := pathParams["subresource"]
+	user := remoteUser(r)
 
 	// if any of the minimal parameters are missing we should bail
 	if user == "" || namespace == "" || pod == "" {
@@ -52,7 +97,7 @@ func rexecHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(httpForbidden))
 		return
 	}
-	r.Header.Add("Kubectl-Command", "kubectl exec")
+	r.Header.Add("Kubectl-Command", fmt.Sprintf("kubectl %s", subresource))
 
 	// adding the service account token we are using for impersonating
 	r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
@@ -61,7 +106,7 @@ func rexecHandler(w http.ResponseWriter, r *http.Request) {
 	r.Header.Add("Impersonate-User", user)
 
 	// adding all passed groups as impersonation groups
-	groups := r.Header.Values("X-Remote-Group")
+	groups := remoteGroups(r)
 	for _, group := range groups {
 		r.Header.Add("Impersonate-Group", group)
 	}
@@ -72,9 +117,17 @@ func rexecHandler(w http.ResponseWriter, r *http.Request) {
 	// header which will end up in `admissionReview.Request.UserInfo.Extra`
 	r.Header.Add("Impersonate-Extra-Secret-Sauce", SecretSauce)
 
+	// the break-glass marker is for rexec only, the webhook learns
+	// about it through an extra so it does not apply the exec rules
+	breakGlass := r.Header.Get(breakGlassHeader) == "true"
+	r.Header.Del(breakGlassHeader)
+	if breakGlass {
+		r.Header.Add("Impersonate-Extra-Break-Glass", "true")
+	}
+
 	// template old and new url paths and replace them in the url
-	newPath := fmt.Sprintf("api/v1/namespaces/%s/pods/%s/exec", namespace, pod)
-	oldPath := fmt.Sprintf("apis/audit.adyen.internal/v1beta1/namespaces/%s/pods/%s/exec", namespace, pod)
+	newPath := fmt.Sprintf("api/v1/namespaces/%s/pods/%s/%s", namespace, pod, subresource)
+	oldPath := fmt.Sprintf("apis/audit.adyen.internal/v1beta1/namespaces/%s/pods/%s/%s", namespace, pod, subresource)
 	r.URL.Path = strings.ReplaceAll(r.URL.Path, oldPath, newPath)
 	r.URL.RawPath = strings.ReplaceAll(r.URL.RawPath, oldPath, newPath)
 	r.Host = "kubernetes.default.svc.cluster.local:443"
@@ -86,93 +139,127 @@ func rexecHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// first fetch the command parameters from the url params to check what commands were passed
-	// initially to the container
-	var initialCommand []string
-	needsRecording := false
-	for key, value := range params {
-		if key == "command" {
-			initialCommand = append(initialCommand, value...)
-		}
-		// we also check whether tty was requested, if so we will need to record the session
-		if key == "tty" {
-			needsRecording = true
-		}
-	}
-
-	if !needsRecording {
-		// if we dont need any recording, we just pass the request back to the kube apiserver
-		url, _ := url.Parse("https://kubernetes.default.svc.cluster.local:443")
-		proxy := httputil.NewSingleHostReverseProxy(url)
-
-		proxy.Transport = &http.Transport{
-			DisableKeepAlives:  true,
-			DisableCompression: true,
-			TLSClientConfig: &tls.Config{
-				RootCAs: CAPool,
-			},
-		}
-
-		// Log initial command as an audit event
-		// as oneoff, since we dont do tty so there
-		// wont be a recording and a session id
-		logCommand(strings.Join(initialCommand, " "), user, "oneoff")
-
-		proxy.FlushInterval = -1
-
-		proxy.ServeHTTP(w, r)
+	// the justification is for rexec only, the apiserver has no use for it
+	query := maps.Clone(params)
+	query.Del(reasonParam)
+	query.Del(ticketParam)
+	r.URL.RawQuery = query.Encode()
+
+	// every exec, with a tty or not, is passed through a tcp proxy of its
+	// own so both directions can be inspected
+
+	// we begin to generate a uuid for the session and we set it as the id of a context
+	// we will use this id to keep track what use the session belongs to
+	ctxid := uuid.New().String()
+	ctx := context.WithValue(r.Context(), "sessionID", ctxid)
+
+	// we save the session id into a map with the user's identity
+	// and everything else we know about the session
+	sess := newSession(ctxid, r, user, groups, namespace, pod, subresource, params)
+	// a port-forward rexec could not follow is refused before
+	// anything else, neither approvals nor break-glass let it by
+	reason, message, ok := "exec denied", "", false
+	if err := admitPortForward(sess, r.Header); err != nil {
+		message = err.Error() + "\n"
 	} else {
-		// in the case of recording we will pass the request through a tcp proxy to make it easier
-		// to actually monitor what is being typed in to the shell
-
-		// we begin to generate a uuid for the session and we set it as the id of a context
-		// we will use this id to keep track what use the session belongs to
-		ctxid := uuid.New().String()
-		ctx := context.WithValue(r.Context(), "sessionID", ctxid)
-
-		// we save the session id into a map with the user's identity
-		mapSync.Lock()
-		userMap[ctxid] = user
-		mapSync.Unlock()
-
-		// we set the previously generated context to the request
-		r.WithContext(ctx)
-
-		// Log initial command as an audit event
-		// with session id
-		logCommand(strings.Join(initialCommand, " "), user, ctxid)
+		reason, message, ok = admit(r.Context(), sess, breakGlass)
+	}
+	if !ok {
+		sess.logStart()
+		sess.end(reason)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(message))
+		return
+	}
+	// the limits are meant for people sitting at a terminal, a
+	// command without one may run as long as it needs
+	if sess.tty {
+		sess.setLimits(r.Context())
+	}
 
-		// we start up a tcp forwarder for the session
-		go tcpForwarder(ctx)
+	// the listener of the session's tcp forwarder is set up before
+	// anything is proxied so there is nothing to wait for
+	listener, err := sessionListener(ctx, ctxid)
+	if err != nil {
+		SysLogger.Error().Err(err).Msgf("failed to start listener for %s", ctxid)
+		sess.logStart()
+		sess.end("forwarder did not start")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(httpInternalError))
+		return
+	}
 
-		// we need to wait a bit until the listener is actually there
-		// probably there are 10 more sophisticated ways to do this
-		// but it is not important now
-		err = waitForListener(ctxid)
+	// if recording is enabled both directions of tty sessions
+	// are written into an asciinema cast file
+	if RecordingDir != "" && sess.tty {
+		recorder, err := newCastRecorder(namespace, ctxid, fmt.Sprintf("%s@%s/%s", user, namespace, pod), redact(strings.Join(sess.command, " ")))
 		if err != nil {
-			SysLogger.Error().Err(err).Msg("waiting for listener")
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(httpInternalError))
-			return
+			SysLogger.Error().Err(err).Msgf("failed to start recording for %s", ctxid)
+			// break-glass sessions are not let in unrecorded
+			if sess.breakGlass {
+				listener.Close()
+				sess.logStart()
+				sess.end("recording failed")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(httpInternalError))
+				return
+			}
+		} else {
+			recorderSync.Lock()
+			recorderMap[ctxid] = recorder
+			recorderSync.Unlock()
 		}
+	}
+	mapSync.Lock()
+	sessionMap[ctxid] = sess
+	mapSync.Unlock()
+
+	// we set the previously generated context to the request
+	r.WithContext(ctx)
+
+	// Log the start of the session along with
+	// the initial command as an audit event
+	sess.logStart()
+
+	// we start up a tcp forwarder for the session
+	go tcpForwarder(ctx, listener)
+
+	// url does not really matter we are going through the socket anyway
+	url, _ := url.Parse("http://localhost:8080")
+	proxy := httputil.NewSingleHostReverseProxy(url)
+
+	proxy.Transport = &http.Transport{
+		DisableKeepAlives:  true,
+		DisableCompression: true,
+		// we are forcing the reverse proxy to go through our socket
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", fmt.Sprintf("/%s", ctxid))
+		},
+	}
 
-		// url does not really matter we are going through the socket anyway
-		url, _ := url.Parse("http://localhost:8080")
-		proxy := httputil.NewSingleHostReverseProxy(url)
-
-		proxy.Transport = &http.Transport{
-			DisableKeepAlives:  true,
-			DisableCompression: true,
-			// we are forcing the reverse proxy to go through our socket
-			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				return net.Dial("unix", fmt.Sprintf("/%s", ctxid))
-			},
-		}
+	proxy.FlushInterval = -1
 
-		proxy.FlushInterval = -1
+	proxy.ServeHTTP(w, r)
+}
 
-		proxy.ServeHTTP(w, r)
+// admit runs the checks a session has to pass before it is proxied,
+// if it did not it returns the close reason and the message for the user
+func admit(ctx context.Context, sess *session, breakGlass bool) (string, string, bool) {
+	if breakGlass {
+		if err := admitBreakGlass(sess); err != nil {
+			return "break-glass denied", err.Error() + "\n", false
+		}
+		return "", "", true
+	}
+	if err := admitExec(ctx, sess); err != nil {
+		return "exec denied", err.Error() + "\n", false
 	}
+	if err := admitSession(ctx, sess); err == errPolicyDenied {
+		return "denied by policy", httpPolicyDenied, false
+	} else if err != nil {
+		return "exec denied", err.Error() + "\n", false
+	}
+	return "", "", true
 }
 
 // execHandler is responsible for auditing exec request and allowing
@@ -195,14 +282,51 @@ func execHandler(w http.ResponseWriter, r *http.Request) {
 
 	canPass := canPass(admissionReview)
 
-	if admissionReview.Request.Kind.Kind == "PodExecOptions" {
+	// attaching to a shell is as good as an exec, so it has to
+	// go through rexec as well
+	switch kind := admissionReview.Request.Kind.Kind; {
+	case kind == "PodExecOptions" || kind == "PodAttachOptions":
 		response.Allowed = canPass
 		if !canPass {
+			verb := "exec"
+			if kind == "PodAttachOptions" {
+				verb = "attach"
+			}
+			response.Result = &metav1.Status{
+				Message: fmt.Sprintf("cannot use %s directly, use rexec plugin instead", verb),
+			}
+		} else if err := checkAdmissionExecRules(r.Context(), admissionReview); err != nil {
+			response.Allowed = false
 			response.Result = &metav1.Status{
-				Message: "cannot use exec directly, use rexec plugin instead",
+				Message: err.Error(),
+				Code:    http.StatusForbidden,
 			}
 		}
-	} else {
+	// port-forward reaches into pods as well, it only has to go
+	// through rexec with --deny-native-port-forward
+	case kind == "PodPortForwardOptions":
+		response.Allowed = canPass || !DenyNativePortForward
+		if !response.Allowed {
+			response.Result = &metav1.Status{
+				Message: "cannot use port-forward directly, use kubectl rexec port-forward instead",
+			}
+		} else if err := checkAdmissionExecRules(r.Context(), admissionReview); err != nil {
+			response.Allowed = false
+			response.Result = &metav1.Status{
+				Message: err.Error(),
+				Code:    http.StatusForbidden,
+			}
+		}
+	// ephemeral containers can run anything and be attached to
+	// right away, so they are only added through rexec
+	case admissionReview.Request.SubResource == "ephemeralcontainers":
+		response.Allowed = canPass
+		if !canPass {
+			response.Result = &metav1.Status{
+				Message: "cannot add ephemeral containers directly, use kubectl rexec debug instead",
+			}
+		}
+	default:
 		response.Allowed = true
 	}
 	admissionReview.Response = &response
@@ -216,22 +340,6 @@ func execHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(respBytes)
 }
 
-// waitForListener is checking whether the tcp forwarder
-// is ready or not, if it is not there after 5 secs
-// it bails
-func waitForListener(listener string) error {
-	// again, super lazy but it is fine for now
-	for i := 0; i < 5; i++ {
-		if proxyMap[listener] {
-			SysLogger.Debug().Msgf("socket became ready on try %d", i)
-			return nil
-		}
-		SysLogger.Debug().Msgf("waiting for socket on try %d", i)
-		time.Sleep(1 * time.Second)
-	}
-	return errors.New("socket was not ready in time")
-}
-
 // canPass checks whether the exec request is allowed
 // or not
 func canPass(rv admissionv1.AdmissionReview) bool {
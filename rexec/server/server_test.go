@@ -2,16 +2,30 @@ package server
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
 	admissionv1 "k8s.io/api/admission/v1"
 	authv1 "k8s.io/api/authentication/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // --- helpers ---
@@ -58,6 +72,130 @@ func makeAdmissionReview(kind, username string, extra map[string][]string) admis
 	}
 }
 
+// issueCert creates a certificate for cn, self signed if parent is nil
+func issueCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent = tmpl
+		parentKey = key
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+// setFrontProxy parses a configmap payload trusting ca and installs it for the test
+func setFrontProxy(t *testing.T, ca *x509.Certificate, allowedNames string) {
+	t.Helper()
+
+	old := frontProxy
+	t.Cleanup(func() { frontProxy = old })
+
+	config, err := parseFrontProxyConfig(map[string]string{
+		"requestheader-client-ca-file": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})),
+		"requestheader-allowed-names":  allowedNames,
+	})
+	if err != nil {
+		t.Fatalf("parse front proxy config: %v", err)
+	}
+	frontProxy = config
+}
+
+func serveFrontProxy(certs ...*x509.Certificate) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/apis/audit.adyen.internal/v1beta1", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: certs}
+	rr := httptest.NewRecorder()
+	requireFrontProxy(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(rr, req)
+	return rr
+}
+
+// --- front proxy tests ---
+
+func TestParseFrontProxyConfigMissingCA(t *testing.T) {
+	if _, err := parseFrontProxyConfig(map[string]string{}); err == nil {
+		t.Fatal("expected error for missing requestheader-client-ca-file")
+	}
+}
+
+func TestRequireFrontProxyNoCert(t *testing.T) {
+	ca, _ := issueCert(t, "front-proxy-ca", nil, nil)
+	setFrontProxy(t, ca, `["front-proxy-client"]`)
+
+	if rr := serveFrontProxy(); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRequireFrontProxyAllowedName(t *testing.T) {
+	ca, caKey := issueCert(t, "front-proxy-ca", nil, nil)
+	setFrontProxy(t, ca, `["front-proxy-client"]`)
+
+	client, _ := issueCert(t, "front-proxy-client", ca, caKey)
+	if rr := serveFrontProxy(client); rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	other, _ := issueCert(t, "someone-else", ca, caKey)
+	if rr := serveFrontProxy(other); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d for not allowed name", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRequireFrontProxyUntrustedCA(t *testing.T) {
+	ca, _ := issueCert(t, "front-proxy-ca", nil, nil)
+	setFrontProxy(t, ca, "")
+
+	rogueCA, rogueKey := issueCert(t, "rogue-ca", nil, nil)
+	client, _ := issueCert(t, "front-proxy-client", rogueCA, rogueKey)
+	if rr := serveFrontProxy(client); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRemoteUserConfiguredHeaders(t *testing.T) {
+	old := frontProxy
+	t.Cleanup(func() { frontProxy = old })
+	frontProxy = &frontProxyConfig{
+		usernameHeaders: []string{"X-Custom-User"},
+		groupHeaders:    []string{"X-Custom-Group"},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Remote-User", "mallory")
+	req.Header.Set("X-Custom-User", "lauren")
+	req.Header.Add("X-Custom-Group", "devs")
+
+	if user := remoteUser(req); user != "lauren" {
+		t.Fatalf("remoteUser = %q, want %q", user, "lauren")
+	}
+	if groups := remoteGroups(req); len(groups) != 1 || groups[0] != "devs" {
+		t.Fatalf("remoteGroups = %v, want [devs]", groups)
+	}
+}
+
 // --- execHandler tests ---
 
 func TestExecHandlerUnsupportedContentType(t *testing.T) {
@@ -159,6 +297,40 @@ func TestExecHandlerExecDenied(t *testing.T) {
 	}
 }
 
+func TestExecHandlerAttach(t *testing.T) {
+	oldSauce := SecretSauce
+	t.Cleanup(func() { SecretSauce = oldSauce })
+	SecretSauce = "the-right-sauce"
+	setExecRules(t, "rules:\n- allowTTY: false\n")
+
+	ar := makeAdmissionReview("PodAttachOptions", "lauren", nil)
+	_, parsed := postExecHandler(t, ar, "application/json")
+	if parsed.Response == nil || parsed.Response.Allowed {
+		t.Fatalf("expected Allowed=false, got: %+v", parsed.Response)
+	}
+	if parsed.Response.Result == nil || parsed.Response.Result.Message != "cannot use attach directly, use rexec plugin instead" {
+		t.Fatalf("unexpected denial message: %+v", parsed.Response.Result)
+	}
+
+	// the exec rules apply to attach as well
+	options, _ := json.Marshal(map[string]any{"kind": "PodAttachOptions", "stdin": true, "tty": true})
+	ar = makeAdmissionReview("PodAttachOptions", "lauren", map[string][]string{
+		"secret-sauce": {"the-right-sauce"},
+	})
+	ar.Request.Object = runtime.RawExtension{Raw: options}
+	_, parsed = postExecHandler(t, ar, "application/json")
+	if parsed.Response == nil || parsed.Response.Allowed {
+		t.Fatalf("expected Allowed=false for a tty attach, got: %+v", parsed.Response)
+	}
+
+	options, _ = json.Marshal(map[string]any{"kind": "PodAttachOptions", "stdout": true})
+	ar.Request.Object = runtime.RawExtension{Raw: options}
+	_, parsed = postExecHandler(t, ar, "application/json")
+	if parsed.Response == nil || !parsed.Response.Allowed {
+		t.Fatalf("expected Allowed=true, got: %+v", parsed.Response)
+	}
+}
+
 // --- canPass unit tests ---
 
 func TestCanPassBypassUser(t *testing.T) {
@@ -210,29 +382,6 @@ func TestCanPassNoMatch(t *testing.T) {
 	}
 }
 
-// --- waitForListener unit test ---
-
-func TestWaitForListenerReady(t *testing.T) {
-	// Save/restore shared map
-	oldProxyMap := proxyMap
-	t.Cleanup(func() { proxyMap = oldProxyMap })
-
-	// Use a fresh map for isolation
-	proxyMap = map[string]bool{}
-
-	// Mark ready before call so it should return quickly
-	id := "session-123"
-	proxyMap[id] = true
-
-	start := time.Now()
-	if err := waitForListener(id); err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-	if time.Since(start) > time.Second {
-		t.Fatalf("waitForListener returned too slowly")
-	}
-}
-
 // --- rexecHandler early validation test ---
 
 func TestRexecHandlerMissingUser(t *testing.T) {
@@ -252,3 +401,171 @@ func TestRexecHandlerMissingUser(t *testing.T) {
 		t.Fatalf("status = %d, want %d", rr.Code, http.StatusForbidden)
 	}
 }
+
+// --- castRecorder unit test ---
+
+func TestCastRecorder(t *testing.T) {
+	oldDir := RecordingDir
+	t.Cleanup(func() { RecordingDir = oldDir })
+	RecordingDir = t.TempDir()
+
+	recorder, err := newCastRecorder("ns", "session-123", "lauren@ns/pod", "bash")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	recorder.resize(120, 40)
+	recorder.input([]byte("ls\r"))
+	// a multibyte character split between two frames
+	recorder.output([]byte("caf\xc3"))
+	recorder.output([]byte("\xa9\r\n"))
+	recorder.resize(100, 30)
+	recorder.Close()
+
+	raw, err := os.ReadFile(filepath.Join(RecordingDir, "ns", "session-123.cast"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("got %d lines, want 5:\n%s", len(lines), raw)
+	}
+
+	header := castHeader{}
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatalf("unmarshal header: %v", err)
+	}
+	if header.Version != 2 || header.Width != 120 || header.Height != 40 || header.Command != "bash" {
+		t.Fatalf("unexpected header: %+v", header)
+	}
+
+	want := [][2]string{{"i", "ls\r"}, {"o", "caf"}, {"o", "é\r\n"}, {"r", "100x30"}}
+	for i, w := range want {
+		var event []interface{}
+		if err := json.Unmarshal([]byte(lines[i+1]), &event); err != nil {
+			t.Fatalf("unmarshal event: %v", err)
+		}
+		if event[1] != w[0] || event[2] != w[1] {
+			t.Fatalf("event %d = %v, want %v", i, event, w)
+		}
+	}
+}
+
+func TestPruneRecordings(t *testing.T) {
+	oldDir, oldRetention, oldRecorders := RecordingDir, RecordingRetention, recorderMap
+	t.Cleanup(func() { RecordingDir, RecordingRetention, recorderMap = oldDir, oldRetention, oldRecorders })
+	RecordingDir = t.TempDir()
+	RecordingRetention = 24 * time.Hour
+	recorderMap = map[string]*castRecorder{"running": nil}
+
+	now := time.Now()
+	for name, age := range map[string]time.Duration{"old": 48 * time.Hour, "new": time.Hour, "running": 48 * time.Hour} {
+		path := filepath.Join(RecordingDir, "ns", name+".cast")
+		os.MkdirAll(filepath.Dir(path), 0700)
+		os.WriteFile(path, []byte("{}\n"), 0600)
+		os.Chtimes(path, now.Add(-age), now.Add(-age))
+	}
+	pruneRecordings(now)
+	for name, kept := range map[string]bool{"old": false, "new": true, "running": true} {
+		_, err := os.Stat(filepath.Join(RecordingDir, "ns", name+".cast"))
+		if (err == nil) != kept {
+			t.Errorf("%s: got %v, want kept=%v", name, err, kept)
+		}
+	}
+}
+
+// --- session unit test ---
+
+func TestSessionEvents(t *testing.T) {
+	oldLogger := auditLogger
+	t.Cleanup(func() { auditLogger = oldLogger })
+	var buf bytes.Buffer
+	auditLogger = zerolog.New(&buf)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1, 10.0.0.2")
+	req.Header.Set("User-Agent", "kubectl/v1.33.0")
+	params := url.Values{
+		"container": {"app"},
+		"command":   {"bash", "-l"},
+		"tty":       {"true"},
+		"stdin":     {"true"},
+		"stdout":    {"true"},
+	}
+
+	sess := newSession("session-123", req, "lauren", []string{"devs"}, "ns", "pod", "exec", params)
+	sess.logStart()
+	sess.bytesIn.Add(10)
+	sess.bytesOut.Add(20)
+	sess.setCloseReason("client closed the connection")
+	sess.end("request finished")
+	sess.end("request finished")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d events, want 2:\n%s", len(lines), buf.String())
+	}
+
+	start := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &start); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	want := map[string]interface{}{
+		"event":       "session_start",
+		"session":     "session-123",
+		"user":        "lauren",
+		"namespace":   "ns",
+		"pod":         "pod",
+		"container":   "app",
+		"subresource": "exec",
+		"command":     "bash -l",
+		"tty":         true,
+		"stdin":       true,
+		"stderr":      false,
+		"source_ip":   "10.0.0.2",
+		"user_agent":  "kubectl/v1.33.0",
+	}
+	for key, value := range want {
+		if start[key] != value {
+			t.Fatalf("session_start %s = %v, want %v", key, start[key], value)
+		}
+	}
+
+	end := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[1]), &end); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if end["event"] != "session_end" || end["bytes_in"] != float64(10) || end["bytes_out"] != float64(20) ||
+		end["close_reason"] != "client closed the connection" || end["pod"] != "pod" {
+		t.Fatalf("unexpected session_end: %v", end)
+	}
+}
+
+func TestSessionExitStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		exitCode *int
+		reason   string
+	}{
+		{"success", `{"metadata":{},"status":"Success"}`, intPtr(0), ""},
+		{"non zero", `{"metadata":{},"status":"Failure","message":"command terminated with non-zero exit code: error executing command [false], exit code 2","reason":"NonZeroExitCode","details":{"causes":[{"reason":"ExitCode","message":"2"}]}}`, intPtr(2), "NonZeroExitCode"},
+		{"internal error", `{"metadata":{},"status":"Failure","message":"executable file not found","reason":"InternalError"}`, nil, "InternalError"},
+		{"plain text", `something went wrong`, nil, "Unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess := &session{}
+			sess.setExitStatus([]byte(tt.payload))
+			if (sess.exitCode == nil) != (tt.exitCode == nil) || (sess.exitCode != nil && *sess.exitCode != *tt.exitCode) {
+				t.Fatalf("exitCode = %v, want %v", sess.exitCode, tt.exitCode)
+			}
+			if sess.exitReason != tt.reason {
+				t.Fatalf("exitReason = %q, want %q", sess.exitReason, tt.reason)
+			}
+		})
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/remotecommand"
+)
+
+// session holds what we know about an exec session, the metadata
+// is attached to its logger so every audit event carries it and
+// nobody has to join events on the session id
+type session struct {
+	id        string
+	user      string
+	groups    []string
+	namespace string
+	pod       string
+	container string
+	// exec, attach or portforward
+	subresource string
+	command     []string
+	tty         bool
+	stdin       bool
+	stdout      bool
+	stderr      bool
+	sourceIP    string
+	userAgent   string
+	start       time.Time
+	logger      zerolog.Logger
+	// remote ports a port-forward asked for, the client sends them
+	// so they only tell what was meant to be used
+	requestedPorts []string
+
+	// why the user opened the session and the ticket it belongs to
+	reason string
+	ticket string
+	// the exec request letting the user in and when it runs out
+	approval        string
+	approvalExpires time.Time
+	// the checks were skipped and everything is audited
+	breakGlass bool
+	// limits of the session, zero if there are none
+	maxDuration time.Duration
+	idleTimeout time.Duration
+	// when the user last sent something, in unix nanoseconds
+	lastInput atomic.Int64
+
+	// bytes sent by the user toward the container and back
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	mu          sync.Mutex
+	closeReason string
+	exitCode    *int
+	exitReason  string
+	exitMessage string
+	// a private key is being pasted line by line
+	privateKey bool
+	// what was sent to the stdin of a command without a tty
+	stdinCapture stdinCapture
+	endOnce      sync.Once
+
+	// labels of the pod, only fetched once a policy rule needs them,
+	// the admission and then the input goroutine are the only users
+	podLabels map[string]string
+	// the connection carrying the session and the messages
+	// for the user waiting for it
+	conn    *TCPLogger
+	notices []string
+	// how the session was told to go before its connection was there
+	closeMessage string
+	closeCode    uint16
+	closeText    string
+	// users watching the session live
+	shadow shadow
+	// the connections of a port-forward, nil for other sessions
+	forwards *portForwards
+}
+
+// newSession collects the metadata of an exec request
+func newSession(id string, r *http.Request, user string, groups []string, namespace, pod, subresource string, params url.Values) *session {
+	s := &session{
+		id:             id,
+		user:           user,
+		groups:         groups,
+		namespace:      namespace,
+		pod:            pod,
+		subresource:    subresource,
+		container:      params.Get("container"),
+		command:        params["command"],
+		requestedPorts: params["ports"],
+		tty:            boolParam(params, "tty"),
+		stdin:          boolParam(params, "stdin"),
+		stdout:         boolParam(params, "stdout"),
+		stderr:         boolParam(params, "stderr"),
+		sourceIP:       sourceIP(r),
+		userAgent:      r.UserAgent(),
+		reason:         cleanReason(params.Get(reasonParam)),
+		ticket:         params.Get(ticketParam),
+		start:          time.Now(),
+	}
+	s.lastInput.Store(s.start.UnixNano())
+	if subresource == "portforward" {
+		s.forwards = newPortForwards()
+	}
+	logger := auditLogger.With().
+		Str("session", s.id).
+		Str("user", s.user).
+		Strs("groups", s.groups).
+		Str("namespace", s.namespace).
+		Str("pod", s.pod).
+		Str("container", s.container).
+		Str("subresource", s.subresource).
+		Bool("tty", s.tty).
+		Bool("stdin", s.stdin).
+		Bool("stdout", s.stdout).
+		Bool("stderr", s.stderr).
+		Str("source_ip", s.sourceIP).
+		Str("user_agent", s.userAgent)
+	if s.reason != "" {
+		logger = logger.Str("justification", s.reason)
+	}
+	if s.ticket != "" {
+		logger = logger.Str("ticket", s.ticket)
+	}
+	s.logger = logger.Logger()
+	return s
+}
+
+// logStart emits the session_start event, a port-forward names the
+// ports it asked for instead
+func (s *session) logStart() {
+	if s.forwards != nil {
+		s.logger.Info().Str("event", "port_forward_start").Strs("requested_ports", s.requestedPorts).Msg("")
+		return
+	}
+	s.logger.Info().Str("event", "session_start").Str("command", redact(strings.Join(s.command, " "))).Msg("")
+}
+
+// setCloseReason records why the session ended, the first reason wins
+// as closing one side of the connection will close the other as well
+func (s *session) setCloseReason(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closeReason == "" {
+		s.closeReason = reason
+	}
+}
+
+// end emits the session_end event, only the first call does anything
+func (s *session) end(reason string) {
+	s.endOnce.Do(func() {
+		s.setCloseReason(reason)
+		s.endWatch()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.logStdin()
+		if s.forwards != nil {
+			s.forwards.log(s, time.Now())
+		}
+		event := s.logger.Info().
+			Str("event", "session_end").
+			Int64("duration_ms", time.Since(s.start).Milliseconds()).
+			Int64("bytes_in", s.bytesIn.Load()).
+			Int64("bytes_out", s.bytesOut.Load()).
+			Str("close_reason", s.closeReason)
+		// the exit status is only known if the container
+		// sent one before the connection went away
+		if s.exitCode != nil {
+			event = event.Int("exit_code", *s.exitCode)
+		}
+		if s.exitReason != "" {
+			event = event.Str("exit_reason", s.exitReason).Str("exit_message", s.exitMessage)
+		}
+		event.Msg("")
+	})
+}
+
+// setExitStatus decodes the metav1.Status the apiserver sends on the
+// error stream once the remote process is gone
+func (s *session) setExitStatus(payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := metav1.Status{}
+	err := json.Unmarshal(payload, &status)
+	if err != nil {
+		// older protocols send the error as plain text
+		s.exitReason = "Unknown"
+		s.exitMessage = string(payload)
+		return
+	}
+
+	if status.Status == metav1.StatusSuccess {
+		exitCode := 0
+		s.exitCode = &exitCode
+		return
+	}
+
+	s.exitReason = string(status.Reason)
+	s.exitMessage = status.Message
+	if status.Details == nil {
+		return
+	}
+	for _, cause := range status.Details.Causes {
+		if cause.Type != remotecommand.ExitCodeCauseType {
+			continue
+		}
+		exitCode, err := strconv.Atoi(cause.Message)
+		if err == nil {
+			s.exitCode = &exitCode
+		}
+	}
+}
+
+// attach connects the session with the connection carrying it
+func (s *session) attach(conn *TCPLogger) {
+	s.mu.Lock()
+	s.conn = conn
+	notices := s.notices
+	s.notices = nil
+	closing := s.closeReason != ""
+	message, code, text := s.closeMessage, s.closeCode, s.closeText
+	s.mu.Unlock()
+	for _, notice := range notices {
+		conn.notify(notice)
+	}
+	// a session closed before its connection came does not get to run
+	if closing {
+		conn.terminate(message, code, text)
+	}
+}
+
+// notify shows a message to the user, before the connection is
+// there it is kept until it is
+func (s *session) notify(message string) {
+	s.mu.Lock()
+	conn := s.conn
+	if conn == nil {
+		s.notices = append(s.notices, message)
+	}
+	s.mu.Unlock()
+	if conn != nil {
+		conn.notify(message)
+	}
+}
+
+// terminate shows a message to the user and ends the session
+func (s *session) terminate(message, reason string) {
+	s.close(message, reason, wsClosePolicyViolation, "policy violation")
+}
+
+// timeout shows a message to the user and ends a session which ran
+// out of time, unlike terminate this is a normal closure
+func (s *session) timeout(message, reason string) {
+	s.close(message, reason, wsCloseNormal, reason)
+}
+
+func (s *session) close(message, reason string, code uint16, text string) {
+	// the reason and the connection are looked at together, so
+	// attach either sees the reason or close sees the connection
+	s.mu.Lock()
+	if s.closeReason == "" {
+		s.closeReason = reason
+	}
+	conn := s.conn
+	if conn == nil && s.closeMessage == "" {
+		s.closeMessage, s.closeCode, s.closeText = message, code, text
+	}
+	s.mu.Unlock()
+	if conn != nil {
+		conn.terminate(message, code, text)
+	}
+}
+
+// closing tells whether the session was already told to go
+func (s *session) closing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeReason != ""
+}
+
+// touch notes that the user did something
+func (s *session) touch() {
+	s.lastInput.Store(time.Now().UnixNano())
+}
+
+// boolParam checks whether a query parameter was set to true
+func boolParam(params url.Values, key string) bool {
+	value, err := strconv.ParseBool(params.Get(key))
+	return err == nil && value
+}
+
+// sourceIP takes the address of the user from X-Forwarded-For set by
+// the kube apiserver, falling back to the address of the connection
+func sourceIP(r *http.Request) string {
+	// the client can send its own X-Forwarded-For, only the entry the
+	// kube apiserver appended, the last one, can be trusted
+	if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		forwarded := values[len(values)-1]
+		if last := strings.TrimSpace(forwarded[strings.LastIndex(forwarded, ",")+1:]); last != "" {
+			return last
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	sessionAPIVersion = "audit.adyen.internal/v1beta1"
+	sessionResource   = "execsessions"
+)
+
+// execSession shows a live session through the rexec api
+type execSession struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              execSessionSpec   `json:"spec"`
+	Status            execSessionStatus `json:"status"`
+}
+
+type execSessionSpec struct {
+	User           string   `json:"user"`
+	Groups         []string `json:"groups,omitempty"`
+	Pod            string   `json:"pod"`
+	Container      string   `json:"container,omitempty"`
+	Command        string   `json:"command,omitempty"`
+	TTY            bool     `json:"tty"`
+	RequestedPorts []string `json:"requestedPorts,omitempty"`
+	SourceIP       string   `json:"sourceIP,omitempty"`
+	Justification  string   `json:"justification,omitempty"`
+	Ticket         string   `json:"ticket,omitempty"`
+	ExecRequest    string   `json:"execRequest,omitempty"`
+	BreakGlass     bool     `json:"breakGlass,omitempty"`
+}
+
+type execSessionStatus struct {
+	StartTime    metav1.Time `json:"startTime"`
+	LastActivity metav1.Time `json:"lastActivity"`
+	// bytes sent by the user toward the container and back
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+}
+
+type execSessionList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []execSession `json:"items"`
+}
+
+// object shows a session the way the api returns it
+func (s *session) object() execSession {
+	start := metav1.NewTime(s.start)
+	return execSession{
+		TypeMeta: metav1.TypeMeta{APIVersion: sessionAPIVersion, Kind: "ExecSession"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              s.id,
+			Namespace:         s.namespace,
+			CreationTimestamp: start,
+		},
+		Spec: execSessionSpec{
+			User:           s.user,
+			Groups:         s.groups,
+			Pod:            s.pod,
+			Container:      s.container,
+			Command:        redact(strings.Join(s.command, " ")),
+			TTY:            s.tty,
+			RequestedPorts: s.requestedPorts,
+			SourceIP:       s.sourceIP,
+			Justification:  s.reason,
+			Ticket:         s.ticket,
+			ExecRequest:    s.approval,
+			BreakGlass:     s.breakGlass,
+		},
+		Status: execSessionStatus{
+			StartTime:    start,
+			LastActivity: metav1.NewTime(time.Unix(0, s.lastInput.Load())),
+			BytesIn:      s.bytesIn.Load(),
+			BytesOut:     s.bytesOut.Load(),
+		},
+	}
+}
+
+// liveSessions returns the sessions of a namespace, or of all of them
+func liveSessions(namespace string) []*session {
+	mapSync.Lock()
+	defer mapSync.Unlock()
+	var sessions []*session
+	for _, sess := range sessionMap {
+		if namespace == "" || sess.namespace == namespace {
+			sessions = append(sessions, sess)
+		}
+	}
+	slices.SortFunc(sessions, func(a, b *session) int { return a.start.Compare(b.start) })
+	return sessions
+}
+
+// lookupSession returns a live session of a namespace, or nil
+func lookupSession(namespace, id string) *session {
+	mapSync.Lock()
+	defer mapSync.Unlock()
+	sess := sessionMap[id]
+	if sess == nil || sess.namespace != namespace {
+		return nil
+	}
+	return sess
+}
+
+// accessReview asks whether the caller may act on sessions, watching
+// and replaying are subresources so reading a session is not enough
+func accessReview(r *http.Request, verb, namespace, name, subresource string) authorizationv1.SubjectAccessReview {
+	return authorizationv1.SubjectAccessReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "authorization.k8s.io/v1", Kind: "SubjectAccessReview"},
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   remoteUser(r),
+			Groups: remoteGroups(r),
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Group:       "audit.adyen.internal",
+				Version:     "v1beta1",
+				Resource:    sessionResource,
+				Subresource: subresource,
+				Verb:        verb,
+				Namespace:   namespace,
+				Name:        name,
+			},
+		},
+	}
+}
+
+// authorized asks the kube apiserver whether the caller may do what they
+// are up to with the sessions, on top of the check of the aggregation layer
+func authorized(ctx context.Context, r *http.Request, verb, namespace, name, subresource string) (bool, error) {
+	review := accessReview(r, verb, namespace, name, subresource)
+	err := kubeRequest(ctx, http.MethodPost, "/apis/authorization.k8s.io/v1/subjectaccessreviews", review, &review)
+	if err != nil {
+		return false, err
+	}
+	return review.Status.Allowed, nil
+}
+
+// authorize answers the request itself if the caller may not go on
+func authorize(w http.ResponseWriter, r *http.Request, verb, namespace, name, subresource string) bool {
+	if remoteUser(r) == "" {
+		writeStatus(w, http.StatusForbidden, "no user found")
+		return false
+	}
+	allowed, err := authorized(r.Context(), r, verb, namespace, name, subresource)
+	if err != nil {
+		SysLogger.Error().Err(err).Msg("failed to review access to the sessions")
+		writeStatus(w, http.StatusInternalServerError, "failed to check access")
+		return false
+	}
+	if !allowed {
+		resource := sessionResource
+		if subresource != "" {
+			resource = fmt.Sprintf("%s/%s", sessionResource, subresource)
+		}
+		writeStatus(w, http.StatusForbidden, fmt.Sprintf("%s cannot %s %s", remoteUser(r), verb, resource))
+		return false
+	}
+	return true
+}
+
+// sessionListHandler lists the live sessions of this replica
+func sessionListHandler(w http.ResponseWriter, r *http.Request) {
+	namespace := mux.Vars(r)["namespace"]
+	if !authorize(w, r, "list", namespace, "", "") {
+		return
+	}
+	list := execSessionList{
+		TypeMeta: metav1.TypeMeta{APIVersion: sessionAPIVersion, Kind: "ExecSessionList"},
+		Items:    []execSession{},
+	}
+	for _, sess := range liveSessions(namespace) {
+		list.Items = append(list.Items, sess.object())
+	}
+	writeSessions(w, r, list.Items, list)
+}
+
+// sessionGetHandler shows one live session
+func sessionGetHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !authorize(w, r, "get", vars["namespace"], vars["name"], "") {
+		return
+	}
+	sess := lookupSession(vars["namespace"], vars["name"])
+	if sess == nil {
+		writeStatus(w, http.StatusNotFound, fmt.Sprintf("session %s not found", vars["name"]))
+		return
+	}
+	object := sess.object()
+	writeSessions(w, r, []execSession{object}, object)
+}
+
+// sessionDeleteHandler closes a live session, the user gets a message
+// and both the forwarder and the upstream connection are torn down
+func sessionDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !authorize(w, r, "delete", vars["namespace"], vars["name"], "") {
+		return
+	}
+	sess := lookupSession(vars["namespace"], vars["name"])
+	if sess == nil {
+		writeStatus(w, http.StatusNotFound, fmt.Sprintf("session %s not found", vars["name"]))
+		return
+	}
+	admin := remoteUser(r)
+	sess.logger.Warn().Str("event", "session_terminated").Str("by", admin).Msg("")
+	sess.terminate("rexec terminated the session: it was closed by an administrator", fmt.Sprintf("terminated by %s", admin))
+	writeObject(w, http.StatusOK, metav1.Status{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Status"},
+		Status:   metav1.StatusSuccess,
+		Details:  &metav1.StatusDetails{Name: sess.id, Group: "audit.adyen.internal", Kind: sessionResource},
+	})
+}
+
+// writeSessions answers with a table if kubectl asked for one, so
+// kubectl get shows the interesting columns
+func writeSessions(w http.ResponseWriter, r *http.Request, sessions []execSession, object interface{}) {
+	if !strings.Contains(r.Header.Get("Accept"), "as=Table") {
+		writeObject(w, http.StatusOK, object)
+		return
+	}
+	table := metav1.Table{
+		TypeMeta: metav1.TypeMeta{APIVersion: "meta.k8s.io/v1", Kind: "Table"},
+		ColumnDefinitions: []metav1.TableColumnDefinition{
+			{Name: "Name", Type: "string", Format: "name"},
+			{Name: "User", Type: "string"},
+			{Name: "Pod", Type: "string"},
+			{Name: "Started", Type: "string", Format: "date-time"},
+			{Name: "Last Activity", Type: "string", Format: "date-time"},
+			{Name: "Bytes In", Type: "integer"},
+			{Name: "Bytes Out", Type: "integer"},
+			{Name: "Command", Type: "string", Priority: 1},
+		},
+		Rows: []metav1.TableRow{},
+	}
+	for _, sess := range sessions {
+		// kubectl only needs the metadata of the rows
+		meta, err := json.Marshal(metav1.PartialObjectMetadata{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "meta.k8s.io/v1", Kind: "PartialObjectMetadata"},
+			ObjectMeta: sess.ObjectMeta,
+		})
+		if err != nil {
+			writeStatus(w, http.StatusInternalServerError, "failed to encode the sessions")
+			return
+		}
+		table.Rows = append(table.Rows, metav1.TableRow{
+			Cells: []interface{}{
+				sess.Name,
+				sess.Spec.User,
+				sess.Spec.Pod,
+				sess.Status.StartTime.UTC().Format(time.RFC3339),
+				sess.Status.LastActivity.UTC().Format(time.RFC3339),
+				sess.Status.BytesIn,
+				sess.Status.BytesOut,
+				sess.Spec.Command,
+			},
+			Object: runtime.RawExtension{Raw: meta},
+		})
+	}
+	writeObject(w, http.StatusOK, table)
+}
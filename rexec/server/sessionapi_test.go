@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func setSessions(t *testing.T, sessions ...*session) {
+	oldSessions := sessionMap
+	t.Cleanup(func() { sessionMap = oldSessions })
+	sessionMap = map[string]*session{}
+	for _, sess := range sessions {
+		sessionMap[sess.id] = sess
+	}
+}
+
+func TestLiveSessions(t *testing.T) {
+	setRedactPatterns(t)
+	now := time.Now()
+	first := &session{id: "first", user: "lauren", namespace: "prod", pod: "db-0", command: []string{"psql", "password=hunter2"}, start: now.Add(-time.Hour)}
+	first.lastInput.Store(now.UnixNano())
+	first.bytesIn.Add(10)
+	first.requestedPorts = []string{"5432"}
+	second := &session{id: "second", user: "bob", namespace: "prod", start: now}
+	other := &session{id: "other", user: "bob", namespace: "dev", start: now}
+	setSessions(t, second, other, first)
+
+	sessions := liveSessions("prod")
+	if len(sessions) != 2 || sessions[0] != first || sessions[1] != second {
+		t.Fatalf("unexpected sessions: %v", sessions)
+	}
+	if len(liveSessions("")) != 3 {
+		t.Fatal("listing all namespaces missed sessions")
+	}
+	if lookupSession("dev", "first") != nil || lookupSession("prod", "first") != first {
+		t.Fatal("sessions were looked up across namespaces")
+	}
+
+	object := first.object()
+	if object.Name != "first" || object.Namespace != "prod" || object.Spec.User != "lauren" || object.Status.BytesIn != 10 {
+		t.Fatalf("unexpected object: %+v", object)
+	}
+	if object.Spec.Command != "psql password=[REDACTED]" {
+		t.Fatalf("command was not redacted: %q", object.Spec.Command)
+	}
+	raw, err := json.Marshal(object)
+	if err != nil || !bytes.Contains(raw, []byte(`"requestedPorts":["5432"]`)) {
+		t.Fatalf("requested ports missing from %s: %v", raw, err)
+	}
+	if !object.Status.LastActivity.Time.Equal(time.Unix(0, now.UnixNano())) {
+		t.Fatalf("last activity = %s", object.Status.LastActivity)
+	}
+}
+
+func TestWriteSessionsTable(t *testing.T) {
+	sess := &session{id: "first", user: "lauren", namespace: "prod", pod: "db-0", start: time.Now()}
+	objects := []execSession{sess.object()}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/json;as=Table;v=v1;g=meta.k8s.io,application/json")
+	rr := httptest.NewRecorder()
+	writeSessions(rr, req, objects, nil)
+
+	table := metav1.Table{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &table); err != nil {
+		t.Fatalf("unmarshal: %v\nbody: %s", err, rr.Body.String())
+	}
+	if table.Kind != "Table" || len(table.Rows) != 1 || table.Rows[0].Cells[1] != "lauren" || table.Rows[0].Cells[2] != "db-0" {
+		t.Fatalf("unexpected table: %+v", table)
+	}
+	meta := metav1.PartialObjectMetadata{}
+	if err := json.Unmarshal(table.Rows[0].Object.Raw, &meta); err != nil || meta.Name != "first" {
+		t.Fatalf("unexpected row object: %s %v", table.Rows[0].Object.Raw, err)
+	}
+}
+
+func TestSessionHandlersNeedUser(t *testing.T) {
+	for _, handler := range []http.HandlerFunc{sessionListHandler, sessionGetHandler, sessionDeleteHandler} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = mux.SetURLVars(req, map[string]string{"namespace": "prod", "name": "first"})
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("status = %d, want %d", rr.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestAccessReviewSubresource(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, subresource := range []string{"", "attach", "recording"} {
+		attributes := accessReview(req, "get", "prod", "7d3c", subresource).Spec.ResourceAttributes
+		if attributes.Resource != sessionResource || attributes.Subresource != subresource || attributes.Name != "7d3c" {
+			t.Errorf("unexpected attributes for %q: %+v", subresource, attributes)
+		}
+	}
+}
+
+func TestTerminateBeforeAttach(t *testing.T) {
+	var buf bytes.Buffer
+	sess := &session{id: "early", user: "lauren", namespace: "prod", pod: "db-0", logger: zerolog.New(&buf)}
+	// the delete came in before the connection of the session did
+	sess.terminate("rexec terminated the session: it was closed by an administrator", "terminated by alice")
+
+	client, user := net.Pipe()
+	upstream, kube := net.Pipe()
+	t.Cleanup(func() {
+		user.Close()
+		kube.Close()
+	})
+	sess.attach(&TCPLogger{Conn: upstream, ctxid: sess.id, session: sess, client: client})
+	if _, err := user.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("client connection is still open: %v", err)
+	}
+	if _, err := kube.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("upstream connection is still open: %v", err)
+	}
+	if sess.closeReason != "terminated by alice" {
+		t.Fatalf("unexpected close reason %q", sess.closeReason)
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// events a watcher may fall behind by before it is dropped, the session
+// itself never waits for its watchers
+const watcherBuffer = 1024
+
+// watcher is a user shadowing a tty session, it receives the session
+// as asciinema v2 lines, the header first
+type watcher struct {
+	user   string
+	events chan []byte
+}
+
+// shadow fans both directions of a tty session out to its watchers
+type shadow struct {
+	mu       sync.Mutex
+	watchers map[*watcher]bool
+	ended    bool
+	// the last terminal size, watchers joining late need it
+	width  int
+	height int
+	// bytes of multibyte characters split between two frames
+	pending map[string][]byte
+}
+
+// watch adds a watcher to the session and lets the user know, it
+// returns nil once the session is over
+func (s *session) watch(user string) *watcher {
+	s.shadow.mu.Lock()
+	if s.shadow.ended {
+		s.shadow.mu.Unlock()
+		return nil
+	}
+	if s.shadow.watchers == nil {
+		s.shadow.watchers = make(map[*watcher]bool)
+		s.shadow.pending = make(map[string][]byte)
+	}
+	w := &watcher{user: user, events: make(chan []byte, watcherBuffer)}
+	w.events <- s.castHeader()
+	s.shadow.watchers[w] = true
+	s.shadow.mu.Unlock()
+
+	s.logger.Info().Str("event", "watch_start").Str("watcher", user).Msg("")
+	s.notify(fmt.Sprintf("rexec: %s is watching this session", user))
+	return w
+}
+
+// unwatch removes a watcher which went away by itself
+func (s *session) unwatch(w *watcher) {
+	s.shadow.mu.Lock()
+	defer s.shadow.mu.Unlock()
+	s.dropWatcher(w, "watcher left")
+}
+
+// dropWatcher closes the events of a watcher, shadow.mu has to be held
+func (s *session) dropWatcher(w *watcher, reason string) {
+	if !s.shadow.watchers[w] {
+		return
+	}
+	delete(s.shadow.watchers, w)
+	close(w.events)
+	s.logger.Info().Str("event", "watch_end").Str("watcher", w.user).Str("reason", reason).Msg("")
+	if !s.shadow.ended {
+		// notify takes the locks of the connection, which may be
+		// busy passing on the very output being broadcast
+		go s.notify(fmt.Sprintf("rexec: %s stopped watching this session", w.user))
+	}
+}
+
+// endWatch lets the watchers go once the session is over
+func (s *session) endWatch() {
+	s.shadow.mu.Lock()
+	defer s.shadow.mu.Unlock()
+	s.shadow.ended = true
+	for w := range s.shadow.watchers {
+		s.dropWatcher(w, "session ended")
+	}
+}
+
+// broadcast sends input or output to the watchers
+func (s *session) broadcast(kind string, data []byte) {
+	s.shadow.mu.Lock()
+	defer s.shadow.mu.Unlock()
+	if len(s.shadow.watchers) == 0 {
+		return
+	}
+	data = append(s.shadow.pending[kind], data...)
+	cut := incompleteRuneStart(data)
+	s.shadow.pending[kind] = append([]byte(nil), data[cut:]...)
+	if cut > 0 {
+		s.sendEvent(kind, string(data[:cut]))
+	}
+}
+
+// broadcastResize sends a new terminal size to the watchers
+func (s *session) broadcastResize(width, height int) {
+	s.shadow.mu.Lock()
+	defer s.shadow.mu.Unlock()
+	s.shadow.width, s.shadow.height = width, height
+	if len(s.shadow.watchers) > 0 {
+		s.sendEvent("r", fmt.Sprintf("%dx%d", width, height))
+	}
+}
+
+// sendEvent queues an event for every watcher, shadow.mu has to be held
+func (s *session) sendEvent(kind, data string) {
+	line, err := json.Marshal([]interface{}{time.Since(s.start).Seconds(), kind, data})
+	if err != nil {
+		SysLogger.Error().Err(err).Msg("failed to encode cast event")
+		return
+	}
+	line = append(line, '\n')
+	for w := range s.shadow.watchers {
+		select {
+		case w.events <- line:
+		default:
+			s.dropWatcher(w, "watcher fell behind")
+		}
+	}
+}
+
+// castHeader describes the session for a watcher joining, shadow.mu
+// has to be held
+func (s *session) castHeader() []byte {
+	header := castHeader{
+		Version:   2,
+		Width:     s.shadow.width,
+		Height:    s.shadow.height,
+		Timestamp: s.start.Unix(),
+		Command:   redact(strings.Join(s.command, " ")),
+		Title:     fmt.Sprintf("%s@%s/%s", s.user, s.namespace, s.pod),
+		Env:       map[string]string{"TERM": "xterm"},
+	}
+	if header.Width == 0 || header.Height == 0 {
+		header.Width, header.Height = 80, 24
+	}
+	raw, _ := json.Marshal(header)
+	return append(raw, '\n')
+}
+
+// sessionWatchHandler streams a live session to a watcher, it is served
+// as the attach subresource as the kube apiserver does not time out
+// attach requests
+func sessionWatchHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !authorize(w, r, "get", vars["namespace"], vars["name"], "attach") {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeStatus(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	sess := lookupSession(vars["namespace"], vars["name"])
+	if sess == nil {
+		writeStatus(w, http.StatusNotFound, fmt.Sprintf("session %s not found", vars["name"]))
+		return
+	}
+	watcher := sess.watch(remoteUser(r))
+	if watcher == nil {
+		writeStatus(w, http.StatusNotFound, fmt.Sprintf("session %s not found", vars["name"]))
+		return
+	}
+	defer sess.unwatch(watcher)
+
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.WriteHeader(http.StatusOK)
+	for {
+		select {
+		case line, ok := <-watcher.events:
+			if !ok {
+				return
+			}
+			_, err := w.Write(line)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestSessionWatch(t *testing.T) {
+	var buf bytes.Buffer
+	sess := &session{id: "test", user: "lauren", namespace: "prod", pod: "db-0", command: []string{"bash"}, tty: true, start: time.Now(), logger: zerolog.New(&buf)}
+	sess.broadcastResize(120, 40)
+
+	w := sess.watch("bob")
+	header := castHeader{}
+	if err := json.Unmarshal(<-w.events, &header); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if header.Width != 120 || header.Height != 40 || header.Title != "lauren@prod/db-0" {
+		t.Fatalf("unexpected header: %+v", header)
+	}
+	if !strings.Contains(buf.String(), `"event":"watch_start","watcher":"bob"`) {
+		t.Fatalf("watch_start missing: %s", buf.String())
+	}
+
+	// a character split between two frames arrives in one piece
+	sess.broadcast("o", []byte("caf\xc3"))
+	sess.broadcast("o", []byte("\xa9"))
+	sess.broadcast("i", []byte("l"))
+	for _, want := range []string{"caf", "é", "l"} {
+		var event []interface{}
+		if err := json.Unmarshal(<-w.events, &event); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if event[2] != want {
+			t.Fatalf("event = %v, want %q", event, want)
+		}
+	}
+
+	sess.end("request finished")
+	if _, ok := <-w.events; ok {
+		t.Fatal("events were not closed at the end of the session")
+	}
+	if !strings.Contains(buf.String(), `"event":"watch_end","watcher":"bob","reason":"session ended"`) {
+		t.Fatalf("watch_end missing: %s", buf.String())
+	}
+	if sess.watch("alice") != nil {
+		t.Fatal("watched a session which is over")
+	}
+}
+
+func TestSessionWatcherFallsBehind(t *testing.T) {
+	var buf bytes.Buffer
+	sess := &session{id: "test", user: "lauren", tty: true, start: time.Now(), logger: zerolog.New(&buf)}
+	_, user := negotiatedLogger(t, sess)
+	notices := make(chan []byte, 2)
+	go func() {
+		for {
+			frame := make([]byte, 256)
+			n, err := user.Read(frame)
+			if err != nil {
+				return
+			}
+			notices <- frame[:n]
+		}
+	}()
+
+	w := sess.watch("bob")
+	messages, err := (&wsDecoder{}).feed(<-notices)
+	if err != nil || len(messages) != 1 || !strings.Contains(string(messages[0].Payload), "bob is watching this session") {
+		t.Fatalf("unexpected notice: %q %v", messages, err)
+	}
+	for i := 0; i <= watcherBuffer; i++ {
+		sess.broadcast("o", []byte("x"))
+	}
+	if !strings.Contains(buf.String(), `"reason":"watcher fell behind"`) {
+		t.Fatalf("slow watcher was not dropped: %s", buf.String())
+	}
+	messages, err = (&wsDecoder{}).feed(<-notices)
+	if err != nil || len(messages) != 1 || !strings.Contains(string(messages[0].Payload), "bob stopped watching this session") {
+		t.Fatalf("unexpected notice: %q %v", messages, err)
+	}
+	// the events already queued are still delivered
+	count := 0
+	for range w.events {
+		count++
+	}
+	if count != watcherBuffer {
+		t.Fatalf("got %d events, want %d", count, watcherBuffer)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// AuditSink receives every audit event as a single json encoded line,
+// all audit logging goes through auditLogger which fans out to the sinks
+type AuditSink interface {
+	zerolog.LevelWriter
+	io.Closer
+}
+
+var AuditSinks []string
+var AuditFilePath string
+var AuditFileMaxSize int
+var AuditFileMaxBackups int
+var AuditSyslogNetwork string
+var AuditSyslogAddress string
+var AuditHTTPURL string
+var AuditHTTPHeaders []string
+var AuditHTTPBatchSize int
+var AuditHTTPFlushInterval time.Duration
+var AuditHTTPRetries int
+var AuditHTTPBufferDir string
+var auditSinks []AuditSink
+
+// setupAuditSinks creates the sinks selected with --audit-sink
+func setupAuditSinks() ([]AuditSink, error) {
+	if len(AuditSinks) == 0 {
+		AuditSinks = []string{"stdout"}
+	}
+
+	var sinks []AuditSink
+	for _, name := range AuditSinks {
+		var sink AuditSink
+		var err error
+		switch name {
+		case "stdout":
+			sink = &stdoutSink{}
+		case "file":
+			sink, err = newFileSink(AuditFilePath, AuditFileMaxSize, AuditFileMaxBackups)
+		case "syslog":
+			sink, err = newSyslogSink(AuditSyslogNetwork, AuditSyslogAddress)
+		case "http":
+			sink, err = newHTTPSink(AuditHTTPURL, AuditHTTPHeaders, AuditHTTPBatchSize, AuditHTTPFlushInterval, AuditHTTPRetries, AuditHTTPBufferDir)
+		default:
+			err = fmt.Errorf("unknown audit sink %q", name)
+		}
+		if err != nil {
+			for _, sink := range sinks {
+				sink.Close()
+			}
+			return nil, fmt.Errorf("failed to setup %s audit sink: %w", name, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// closeAuditSinks flushes and closes all sinks, used on shutdown
+// so buffered events are not lost
+func closeAuditSinks() {
+	for _, sink := range auditSinks {
+		err := sink.Close()
+		if err != nil {
+			SysLogger.Error().Err(err).Msg("failed to close audit sink")
+		}
+	}
+}
+
+// stdoutSink is the default sink, writing events to the pod logs
+type stdoutSink struct{}
+
+func (s *stdoutSink) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (s *stdoutSink) WriteLevel(_ zerolog.Level, p []byte) (int, error) {
+	return s.Write(p)
+}
+
+func (s *stdoutSink) Close() error {
+	return nil
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestSetupAuditSinksUnknown(t *testing.T) {
+	old := AuditSinks
+	t.Cleanup(func() { AuditSinks = old })
+
+	AuditSinks = []string{"stdout", "carrier-pigeon"}
+	if _, err := setupAuditSinks(); err == nil {
+		t.Fatal("expected error for unknown sink")
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := newFileSink(path, 1, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer sink.Close()
+	// shrinking the limit so we do not need to write megabytes
+	sink.maxSize = 10
+
+	for _, event := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := sink.Write([]byte(event)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	want := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for file, content := range want {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(raw) != content {
+			t.Fatalf("%s = %q, want %q", file, raw, content)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expected only 2 backups to be kept")
+	}
+}
+
+func TestSyslogSinkFormat(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	sink, err := newSyslogSink("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer sink.Close()
+
+	if _, err := sink.WriteLevel(zerolog.WarnLevel, []byte(`{"user":"lauren"}`+"\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	msg := string(buf[:n])
+	// authpriv (10) * 8 + warning (4)
+	if !strings.HasPrefix(msg, "<84>1 ") {
+		t.Fatalf("unexpected priority/version: %q", msg)
+	}
+	if !strings.HasSuffix(msg, ` rexec `+strings.Fields(msg)[4]+` audit - {"user":"lauren"}`) {
+		t.Fatalf("unexpected message: %q", msg)
+	}
+}
+
+func TestHTTPSinkBuffersUntilReachable(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	up := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, string(body))
+	}))
+	defer srv.Close()
+
+	bufferDir := t.TempDir()
+	sink, err := newHTTPSink(srv.URL, nil, 2, time.Hour, 0, bufferDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the first batch fails and ends up on disk
+	sink.Write([]byte("1\n"))
+	sink.Write([]byte("2\n"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files, _ := filepath.Glob(filepath.Join(bufferDir, "*.ndjson"))
+		if len(files) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the failed batch to be buffered, got %v", files)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	up = true
+	mu.Unlock()
+
+	// closing flushes, the buffered batch has to arrive first
+	sink.Write([]byte("3\n"))
+	sink.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || received[0] != "1\n2\n" || received[1] != "3\n" {
+		t.Fatalf("unexpected deliveries: %q", received)
+	}
+	if files, _ := filepath.Glob(filepath.Join(bufferDir, "*.ndjson")); len(files) != 0 {
+		t.Fatalf("expected buffer to be drained, got %v", files)
+	}
+}
+
+func TestHTTPSinkSpillsWhileDraining(t *testing.T) {
+	posting := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posting <- struct{}{}
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	bufferDir := t.TempDir()
+	sink := &httpSink{url: srv.URL, bufferDir: bufferDir, client: &http.Client{Timeout: 10 * time.Second}}
+	if err := sink.spill([][]byte{[]byte("1\n")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	go sink.drain()
+	<-posting
+
+	// a session spilling an event is not held up by the slow endpoint
+	spilled := make(chan error)
+	go func() { spilled <- sink.spill([][]byte{[]byte("2\n")}) }()
+	select {
+	case err := <-spilled:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("spill waited for the buffered events to be posted")
+	}
+}
+
+func TestSyslogSinkReconnectsInBackground(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	// the daemon is down, writing must neither block nor fail
+	sink := &syslogSink{network: "tcp", address: address, hostname: "rexec-0"}
+	defer sink.Close()
+	start := time.Now()
+	if _, err := sink.WriteLevel(zerolog.InfoLevel, []byte(`{"event":"command"}`+"\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatal("write waited for the connection")
+	}
+
+	// once it is back the held message is delivered
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Skipf("could not listen on %s again: %v", address, err)
+	}
+	defer listener.Close()
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("sink did not reconnect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil || !strings.HasSuffix(string(buf[:n]), ` audit - {"event":"command"}`) {
+		t.Fatalf("unexpected message %q: %v", buf[:n], err)
+	}
+}
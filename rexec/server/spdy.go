@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+const (
+	spdyProtocol = "SPDY/3.1"
+	// every spdy frame starts with 8 bytes, the last 3 are the length
+	spdyHeaderLen = 8
+)
+
+// isSPDYUpgrade checks whether an upgrade request or response is spdy
+func isSPDYUpgrade(header http.Header) bool {
+	return strings.EqualFold(header.Get("Upgrade"), spdyProtocol)
+}
+
+// spdyStreams maps spdy stream ids to remotecommand streams, the
+// client announces the streams but both directions need the mapping
+type spdyStreams struct {
+	mu    sync.Mutex
+	types map[spdy.StreamId]byte
+}
+
+func (s *spdyStreams) set(id spdy.StreamId, stream byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.types == nil {
+		s.types = map[spdy.StreamId]byte{}
+	}
+	s.types[id] = stream
+}
+
+func (s *spdyStreams) get(id spdy.StreamId) (byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stream, ok := s.types[id]
+	return stream, ok
+}
+
+// id returns the spdy stream carrying a remotecommand stream
+func (s *spdyStreams) id(stream byte) (spdy.StreamId, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, known := range s.types {
+		if known == stream {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// spdyDecoder demultiplexes one direction of a spdy connection, the
+// framer of spdystream does the parsing but it reads from a stream,
+// so it is only handed complete frames and never blocks
+type spdyDecoder struct {
+	buf     []byte
+	frames  bytes.Buffer
+	framer  *spdy.Framer
+	streams *spdyStreams
+	// bytes left of a data frame we decided to skip
+	skip int
+	// oversized data frames are skipped rather than being an error
+	skipOversized bool
+}
+
+func newSPDYDecoder(streams *spdyStreams, skipOversized bool) (*spdyDecoder, error) {
+	d := &spdyDecoder{streams: streams, skipOversized: skipOversized}
+	framer, err := spdy.NewFramer(io.Discard, &d.frames)
+	if err != nil {
+		return nil, err
+	}
+	d.framer = framer
+	return d, nil
+}
+
+// feed takes the next chunk of the stream and returns the messages
+// completed by it, an error means the stream is not spdy anymore
+func (d *spdyDecoder) feed(data []byte) ([]channelMessage, error) {
+	d.buf = append(d.buf, data...)
+	var messages []channelMessage
+	consumed := 0
+	for consumed < len(d.buf) {
+		rest := d.buf[consumed:]
+
+		if d.skip > 0 {
+			n := min(d.skip, len(rest))
+			d.skip -= n
+			consumed += n
+			continue
+		}
+
+		if len(rest) < spdyHeaderLen {
+			break
+		}
+		size := spdyHeaderLen + int(binary.BigEndian.Uint32(rest[4:8])&0xFFFFFF)
+		if len(rest) < size {
+			// data frames do not touch the header compression state,
+			// so the ones too big to wait for can be dropped as they pass
+			if rest[0]&0x80 == 0 && size-spdyHeaderLen > maxWSMessageSize {
+				if !d.skipOversized {
+					d.buf = nil
+					return messages, fmt.Errorf("spdy data frame of %d bytes", size-spdyHeaderLen)
+				}
+				d.skip = size - spdyHeaderLen
+				consumed += spdyHeaderLen
+				SysLogger.Error().Msgf("skipping spdy frame of %d bytes", d.skip)
+				continue
+			}
+			break
+		}
+
+		d.frames.Write(rest[:size])
+		consumed += size
+		frame, err := d.framer.ReadFrame()
+		if err != nil {
+			d.buf = nil
+			return messages, err
+		}
+		messages = append(messages, d.route(frame)...)
+	}
+
+	// keeping only what was not consumed yet
+	d.buf = append(d.buf[:0], d.buf[consumed:]...)
+	return messages, nil
+}
+
+// route turns a frame into messages of the remotecommand streams,
+// closing a stream is signalled the same way as v5 websockets do
+func (d *spdyDecoder) route(frame spdy.Frame) []channelMessage {
+	switch frame := frame.(type) {
+	case *spdy.SynStreamFrame:
+		name := frame.Headers.Get("streamType")
+		stream, ok := streamIds[name]
+		if !ok {
+			SysLogger.Error().Msgf("unknown spdy stream type %q", name)
+			return nil
+		}
+		d.streams.set(frame.StreamId, stream)
+	case *spdy.DataFrame:
+		stream, ok := d.streams.get(frame.StreamId)
+		if !ok {
+			return nil
+		}
+		var messages []channelMessage
+		if len(frame.Data) > 0 {
+			messages = append(messages, channelMessage{stream: stream, data: frame.Data})
+		}
+		if frame.Flags&spdy.DataFlagFin != 0 {
+			messages = append(messages, channelMessage{stream: streamClose, data: []byte{stream}})
+		}
+		return messages
+	case *spdy.RstStreamFrame:
+		stream, ok := d.streams.get(frame.StreamId)
+		if !ok {
+			return nil
+		}
+		return []channelMessage{{stream: streamClose, data: []byte{stream}}}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+)
+
+// stdinCapture keeps the start of the stdin of a command without a tty,
+// up to --stdin-capture-size, all of it is hashed
+type stdinCapture struct {
+	data []byte
+	size int64
+	hash hash.Hash
+	// the stdin is an archive, its files are audited on their own
+	archive bool
+}
+
+// captureStdin adds data sent to the stdin of a session without a tty
+func (s *session) captureStdin(data []byte, archive bool) {
+	if len(data) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &s.stdinCapture
+	if c.hash == nil {
+		c.hash = sha256.New()
+	}
+	c.hash.Write(data)
+	c.size += int64(len(data))
+	if archive {
+		c.archive = true
+		c.data = nil
+	}
+	if room := StdinCaptureSize - len(c.data); room > 0 && !c.archive {
+		c.data = append(c.data, data[:min(room, len(data))]...)
+	}
+}
+
+// logStdin emits the stdin event once the session is over, s.mu has to
+// be held
+func (s *session) logStdin() {
+	c := &s.stdinCapture
+	if c.size == 0 {
+		return
+	}
+	event := s.logger.Info().
+		Str("event", "stdin").
+		Int64("bytes", c.size).
+		Str("sha256", hex.EncodeToString(c.hash.Sum(nil))).
+		Bool("truncated", int64(len(c.data)) < c.size)
+	if c.archive {
+		event = event.Bool("archive", true)
+	} else {
+		event = event.Str("data", redact(string(c.data)))
+	}
+	event.Msg("")
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func setStdinCaptureSize(t *testing.T, size int) {
+	old := StdinCaptureSize
+	t.Cleanup(func() { StdinCaptureSize = old })
+	StdinCaptureSize = size
+}
+
+// stdinEvent ends the session and returns its stdin event, nil if
+// there was none
+func stdinEvent(t *testing.T, sess *session, buf *bytes.Buffer) map[string]interface{} {
+	sess.end("request finished")
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		event := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if event["event"] == "stdin" {
+			return event
+		}
+	}
+	return nil
+}
+
+func TestCaptureStdin(t *testing.T) {
+	setStdinCaptureSize(t, 16)
+	script := "#!/bin/sh\necho password=hunter2\nrm -rf /tmp/cache\n"
+	sum := sha256.Sum256([]byte(script))
+
+	var buf bytes.Buffer
+	sess := &session{id: "test", logger: zerolog.New(&buf)}
+	sess.captureStdin([]byte(script[:20]), false)
+	sess.captureStdin([]byte(script[20:]), false)
+	event := stdinEvent(t, sess, &buf)
+	if event == nil || event["data"] != script[:16] || event["truncated"] != true ||
+		event["bytes"] != float64(len(script)) || event["sha256"] != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected stdin event: %v", event)
+	}
+
+	setStdinCaptureSize(t, 1024)
+	buf.Reset()
+	sess = &session{id: "test", logger: zerolog.New(&buf)}
+	sess.captureStdin([]byte(script), false)
+	event = stdinEvent(t, sess, &buf)
+	if event == nil || event["data"] != "#!/bin/sh\necho password=[REDACTED]\nrm -rf /tmp/cache\n" || event["truncated"] != false {
+		t.Fatalf("unexpected stdin event: %v", event)
+	}
+
+	// an archive is covered by the transfer events
+	buf.Reset()
+	sess = &session{id: "test", logger: zerolog.New(&buf)}
+	sess.captureStdin([]byte("first part"), false)
+	sess.captureStdin([]byte("second part"), true)
+	event = stdinEvent(t, sess, &buf)
+	if event == nil || event["archive"] != true || event["data"] != nil || event["bytes"] != float64(21) {
+		t.Fatalf("unexpected stdin event: %v", event)
+	}
+
+	buf.Reset()
+	sess = &session{id: "test", logger: zerolog.New(&buf)}
+	if event := stdinEvent(t, sess, &buf); event != nil {
+		t.Fatalf("stdin event without stdin: %v", event)
+	}
+}
+
+func TestHandleStdinWithoutTTY(t *testing.T) {
+	setStdinCaptureSize(t, 1024)
+	var buf bytes.Buffer
+	sess := &session{id: "test", stdin: true, logger: zerolog.New(&buf)}
+	tl, _ := negotiatedLogger(t, sess)
+	tl.watchTransfers()
+
+	stream := []byte("GET /exec HTTP/1.1\r\nHost: kube\r\n\r\n")
+	stream = append(stream, wsFrame(true, wsOpBinary, true, []byte("\x00ls /\n"))...)
+	stream = append(stream, wsFrame(true, wsOpBinary, true, []byte("\x00exit\n"))...)
+	tl.inspectInput(stream)
+	if event := stdinEvent(t, sess, &buf); event == nil || event["data"] != "ls /\nexit\n" {
+		t.Fatalf("stdin was not captured: %s", buf.String())
+	}
+}
+
+func TestLogStartWithoutTTY(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := auditLogger
+	t.Cleanup(func() { auditLogger = oldLogger })
+	auditLogger = zerolog.New(&buf)
+
+	req := httptest.NewRequest(http.MethodPost, "/apis/audit.adyen.internal/v1beta1/namespaces/ns/pods/pod/exec", nil)
+	sess := newSession("7d3c", req, "lauren", nil, "ns", "pod", "exec", url.Values{"command": {"cat", "/etc/hosts"}})
+	sess.logStart()
+	if !strings.Contains(buf.String(), `"tty":false`) || !strings.Contains(buf.String(), `"event":"session_start","command":"cat /etc/hosts"`) {
+		t.Fatalf("unexpected start event: %s", buf.String())
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// authpriv, as these are security relevant events
+	syslogFacility = 10
+	syslogAppName  = "rexec"
+	syslogMsgID    = "audit"
+	// messages kept while the connection is being restored
+	syslogBufferSize = 1000
+	// how long to wait between two attempts to reconnect
+	syslogRedialInterval = time.Second
+)
+
+// syslogSink sends audit events as RFC 5424 messages, over tcp the
+// messages are framed with octet counting as described in RFC 6587
+type syslogSink struct {
+	mu       sync.Mutex
+	network  string
+	address  string
+	hostname string
+	conn     net.Conn
+	// while reconnecting messages are held here, the oldest
+	// are dropped once it is full
+	redialing bool
+	pending   [][]byte
+	dropped   int
+	closed    bool
+}
+
+func newSyslogSink(network, address string) (*syslogSink, error) {
+	if address == "" {
+		return nil, errors.New("--audit-syslog-address is required")
+	}
+	switch network {
+	case "tcp", "udp", "unix", "unixgram":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q", network)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	s := &syslogSink{network: network, address: address, hostname: hostname}
+	s.conn, err = s.dial()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *syslogSink) dial() (net.Conn, error) {
+	return net.DialTimeout(s.network, s.address, 5*time.Second)
+}
+
+// redial reconnects in the background, so sessions logging in the
+// meantime are not held up, then sends what was held
+func (s *syslogSink) redial() {
+	for {
+		conn, err := s.dial()
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err == nil {
+			err = s.sendPending(conn)
+			if err == nil {
+				s.conn = conn
+				s.redialing = false
+				s.mu.Unlock()
+				return
+			}
+			conn.Close()
+		}
+		s.mu.Unlock()
+		SysLogger.Error().Err(err).Msgf("failed to reconnect to syslog at %s", s.address)
+		time.Sleep(syslogRedialInterval)
+	}
+}
+
+// sendPending writes the held messages, callers hold the lock
+func (s *syslogSink) sendPending(conn net.Conn) error {
+	if s.dropped > 0 {
+		SysLogger.Error().Msgf("dropped %d audit events while syslog was unreachable", s.dropped)
+		s.dropped = 0
+	}
+	for len(s.pending) > 0 {
+		_, err := conn.Write(s.pending[0])
+		if err != nil {
+			return err
+		}
+		s.pending = s.pending[1:]
+	}
+	return nil
+}
+
+// hold keeps a message until the connection is back, callers hold the lock
+func (s *syslogSink) hold(msg []byte) {
+	if len(s.pending) >= syslogBufferSize {
+		s.pending = s.pending[1:]
+		s.dropped++
+	}
+	s.pending = append(s.pending, msg)
+}
+
+// syslogSeverity maps zerolog levels to syslog severities
+func syslogSeverity(level zerolog.Level) int {
+	switch level {
+	case zerolog.TraceLevel, zerolog.DebugLevel:
+		return 7
+	case zerolog.WarnLevel:
+		return 4
+	case zerolog.ErrorLevel:
+		return 3
+	case zerolog.FatalLevel:
+		return 2
+	case zerolog.PanicLevel:
+		return 1
+	default:
+		return 6
+	}
+}
+
+// format renders a RFC 5424 message without structured data,
+// the json event itself is the message
+func (s *syslogSink) format(level zerolog.Level, p []byte) []byte {
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		syslogFacility*8+syslogSeverity(level),
+		time.Now().UTC().Format(time.RFC3339Nano),
+		s.hostname,
+		syslogAppName,
+		os.Getpid(),
+		syslogMsgID,
+		bytes.TrimRight(p, "\n"),
+	))
+}
+
+func (s *syslogSink) frame(msg []byte) []byte {
+	switch s.network {
+	case "tcp":
+		return append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	case "unix":
+		return append(msg, '\n')
+	default:
+		return msg
+	}
+}
+
+func (s *syslogSink) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg := s.frame(s.format(level, p))
+	if s.conn != nil {
+		_, err := s.conn.Write(msg)
+		if err == nil {
+			return len(p), nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	// syslog daemons are restarted from time to time, reconnecting
+	// is left to the background so the session goes on right away
+	s.hold(msg)
+	if !s.redialing && !s.closed {
+		s.redialing = true
+		go s.redial()
+	}
+	return len(p), nil
+}
+
+func (s *syslogSink) Write(p []byte) (int, error) {
+	return s.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (s *syslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -3,12 +3,15 @@ package server
 import (
 	"context"
 	"crypto/tls"
-	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"os"
-	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/rs/zerolog"
 )
@@ -17,26 +20,24 @@ const (
 	targetAddress = "kubernetes.default.svc.cluster.local:443"
 )
 
-func tcpForwarder(ctx context.Context) {
+// errUninspectable ends a connection rexec can not follow anymore,
+// passing it through would leave it out of the audit
+var errUninspectable = errors.New("stream can not be inspected")
+
+// sessionListener sets up the unix listener of a session, it is
+// created before the request is proxied so it is there when dialed
+func sessionListener(ctx context.Context, ctxid string) (net.Listener, error) {
 	lc := net.ListenConfig{}
+	return lc.Listen(ctx, "unix", fmt.Sprintf("/%s", ctxid))
+}
 
+func tcpForwarder(ctx context.Context, listener net.Listener) {
 	ctxid := ctx.Value("sessionID").(string)
-	socketPath := fmt.Sprintf("/%s", ctxid)
-
-	// we setup a unix listener for the specific session
-	listener, err := lc.Listen(ctx, "unix", socketPath)
-	if err != nil {
-		SysLogger.Error().Err(err).Msgf("failed to start listener for %s", ctxid)
-		return
-	}
+	socketPath := listener.Addr().String()
 	defer listener.Close()
 
 	SysLogger.Debug().Msgf("starting personal tcp forwarer at %s", socketPath)
 
-	// in a cheap manner we signer back that it is ready
-	mapSync.Lock()
-	proxyMap[ctxid] = true
-	mapSync.Unlock()
 	halt := false
 	for {
 		client, err := listener.Accept()
@@ -60,13 +61,24 @@ func tcpForwarder(ctx context.Context) {
 	// once the http session is gone, the socket and the user and proxymaps are getting cleaned up
 	os.Remove(socketPath)
 	mapSync.Lock()
-	delete(proxyMap, ctxid)
-	delete(userMap, ctxid)
+	sess := sessionMap[ctxid]
+	delete(sessionMap, ctxid)
 	mapSync.Unlock()
 
+	if sess != nil {
+		sess.end("request finished")
+	}
+
 	commandSync.Lock()
-	delete(commandMap, ctxid)
+	delete(editorMap, ctxid)
 	commandSync.Unlock()
+
+	recorderSync.Lock()
+	if recorder, ok := recorderMap[ctxid]; ok {
+		recorder.Close()
+		delete(recorderMap, ctxid)
+	}
+	recorderSync.Unlock()
 }
 
 func handleTcpConnection(client net.Conn, ctxid string) {
@@ -77,57 +89,484 @@ func handleTcpConnection(client net.Conn, ctxid string) {
 		client.Close()
 		return
 	}
-	defer target.Close()
+
+	recorderSync.Lock()
+	recorder := recorderMap[ctxid]
+	recorderSync.Unlock()
+
+	mapSync.Lock()
+	sess := sessionMap[ctxid]
+	mapSync.Unlock()
+	if sess == nil {
+		SysLogger.Error().Msgf("no session found for %s", ctxid)
+		client.Close()
+		return
+	}
 
 	// we are creating an instance of TCPLogger
 	// which implements net.conn and custom logging
 	// with the context of the user we are logging
 	// traffic for
-	tcpLogger := &TCPLogger{Conn: target, ctxid: ctxid}
+	tcpLogger := &TCPLogger{Conn: target, ctxid: ctxid, session: sess, recorder: recorder, client: client}
+	defer tcpLogger.Close()
+	if AuditScreen && sess.tty {
+		tcpLogger.screen = newScreen()
+	}
+	tcpLogger.watchTransfers()
+	sess.attach(tcpLogger)
 
 	// on the way toward the target we send the traffic
 	// through the tcp logger
-	go io.Copy(tcpLogger, client)
-	// on the way back however we dont want to log anything
-	io.Copy(client, target)
+	go func() {
+		_, err := io.Copy(tcpLogger, client)
+		sess.setCloseReason(closeReason("client", err))
+	}()
+	// on the way back we read through the tcp logger
+	// as well, so the output can be recorded
+	err = tcpLogger.copyOutput()
+	sess.setCloseReason(closeReason("upstream", err))
 	client.Close()
 }
 
+// closeReason describes which side ended the session and how
+func closeReason(side string, err error) string {
+	if err != nil {
+		return fmt.Sprintf("%s error: %s", side, err)
+	}
+	return fmt.Sprintf("%s closed the connection", side)
+}
+
+// terminalSize is the payload of a resize message sent by kubectl
+type terminalSize struct {
+	Width  uint16
+	Height uint16
+}
+
 type TCPLogger struct {
 	net.Conn
-	ctxid string
+	ctxid    string
+	session  *session
+	recorder *castRecorder
+	// what the terminal of the user shows, if --audit-screen is set
+	screen *screen
+	// notices input typed while the terminal does not echo it
+	echo echoWatch
+	// the connection of the user, rexec writes its own messages
+	// there as well so writes are serialized
+	client     net.Conn
+	clientSync sync.Mutex
+	atBoundary bool
+	notices    []string
+	// the http heads of the upgrade and the websocket
+	// decoders of both directions, reads and writes happen
+	// on different goroutines so they do not share state
+	requestHead  httpHead
+	responseHead httpHead
+	input        wsDecoder
+	output       wsDecoder
+	// set once the upgrade was refused, there are no streams then
+	outputPassthrough bool
+	// set once a direction could not be parsed, the connection
+	// is closed then
+	uninspectable atomic.Bool
+	// the subprotocol is picked by the server in the upgrade
+	// response but is needed to decode the input as well, client
+	// messages coming before it are held in pendingInput
+	protocolSync sync.Mutex
+	protocol     *channelProtocol
+	pendingInput []wsMessage
+	// the input is handled on the output goroutine as well when
+	// pending messages are decoded
+	inputSync sync.Mutex
+	// older clients upgrade to spdy instead, then these replace
+	// the websocket decoders and share the stream mapping
+	spdyInput   *spdyDecoder
+	spdyOutput  *spdyDecoder
+	spdyStreams spdyStreams
+	// port-forwards are followed by decoders of their own
+	forwardInput  *portForwardDecoder
+	forwardOutput *portForwardDecoder
+	// archives going through stdin and stdout of sessions
+	// without a tty, and whether one was not allowed
+	upload         *transferWatch
+	download       *transferWatch
+	transferDenied atomic.Bool
+	// set once a command typed got the session terminated
+	policyDenied atomic.Bool
+}
+
+// watchTransfers looks for archives in the streams of a session
+// without a tty, with a tty they carry keystrokes and a terminal
+func (t *TCPLogger) watchTransfers() {
+	if t.session.tty || t.session.forwards != nil {
+		return
+	}
+	t.upload = newTransferWatch(t.session, transferUpload)
+	t.download = newTransferWatch(t.session, transferDownload)
 }
 
+// Close ends the archives still being read and logs the commands
+// still held along with the connection
+func (t *TCPLogger) Close() error {
+	t.closeTransfers()
+	t.echo.flush()
+	return t.Conn.Close()
+}
+
+// Read is the way back from the kube apiserver to the user
 func (t *TCPLogger) Read(b []byte) (n int, err error) {
 	n, err = t.Conn.Read(b)
+	t.session.bytesOut.Add(int64(n))
+	if n > 0 && !t.outputPassthrough {
+		t.inspectOutput(b[:n])
+	}
+	// nothing of a denied download makes it to the user
+	if t.transferDenied.Load() {
+		return 0, errTransferDenied
+	}
+	if t.uninspectable.Load() {
+		return 0, errUninspectable
+	}
 	return
 }
 
+// Write is the way from the user toward the kube apiserver, the input
+// is inspected before it is forwarded so the screen is captured before
+// the shell gets to react on an enter
 func (t *TCPLogger) Write(b []byte) (n int, err error) {
+	if len(b) > 0 {
+		t.inspectInput(b)
+	}
+	if t.transferDenied.Load() {
+		return 0, errTransferDenied
+	}
+	if t.uninspectable.Load() {
+		return 0, errUninspectable
+	}
+	// the enter of a command the policy terminated never reaches the shell
+	if t.policyDenied.Load() {
+		return 0, errPolicyDenied
+	}
 	n, err = t.Conn.Write(b)
-	if n > 0 {
-		// we need parse the websockter frame
-		frame, err := parseWebSocketFrame(b)
-		if err != nil {
-			SysLogger.Error().Err(err).Msg("failed to parse ws frame")
+	t.session.bytesIn.Add(int64(n))
+	return
+}
+
+func (t *TCPLogger) inspectOutput(data []byte) {
+	if t.uninspectable.Load() {
+		return
+	}
+	wasDone := t.responseHead.done
+	data, done, err := t.responseHead.feed(data)
+	if err == nil && done && !wasDone {
+		err = t.negotiate()
+	}
+	if err != nil {
+		t.stopInspection("output", err)
+		return
+	}
+	if t.outputPassthrough || !done || len(data) == 0 {
+		return
+	}
+	if t.forwardOutput != nil {
+		if err := t.forwardOutput.feed(data); err != nil {
+			t.stopInspection("output", err)
 		}
-		if frame != nil {
-			// if it is opscode 0x2 we log out
-			// activities
-			if frame.Opcode == 0x2 {
-				if auditLogger.GetLevel() == zerolog.TraceLevel {
-					stroke, err := hex.DecodeString(fmt.Sprintf("%x", frame.Payload))
-					if err != nil {
-						SysLogger.Error().Err(err).Msg("failed to parse payload")
-					}
-					auditLogger.Trace().Str("user", userMap[t.ctxid]).Str("session", t.ctxid).Str("stroke", strings.ReplaceAll(string(stroke), "\u0000", "")).Msg("")
-				}
-				asyncAuditChan <- asyncAudit{
-					ctxid: t.ctxid,
-					ascii: frame.Payload,
-				}
+		return
+	}
+
+	var messages []channelMessage
+	if t.spdyOutput != nil {
+		messages, err = t.spdyOutput.feed(data)
+	} else {
+		var wsMessages []wsMessage
+		wsMessages, err = t.output.feed(data)
+		t.protocolSync.Lock()
+		protocol := t.protocol
+		t.protocolSync.Unlock()
+		messages = t.decodeChannel(protocol, wsMessages)
+	}
+	if err != nil {
+		t.stopInspection("output", err)
+	}
+	for _, message := range messages {
+		switch message.stream {
+		case streamStdout, streamStderr:
+			t.logStreamData(message.stream, message.data)
+			if message.stream == streamStdout {
+				t.inspectTransfer(t.download, message.data)
+			}
+			// stdout and stderr are both recorded as output
+			if t.recorder != nil {
+				t.recorder.output(message.data)
+			}
+			t.session.broadcast("o", message.data)
+			if t.screen != nil {
+				t.screen.write(message.data)
+			}
+			if t.session.tty {
+				t.echo.output(message.data)
 			}
+		case streamError:
+			// the error stream carries the exit status
+			t.session.setExitStatus(message.data)
+		case streamClose:
+			t.logStreamClose(message.data)
 		}
 	}
-	return
+}
+
+// negotiate picks up the subprotocol from the upgrade response,
+// if the upgrade was refused there is nothing for us to parse
+func (t *TCPLogger) negotiate() error {
+	resp, err := t.responseHead.response()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.outputPassthrough = true
+		return nil
+	}
+	if t.session.forwards != nil && !isSPDYUpgrade(resp.Header) {
+		return errPortForwardProtocol
+	}
+	if isSPDYUpgrade(resp.Header) {
+		if t.session.forwards != nil {
+			t.forwardOutput, err = newPortForwardDecoder(t.session.forwards, false)
+			return err
+		}
+		t.spdyOutput, err = newSPDYDecoder(&t.spdyStreams, true)
+		return err
+	}
+	protocol, err := parseChannelProtocol(resp.Header.Get("Sec-WebSocket-Protocol"))
+	if err != nil {
+		return err
+	}
+	// what the container prints can be skipped when it is too big,
+	// unlike the input it can not run anything
+	t.output.skipOversized = true
+	t.protocolSync.Lock()
+	t.protocol = protocol
+	t.protocolSync.Unlock()
+
+	// the client may have sent messages right behind the upgrade
+	// request, they already went upstream but are audited now
+	t.inputSync.Lock()
+	messages, _ := t.decodeInput(nil)
+	t.handleInput(messages)
+	t.inputSync.Unlock()
+	return nil
+}
+
+// decodeInput decodes client messages along with the ones held back,
+// while the subprotocol is not known yet they are all held back,
+// callers hold inputSync
+func (t *TCPLogger) decodeInput(wsMessages []wsMessage) ([]channelMessage, error) {
+	t.protocolSync.Lock()
+	protocol := t.protocol
+	wsMessages = append(t.pendingInput, wsMessages...)
+	t.pendingInput = nil
+	if protocol == nil {
+		t.pendingInput = wsMessages
+	}
+	t.protocolSync.Unlock()
+	if protocol != nil {
+		return t.decodeChannel(protocol, wsMessages), nil
+	}
+	held := 0
+	for _, message := range wsMessages {
+		held += len(message.Payload)
+	}
+	if held > maxWSMessageSize {
+		return nil, fmt.Errorf("%d bytes sent before the upgrade response", held)
+	}
+	return nil, nil
+}
+
+// decodeChannel splits websocket messages into stream id and data,
+// control messages and anything we cannot decode are skipped
+func (t *TCPLogger) decodeChannel(protocol *channelProtocol, wsMessages []wsMessage) []channelMessage {
+	if protocol == nil {
+		return nil
+	}
+	var messages []channelMessage
+	for _, message := range wsMessages {
+		if message.Opcode != wsOpBinary && message.Opcode != wsOpText {
+			continue
+		}
+		stream, payload, err := protocol.decode(message)
+		if err != nil {
+			SysLogger.Error().Err(err).Msgf("failed to decode message in %s", t.ctxid)
+			continue
+		}
+		if stream == streamClose && !protocol.closeSignal {
+			continue
+		}
+		messages = append(messages, channelMessage{stream: stream, data: payload})
+	}
+	return messages
+}
+
+// stopInspection closes a connection once one of its directions can not
+// be parsed, from then on nothing would make it into the audit
+func (t *TCPLogger) stopInspection(direction string, err error) {
+	if t.uninspectable.Swap(true) {
+		return
+	}
+	SysLogger.Error().Err(err).Msgf("failed to inspect %s of %s, closing it", direction, t.ctxid)
+	t.session.logger.Warn().Str("event", "inspection_failed").Str("direction", direction).Str("reason", err.Error()).Msg("")
+	t.session.setCloseReason("inspection failed")
+	t.Conn.Close()
+	if t.client != nil {
+		t.client.Close()
+	}
+}
+
+func (t *TCPLogger) inspectInput(data []byte) {
+	t.inputSync.Lock()
+	defer t.inputSync.Unlock()
+	if t.uninspectable.Load() {
+		return
+	}
+	wasDone := t.requestHead.done
+	data, done, err := t.requestHead.feed(data)
+	if err == nil && done && !wasDone {
+		err = t.upgrade()
+	}
+	if err != nil {
+		t.stopInspection("input", err)
+		return
+	}
+	if !done || len(data) == 0 {
+		return
+	}
+	if t.forwardInput != nil {
+		t.session.touch()
+		if err := t.forwardInput.feed(data); err != nil {
+			t.stopInspection("input", err)
+		}
+		return
+	}
+
+	var messages []channelMessage
+	if t.spdyInput != nil {
+		messages, err = t.spdyInput.feed(data)
+	} else {
+		var wsMessages []wsMessage
+		wsMessages, err = t.input.feed(data)
+		if err == nil {
+			messages, err = t.decodeInput(wsMessages)
+		}
+	}
+	if err != nil {
+		t.stopInspection("input", err)
+	}
+	t.handleInput(messages)
+}
+
+// handleInput passes on the messages of the client, callers hold inputSync
+func (t *TCPLogger) handleInput(messages []channelMessage) {
+	if len(messages) > 0 {
+		t.session.touch()
+	}
+	for _, message := range messages {
+		switch message.stream {
+		case streamStdin:
+			t.handleStdin(message.data)
+		case streamResize:
+			t.handleResize(message.data)
+		case streamClose:
+			t.logStreamClose(message.data)
+		}
+	}
+}
+
+// upgrade checks which protocol the client asked for, the response
+// is read on the other goroutine so the input can not rely on it
+func (t *TCPLogger) upgrade() error {
+	req, err := t.requestHead.request()
+	if err != nil {
+		return err
+	}
+	switch {
+	case t.session.forwards != nil && !isSPDYUpgrade(req.Header):
+		return errPortForwardProtocol
+	case t.session.forwards != nil:
+		t.forwardInput, err = newPortForwardDecoder(t.session.forwards, true)
+	case isSPDYUpgrade(req.Header):
+		t.spdyInput, err = newSPDYDecoder(&t.spdyStreams, false)
+	}
+	return err
+}
+
+// handleStdin passes keystrokes to the auditor, the stdin of
+// sessions without a tty is captured as it is instead
+func (t *TCPLogger) handleStdin(payload []byte) {
+	if !t.session.tty {
+		t.logStreamData(streamStdin, payload)
+		t.inspectTransfer(t.upload, payload)
+		t.session.captureStdin(payload, t.upload != nil && t.upload.archive())
+		return
+	}
+	if len(payload) == 0 {
+		return
+	}
+	// secrets typed at a password prompt are not stored or shown,
+	// the line editor and the policy still get what was typed
+	masked, hidden := t.echo.mask(payload)
+	if t.session.logger.GetLevel() == zerolog.TraceLevel {
+		t.session.logger.Trace().Str("event", "stroke").Str("stroke", redact(string(masked))).Msg("")
+	}
+	if t.recorder != nil {
+		t.recorder.input(masked)
+	}
+	t.session.broadcast("i", masked)
+	var screens map[int]screenLine
+	if t.screen != nil {
+		screens = t.screen.input(payload)
+	}
+	if !storeOrFlush(keystrokes{
+		ctxid:   t.ctxid,
+		session: t.session,
+		ascii:   payload,
+		hidden:  hidden,
+		echo:    &t.echo,
+		screens: screens,
+	}) {
+		t.policyDenied.Store(true)
+	}
+}
+
+// inspectTransfer passes data to the watch of its stream and checks
+// whether an archive found in it may go through
+func (t *TCPLogger) inspectTransfer(watch *transferWatch, data []byte) {
+	if watch != nil && watch.feed(data) {
+		t.enforceTransfer(watch.direction)
+	}
+}
+
+// handleResize logs the new terminal size
+func (t *TCPLogger) handleResize(payload []byte) {
+	size := terminalSize{}
+	err := json.Unmarshal(payload, &size)
+	if err != nil {
+		SysLogger.Error().Err(err).Msg("failed to parse resize message")
+		return
+	}
+	t.session.logger.Info().Str("event", "resize").Uint16("width", size.Width).Uint16("height", size.Height).Msg("")
+	if t.recorder != nil {
+		t.recorder.resize(int(size.Width), int(size.Height))
+	}
+	t.session.broadcastResize(int(size.Width), int(size.Height))
+	if t.screen != nil {
+		t.screen.resize(int(size.Width), int(size.Height))
+	}
+}
+
+// logStreamClose logs a v5 close signal, its payload is the closed stream
+func (t *TCPLogger) logStreamClose(payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+	t.session.logger.Info().Str("event", "stream_close").Str("stream", streamName(payload[0])).Msg("")
 }
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	transferUpload   = "upload"
+	transferDownload = "download"
+	// tar headers carry the ustar magic at this offset, the gnu
+	// and pax formats written by tar and kubectl cp included
+	tarMagicOffset = 257
+)
+
+var tarMagic = []byte("ustar")
+
+var errTransferDenied = errors.New("file transfer denied")
+
+// transferWatch follows a stream of a session without a tty, if the
+// stream turns out to be a tar archive, like the ones kubectl cp
+// sends, every file in it is audited with its size and hash
+type transferWatch struct {
+	session   *session
+	direction string
+
+	mu sync.Mutex
+	// the start of the stream until it is clear what it is
+	head    []byte
+	decided bool
+	// the archive is read on its own goroutine through the pipe
+	pipe *io.PipeWriter
+	done chan struct{}
+}
+
+func newTransferWatch(sess *session, direction string) *transferWatch {
+	return &transferWatch{session: sess, direction: direction}
+}
+
+// feed passes data of the stream on, it returns true when the data
+// made clear the stream is a tar archive
+func (w *transferWatch) feed(data []byte) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pipe != nil {
+		if _, err := w.pipe.Write(data); err != nil {
+			// the archive ended or could not be read
+			w.pipe = nil
+		}
+		return false
+	}
+	if w.decided {
+		return false
+	}
+
+	w.head = append(w.head, data...)
+	if len(w.head) < tarMagicOffset+len(tarMagic) {
+		return false
+	}
+	w.decided = true
+	head := w.head
+	w.head = nil
+	if !bytes.Equal(head[tarMagicOffset:tarMagicOffset+len(tarMagic)], tarMagic) {
+		return false
+	}
+
+	reader, writer := io.Pipe()
+	w.pipe = writer
+	w.done = make(chan struct{})
+	go w.read(reader)
+	if _, err := w.pipe.Write(head); err != nil {
+		w.pipe = nil
+	}
+	return true
+}
+
+// archive tells whether the stream turned out to be an archive
+func (w *transferWatch) archive() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.done != nil
+}
+
+// close ends the stream and waits until the archive is audited
+func (w *transferWatch) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pipe != nil {
+		w.pipe.Close()
+		w.pipe = nil
+	}
+	if w.done != nil {
+		<-w.done
+	}
+}
+
+// read audits the files of the archive, once it is over the pipe is
+// closed so the stream is not held up by it anymore
+func (w *transferWatch) read(reader *io.PipeReader) {
+	defer close(w.done)
+	w.session.logger.Info().Str("event", "transfer_start").Str("direction", w.direction).Msg("")
+
+	archive := tar.NewReader(reader)
+	files := 0
+	var total int64
+	var err error
+	for {
+		var header *tar.Header
+		header, err = archive.Next()
+		if err != nil {
+			break
+		}
+		event := w.session.logger.Info().
+			Str("event", "file_transfer").
+			Str("direction", w.direction).
+			Str("file", header.Name).
+			Str("type", tarEntryType(header.Typeflag))
+		switch header.Typeflag {
+		case tar.TypeReg:
+			hash := sha256.New()
+			var size int64
+			size, err = io.Copy(hash, archive)
+			if err != nil {
+				break
+			}
+			files++
+			total += size
+			event = event.Int64("size", size).Str("sha256", hex.EncodeToString(hash.Sum(nil)))
+		case tar.TypeSymlink, tar.TypeLink:
+			event = event.Str("link", header.Linkname)
+		}
+		if err != nil {
+			break
+		}
+		event.Msg("")
+	}
+
+	event := w.session.logger.Info().
+		Str("event", "transfer_end").
+		Str("direction", w.direction).
+		Int("files", files).
+		Int64("bytes", total).
+		Bool("complete", errors.Is(err, io.EOF))
+	if err != nil && !errors.Is(err, io.EOF) {
+		event = event.Str("error", err.Error())
+	}
+	event.Msg("")
+	reader.Close()
+}
+
+// tarEntryType names the kind of an entry of an archive
+func tarEntryType(flag byte) string {
+	switch flag {
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	default:
+		return fmt.Sprintf("other (%c)", flag)
+	}
+}
+
+// checkTransfer returns why the exec rules do not allow a transfer in
+// the namespace of the session, nil if they do
+func checkTransfer(ctx context.Context, sess *session, direction string) error {
+	rule, err := matchExecRule(ctx, sess.execRequest())
+	if err != nil {
+		SysLogger.Error().Err(err).Msgf("failed to fetch labels of namespace %s", sess.namespace)
+		return fmt.Errorf("could not check the exec rules of namespace %s", sess.namespace)
+	}
+	if rule == nil {
+		return nil
+	}
+	allowed := rule.AllowUpload
+	if direction == transferDownload {
+		allowed = rule.AllowDownload
+	}
+	if allowed != nil && !*allowed {
+		return fmt.Errorf("file %ss are not allowed in namespace %s (rule %s)", direction, sess.namespace, rule.Name)
+	}
+	return nil
+}
+
+// enforceTransfer runs once a stream turned out to be an archive, a
+// denied transfer ends the session before the files get through,
+// break-glass sessions are only audited
+func (t *TCPLogger) enforceTransfer(direction string) {
+	err := checkTransfer(context.Background(), t.session, direction)
+	if err == nil {
+		return
+	}
+	t.session.logger.Warn().
+		Str("event", "transfer_denied").
+		Str("direction", direction).
+		Str("reason", err.Error()).
+		Bool("enforced", !t.session.breakGlass).
+		Msg("")
+	if t.session.breakGlass {
+		return
+	}
+
+	t.transferDenied.Store(true)
+	if t.client != nil {
+		go t.session.terminate("rexec: "+err.Error(), "transfer denied")
+	} else {
+		t.session.setCloseReason("transfer denied")
+		t.Conn.Close()
+	}
+}
+
+// closeTransfers ends the archives still being read
+func (t *TCPLogger) closeTransfers() {
+	for _, watch := range []*transferWatch{t.upload, t.download} {
+		if watch != nil {
+			watch.close()
+		}
+	}
+}
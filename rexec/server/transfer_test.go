@@ -0,0 +1,142 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func makeTar(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	if err := archive.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for name, content := range files {
+		if err := archive.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		archive.Write([]byte(content))
+	}
+	archive.Close()
+	return buf.Bytes()
+}
+
+func TestTransferWatch(t *testing.T) {
+	var buf bytes.Buffer
+	sess := &session{id: "test", logger: zerolog.New(&buf)}
+	watch := newTransferWatch(sess, transferUpload)
+
+	archive := makeTar(t, map[string]string{"etc/app.conf": "listen 8080\n"})
+	detected := false
+	// the archive comes in pieces as it would over the wire
+	for chunk := range slices.Chunk(archive, 100) {
+		if watch.feed(chunk) {
+			detected = true
+		}
+	}
+	watch.close()
+	if !detected {
+		t.Fatal("archive was not detected")
+	}
+
+	sum := sha256.Sum256([]byte("listen 8080\n"))
+	for _, want := range []string{
+		`"event":"transfer_start","direction":"upload"`,
+		`"event":"file_transfer","direction":"upload","file":"etc/","type":"dir"`,
+		`"event":"file_transfer","direction":"upload","file":"etc/app.conf","type":"file","size":12,"sha256":"` + hex.EncodeToString(sum[:]) + `"`,
+		`"event":"transfer_end","direction":"upload","files":1,"bytes":12,"complete":true`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %s in: %s", want, buf.String())
+		}
+	}
+}
+
+func TestTransferWatchIncomplete(t *testing.T) {
+	var buf bytes.Buffer
+	sess := &session{id: "test", logger: zerolog.New(&buf)}
+	watch := newTransferWatch(sess, transferDownload)
+
+	archive := makeTar(t, map[string]string{"dump.sql": strings.Repeat("x", 4096)})
+	if !watch.feed(archive[:2048]) {
+		t.Fatal("archive was not detected")
+	}
+	watch.close()
+	if !strings.Contains(buf.String(), `"event":"transfer_end","direction":"download","files":0,"bytes":0,"complete":false,"error":"unexpected EOF"`) {
+		t.Fatalf("unexpected events: %s", buf.String())
+	}
+}
+
+func TestTransferWatchIgnoresOtherStreams(t *testing.T) {
+	var buf bytes.Buffer
+	sess := &session{id: "test", logger: zerolog.New(&buf)}
+	watch := newTransferWatch(sess, transferUpload)
+
+	if watch.feed([]byte(strings.Repeat("echo hello\n", 100))) || watch.feed(makeTar(t, nil)) {
+		t.Fatal("a script was taken for an archive")
+	}
+	watch.close()
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected events: %s", buf.String())
+	}
+}
+
+func TestCheckTransfer(t *testing.T) {
+	setExecRules(t, `
+rules:
+- name: admins
+  groups: [admins]
+- name: prod
+  namespaceSelector:
+    matchLabels:
+      env: prod
+  allowUpload: false
+`)
+	setNamespaceLabels(t, map[string]map[string]string{
+		"shop": {"env": "prod"},
+		"dev":  {"env": "dev"},
+	})
+
+	for _, tc := range []struct {
+		sess      *session
+		direction string
+		allowed   bool
+	}{
+		{&session{user: "bob", namespace: "shop"}, transferUpload, false},
+		{&session{user: "bob", namespace: "shop"}, transferDownload, true},
+		{&session{user: "alice", groups: []string{"admins"}, namespace: "shop"}, transferUpload, true},
+		{&session{user: "bob", namespace: "dev"}, transferUpload, true},
+	} {
+		err := checkTransfer(context.Background(), tc.sess, tc.direction)
+		if (err == nil) != tc.allowed {
+			t.Errorf("%s %s in %s: got error %v, want allowed=%v", tc.sess.user, tc.direction, tc.sess.namespace, err, tc.allowed)
+		}
+	}
+}
+
+func TestTCPLoggerDeniesUpload(t *testing.T) {
+	setExecRules(t, "rules:\n- users: [bob]\n  allowUpload: false\n")
+	var buf bytes.Buffer
+	// the archive is read on its own goroutine which logs too
+	sess := &session{id: "test", user: "bob", namespace: "dev", stdin: true, logger: zerolog.New(zerolog.SyncWriter(&buf))}
+	tl, _ := negotiatedLogger(t, sess)
+	tl.watchTransfers()
+
+	stream := []byte("GET /exec HTTP/1.1\r\nHost: kube\r\n\r\n")
+	stream = append(stream, wsFrame(true, wsOpBinary, true, append([]byte{streamStdin}, makeTar(t, map[string]string{"evil": "x"})...))...)
+	if n, err := tl.Write(stream); n != 0 || err != errTransferDenied {
+		t.Fatalf("archive went through: %d %v", n, err)
+	}
+	tl.closeTransfers()
+	if !strings.Contains(buf.String(), `"event":"transfer_denied","direction":"upload"`) {
+		t.Fatalf("denial was not logged: %s", buf.String())
+	}
+}